@@ -1,37 +1,175 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/awfufu/go-hurobot/internal/cmds"
 	"github.com/awfufu/go-hurobot/internal/config"
 	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/go-hurobot/internal/worker"
 	"github.com/awfufu/qbot"
 )
 
+var (
+	permImport = flag.String("perm-import", "", "启动时导入的权限文件 (YAML)")
+	permDryRun = flag.Bool("perm-dry-run", false, "只显示权限文件的差异然后退出")
+)
+
 func main() {
 	config.LoadConfigFile()
 	db.InitDB()
 	cmds.InitCommandPermissions()
+	cmds.InitDrawProviders()
+	cmds.InitPriceSources()
+	cmds.InitModeration()
+	if *permImport != "" {
+		importPermissions(*permImport, *permDryRun)
+	}
 
 	receiver := qbot.HttpServer(config.Cfg.HttpListen)
 	sender := qbot.HttpClient(config.Cfg.HttpRemote)
 
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// cmdCtx outlives sigCtx so that running commands get a chance to finish
+	cmdCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := func(msg *qbot.Message) {
+		handleMessage(cmdCtx, sender, msg)
+	}
+	wc := config.Cfg.Workers
+	wait := time.Duration(wc.SubmitTimeout) * time.Millisecond
+	// fast messages keep their per-group order, slow commands take any free
+	// worker so that one long /sh does not hold up other groups
+	fastPool := worker.NewPool("fast", wc.Fast.Workers, wc.Fast.QueueSize, true, wait, handler)
+	slowPool := worker.NewPool("slow", wc.Slow.Workers, wc.Slow.QueueSize, false, wait, handler)
+	pools := []*worker.Pool{fastPool, slowPool}
+
+	// notices are rare, they get their own goroutines
+	var bg sync.WaitGroup
+	bg.Go(func() {
+		cmds.RunGrantSweeper(sigCtx, sender)
+	})
+	// interrupted draw jobs stay queued for the next start
+	bg.Go(func() {
+		cmds.RunDrawQueue(sigCtx, sender)
+	})
+	bg.Go(func() {
+		cmds.RunCryptoAlerts(sigCtx, sender)
+	})
+
+loop:
 	for {
 		select {
-		case msg := <-receiver.OnMessage():
-			go func() {
-				if msg.ChatType != qbot.Group {
-					return
+		case msg, ok := <-receiver.OnMessage():
+			if !ok {
+				break loop
+			}
+			if msg.ChatType != qbot.Group {
+				continue
+			}
+			// a dropped message is still logged so that its recall can be shown
+			if cmds.IsSlowCommand(msg) {
+				if !slowPool.Submit(msg) {
+					saveMessage(msg)
+					bg.Go(func() {
+						sender.SendGroupReplyMsg(msg.GroupID, msg.MsgID, "Busy, please try again later")
+					})
 				}
-				defer db.SaveDatabase(msg)
+			} else if !fastPool.Submit(msg) {
+				saveMessage(msg)
+			}
+		case notice, ok := <-receiver.OnRecall():
+			if !ok {
+				break loop
+			}
+			bg.Go(func() {
+				cmds.HandleRecall(sender, notice)
+			})
+		case err, ok := <-receiver.Error():
+			if ok && err != nil {
+				log.Printf("receiver error: %v", err)
+			}
+			break loop
+		case <-sigCtx.Done():
+			log.Println("shutting down...")
+			break loop
+		}
+	}
 
-				if msg.UserID != config.Cfg.Permissions.BotID {
-					cmds.HandleCommand(sender, msg)
-				}
-			}()
-		case err := <-receiver.Error():
-			log.Fatal(err)
+	// also stops the background tasks if the loop ended without a signal
+	stop()
+
+	if err := receiver.Close(); err != nil {
+		log.Printf("failed to close receiver: %v", err)
+	}
+
+	for _, p := range pools {
+		p.Close()
+	}
+
+	timeout := time.Duration(config.Cfg.ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	cancelled := false
+	for _, p := range pools {
+		if !p.Wait(time.Until(deadline)) && !cancelled {
+			log.Printf("commands still running after %v, cancelling", timeout)
+			cancel()
+			cancelled = true
+		}
+		if cancelled && !p.Wait(5*time.Second) {
+			log.Printf("worker pool %s did not exit in time", p.Name())
 		}
+		st := p.Stats()
+		log.Printf("worker pool %s: %d handled, %d dropped", p.Name(), st.Handled, st.Dropped)
+	}
+
+	if !worker.WaitTimeout(&bg, 5*time.Second) {
+		log.Println("notice handlers did not exit in time")
+	}
+
+	if err := db.CloseDB(); err != nil {
+		log.Printf("failed to close database: %v", err)
+	}
+}
+
+func handleMessage(ctx context.Context, sender *qbot.Sender, msg *qbot.Message) {
+	defer saveMessage(msg)
+
+	if msg.UserID != config.Cfg.Permissions.BotID {
+		cmds.HandleCommand(ctx, sender, msg)
+	}
+}
+
+func saveMessage(msg *qbot.Message) {
+	if err := db.SaveDatabase(msg); err != nil {
+		log.Printf("failed to save message %d: %v", msg.MsgID, err)
+	}
+}
+
+// importPermissions logs the diff of a permission file and applies it, or
+// exits after logging it on a dry run.
+func importPermissions(path string, dryRun bool) {
+	diff, err := cmds.ImportPermissions(path, !dryRun)
+	if err != nil {
+		log.Fatalf("failed to import permissions from %s: %v", path, err)
+	}
+	for _, line := range diff {
+		log.Println(line)
+	}
+	if dryRun {
+		log.Printf("dry run: %d permission changes in %s", len(diff), path)
+		db.CloseDB()
+		os.Exit(0)
 	}
+	log.Printf("applied %d permission changes from %s", len(diff), path)
 }
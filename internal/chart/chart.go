@@ -0,0 +1,249 @@
+// Package chart renders price charts as PNG images. It only uses the
+// standard library and draws nothing that depends on the environment, so
+// the same input always gives the same bytes.
+package chart
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+type Kind int
+
+const (
+	Line Kind = iota
+	Candles
+)
+
+// Point is a candle, line charts only use Close
+type Point struct {
+	Time  time.Time
+	Open  float64
+	High  float64
+	Low   float64
+	Close float64
+}
+
+type Chart struct {
+	Title  string
+	Kind   Kind
+	Points []Point // oldest first, drawn at equal distances
+
+	Width    int            // 800 if 0
+	Height   int            // 450 if 0
+	Location *time.Location // for the time axis, UTC if nil
+}
+
+var (
+	background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	gridColor  = color.RGBA{0xe5, 0xe7, 0xeb, 0xff}
+	axisColor  = color.RGBA{0x9c, 0xa3, 0xaf, 0xff}
+	textColor  = color.RGBA{0x37, 0x41, 0x51, 0xff}
+	lineColor  = color.RGBA{0x25, 0x63, 0xeb, 0xff}
+	upColor    = color.RGBA{0x16, 0xa3, 0x4a, 0xff}
+	downColor  = color.RGBA{0xdc, 0x26, 0x26, 0xff}
+)
+
+const (
+	textScale = 2
+	padding   = 12
+	yTicks    = 5
+	xLabels   = 6
+)
+
+// Render encodes the chart as PNG
+func (c *Chart) Render(w io.Writer) error {
+	img, err := c.draw()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+func (c *Chart) draw() (*image.RGBA, error) {
+	if len(c.Points) < 2 {
+		return nil, errors.New("not enough data to draw a chart")
+	}
+	width, height := c.Width, c.Height
+	if width <= 0 {
+		width = 800
+	}
+	if height <= 0 {
+		height = 450
+	}
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, 0, 0, width, height, background)
+
+	lo, hi := c.valueRange()
+	step := niceStep((hi - lo) / yTicks)
+	lo, hi = math.Floor(lo/step)*step, math.Ceil(hi/step)*step
+	decimals := max(0, -int(math.Floor(math.Log10(step))))
+
+	var labels []string
+	labelWidth := 0
+	for v := lo; v <= hi+step/2; v += step {
+		s := strconv.FormatFloat(v, 'f', decimals, 64)
+		labels = append(labels, s)
+		labelWidth = max(labelWidth, textWidth(s, textScale))
+	}
+
+	lineHeight := glyphHeight * textScale
+	plot := image.Rect(padding+labelWidth+8, padding+lineHeight+padding, width-padding, height-padding-lineHeight-8)
+	if plot.Dx() < 50 || plot.Dy() < 50 {
+		return nil, errors.New("chart is too small")
+	}
+	drawText(img, plot.Min.X, padding, c.Title, textScale, textColor)
+
+	yOf := func(v float64) int {
+		return plot.Max.Y - int(math.Round((v-lo)/(hi-lo)*float64(plot.Dy())))
+	}
+	n := len(c.Points)
+	slot := float64(plot.Dx()) / float64(n)
+	xOf := func(i int) int {
+		return plot.Min.X + int(math.Round((float64(i)+0.5)*slot))
+	}
+
+	// horizontal grid with the value labels
+	for i, s := range labels {
+		y := yOf(lo + float64(i)*step)
+		fillRect(img, plot.Min.X, y, plot.Dx(), 1, gridColor)
+		drawText(img, plot.Min.X-8-textWidth(s, textScale), y-lineHeight/2, s, textScale, textColor)
+	}
+
+	// time labels, with the time of day for intraday data over a few days
+	layout := "01-02"
+	if c.Points[n-1].Time.Sub(c.Points[0].Time) <= 72*time.Hour && c.Points[1].Time.Sub(c.Points[0].Time) < 24*time.Hour {
+		layout = "01-02 15:04"
+	}
+	// as many labels as fit side by side with a gap between them, labels
+	// sit on points so their spacing may be up to one slot short
+	gap := 4 * textScale
+	span := xOf(n-1) - xOf(0) - int(math.Ceil(slot))
+	fit := span/(textWidth(layout, textScale)+gap) + 1
+	labelCount := max(min(xLabels, n, fit), 2)
+	textEnd := math.MinInt
+	for k := range labelCount {
+		i := k * (n - 1) / (labelCount - 1)
+		x := xOf(i)
+		s := c.Points[i].Time.In(loc).Format(layout)
+		fillRect(img, x, plot.Min.Y, 1, plot.Dy(), gridColor)
+		tw := textWidth(s, textScale)
+		tx := min(max(x-tw/2, 0), width-tw)
+		if tx < textEnd+gap {
+			continue
+		}
+		drawText(img, tx, plot.Max.Y+8, s, textScale, textColor)
+		textEnd = tx + tw
+	}
+
+	fillRect(img, plot.Min.X, plot.Min.Y, 1, plot.Dy()+1, axisColor)
+	fillRect(img, plot.Min.X, plot.Max.Y, plot.Dx(), 1, axisColor)
+
+	switch c.Kind {
+	case Candles:
+		body := max(1, int(slot*0.7))
+		for i, p := range c.Points {
+			col := upColor
+			if p.Close < p.Open {
+				col = downColor
+			}
+			x := xOf(i)
+			fillRect(img, x, yOf(p.High), 1, yOf(p.Low)-yOf(p.High)+1, col)
+			top, bottom := yOf(max(p.Open, p.Close)), yOf(min(p.Open, p.Close))
+			fillRect(img, x-body/2, top, body, max(bottom-top, 1), col)
+		}
+	default:
+		for i := 1; i < n; i++ {
+			drawLine(img, xOf(i-1), yOf(c.Points[i-1].Close), xOf(i), yOf(c.Points[i].Close), lineColor)
+		}
+	}
+	return img, nil
+}
+
+// valueRange returns the lowest and highest value to show
+func (c *Chart) valueRange() (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, p := range c.Points {
+		if c.Kind == Candles {
+			lo, hi = min(lo, p.Low), max(hi, p.High)
+		} else {
+			lo, hi = min(lo, p.Close), max(hi, p.Close)
+		}
+	}
+	if hi-lo <= 1e-9*math.Abs(hi) {
+		// a flat line still needs some room
+		d := math.Max(math.Abs(hi)*0.01, 1e-6)
+		lo, hi = lo-d, hi+d
+	}
+	return lo, hi
+}
+
+// niceStep rounds a raw tick distance to 1, 2 or 5 times a power of ten
+func niceStep(raw float64) float64 {
+	exp := math.Pow(10, math.Floor(math.Log10(raw)))
+	switch f := raw / exp; {
+	case f <= 1:
+		return exp
+	case f <= 2:
+		return 2 * exp
+	case f <= 5:
+		return 5 * exp
+	default:
+		return 10 * exp
+	}
+}
+
+func fillRect(img *image.RGBA, x, y, w, h int, c color.RGBA) {
+	r := image.Rect(x, y, x+w, y+h).Intersect(img.Bounds())
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			img.SetRGBA(px, py, c)
+		}
+	}
+}
+
+// drawLine draws a two pixel wide line with Bresenham's algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		fillRect(img, x0, y0, 2, 2, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
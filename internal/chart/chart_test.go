@@ -0,0 +1,96 @@
+package chart
+
+import (
+	"bytes"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testPoints is a fixed hourly series that rises and falls
+func testPoints() []Point {
+	start := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	points := make([]Point, 48)
+	price := 100.0
+	for i := range points {
+		open := price
+		price += 3*math.Sin(float64(i)/5) + float64(i%7-3)/2
+		points[i] = Point{
+			Time:  start.Add(time.Duration(i) * time.Hour),
+			Open:  open,
+			High:  math.Max(open, price) + 1.25,
+			Low:   math.Min(open, price) - 0.75,
+			Close: price,
+		}
+	}
+	return points
+}
+
+func TestRenderGolden(t *testing.T) {
+	tests := []struct {
+		file  string
+		chart Chart
+	}{
+		{"candles.png", Chart{Title: "BTC-USDT-SWAP 2D  +1.23%", Kind: Candles, Points: testPoints(), Location: time.UTC}},
+		{"line.png", Chart{Title: "USD/CNY 2D", Kind: Line, Points: testPoints(), Width: 640, Height: 360, Location: time.UTC}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.chart.Render(&buf); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", tt.file)
+			if *update {
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v, run go test -update to create it", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("%s differs from the rendered chart, run go test -update and check the image", path)
+			}
+		})
+	}
+}
+
+func TestRenderDeterministic(t *testing.T) {
+	c := Chart{Title: "X", Kind: Candles, Points: testPoints(), Location: time.UTC}
+	var a, b bytes.Buffer
+	if err := c.Render(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Render(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("two renders of the same chart differ")
+	}
+}
+
+func TestRenderTooFewPoints(t *testing.T) {
+	c := Chart{Points: testPoints()[:1]}
+	if err := c.Render(&bytes.Buffer{}); err == nil {
+		t.Error("rendered a chart of one point")
+	}
+}
+
+func TestFlatSeries(t *testing.T) {
+	points := testPoints()
+	for i := range points {
+		points[i] = Point{Time: points[i].Time, Open: 5, High: 5, Low: 5, Close: 5}
+	}
+	c := Chart{Kind: Line, Points: points, Location: time.UTC}
+	if err := c.Render(&bytes.Buffer{}); err != nil {
+		t.Errorf("flat series: %v", err)
+	}
+}
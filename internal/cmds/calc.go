@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"context"
 	"fmt"
 	"math"
 
@@ -72,7 +73,7 @@ var calcFunctions = map[string]govaluate.ExpressionFunction{
 	"min":   binaryMathOp(math.Min),
 }
 
-func calcExec(b *qbot.Sender, msg *qbot.Message) {
+func calcExec(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	exprString := ""
 	for _, item := range msg.Array[1:] {
 		if item.Type() == qbot.TextType {
@@ -0,0 +1,214 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/chart"
+	"github.com/awfufu/go-hurobot/internal/market"
+	"github.com/awfufu/qbot"
+)
+
+// chartMaxDays limits the period of /crypto chart and /fx chart
+const chartMaxDays = 180
+
+// fxChartMinDays is the shortest /fx chart period, the reference rates are
+// published once per working day
+const fxChartMinDays = 7
+
+// parseChartPeriod parses a period like 7d of at least minDays, def is
+// used for ""
+func parseChartPeriod(s string, def int, minDays int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(s), "d"))
+	if err != nil || !strings.HasSuffix(strings.ToLower(s), "d") || n < minDays || n > chartMaxDays {
+		return 0, fmt.Errorf("Invalid period %s, use %dd-%dd", s, minDays, chartMaxDays)
+	}
+	return n, nil
+}
+
+// chartTitle names the chart and sums up the change over its period
+func chartTitle(name string, days int, points []chart.Point) string {
+	first, last := points[0], points[len(points)-1]
+	open := first.Open
+	if open == 0 {
+		open = first.Close
+	}
+	title := fmt.Sprintf("%s %dD  %s", name, days, formatPrice(last.Close))
+	if open > 0 {
+		title += fmt.Sprintf("  %+.2f%%", (last.Close-open)/open*100)
+	}
+	return title
+}
+
+// sendChart renders c as a reply to msg and reports whether it was sent
+func sendChart(b *qbot.Sender, msg *qbot.Message, c *chart.Chart) bool {
+	var buf bytes.Buffer
+	if err := c.Render(&buf); err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+	_, err := b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, qbot.Image("base64://"+base64.StdEncoding.EncodeToString(buf.Bytes())))
+	return err == nil
+}
+
+// execCryptoChart handles /crypto chart <coin> [period] [--line] and reports
+// whether a chart was sent. args are upper case and do not contain --spot.
+func execCryptoChart(ctx context.Context, b *qbot.Sender, msg *qbot.Message, args []string, spot bool) bool {
+	kind := chart.Candles
+	if slices.Contains(args, "--LINE") {
+		kind = chart.Line
+		args = slices.DeleteFunc(args, func(s string) bool { return s == "--LINE" })
+	}
+	if len(args) < 1 || len(args) > 2 {
+		b.SendGroupMsg(msg.GroupID, "Usage: /crypto chart <coin> [period] [--line] [--spot]")
+		return false
+	}
+	period := ""
+	if len(args) == 2 {
+		period = args[1]
+	}
+	days, err := parseChartPeriod(period, 7, 1)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+
+	// keep the number of candles between 24 and 180
+	var interval time.Duration
+	switch {
+	case days == 1:
+		interval = market.Interval15m
+	case days <= 7:
+		interval = market.Interval1h
+	case days <= 30:
+		interval = market.Interval4h
+	default:
+		interval = market.Interval1d
+	}
+	limit := int(time.Duration(days) * 24 * time.Hour / interval)
+
+	inst := market.Instrument{Base: args[0], Quote: "USDT", Spot: spot}
+	candles, source, err := priceChain.Candles(ctx, inst, interval, limit)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Query failed: %s", err.Error()))
+		return false
+	}
+
+	points := make([]chart.Point, len(candles))
+	for i, c := range candles {
+		points[i] = chart.Point{Time: c.Time, Open: c.Open, High: c.High, Low: c.Low, Close: c.Close}
+	}
+	if len(points) < 2 {
+		b.SendGroupMsg(msg.GroupID, "Not enough data to draw a chart")
+		return false
+	}
+	name := inst.String()
+	if sources := priceChain.Sources(); len(sources) > 0 && source != sources[0] {
+		name += " (" + source + ")"
+	}
+	return sendChart(b, msg, &chart.Chart{
+		Title:    chartTitle(name, days, points),
+		Kind:     kind,
+		Points:   points,
+		Location: time.Local,
+	})
+}
+
+type frankfurterResp struct {
+	Rates map[string]map[string]float64 `json:"rates"` // date -> currency -> rate
+}
+
+// getFxHistory returns the daily reference rates of the European Central
+// Bank from Frankfurter, oldest first
+func getFxHistory(ctx context.Context, from string, to string, days int) ([]chart.Point, error) {
+	start := time.Now().UTC().AddDate(0, 0, -days).Format("2006-01-02")
+	q := url.Values{}
+	q.Set("from", from)
+	q.Set("to", to)
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.frankfurter.app/"+start+"..?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := apiClient("frankfurter", 10*time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity {
+		return nil, fmt.Errorf("unsupported currency pair %s/%s", from, to)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+
+	return parseFxHistory(resp.Body, to)
+}
+
+// parseFxHistory reads the rates into to from a Frankfurter time series
+// response, oldest first
+func parseFxHistory(r io.Reader, to string) ([]chart.Point, error) {
+	var data frankfurterResp
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	var points []chart.Point
+	for date, rates := range data.Rates {
+		t, err := time.Parse("2006-01-02", date)
+		rate, ok := rates[to]
+		if err != nil || !ok {
+			continue
+		}
+		points = append(points, chart.Point{Time: t, Close: rate})
+	}
+	slices.SortFunc(points, func(a, b chart.Point) int { return a.Time.Compare(b.Time) })
+	return points, nil
+}
+
+// execFxChart handles /fx chart <from> <to> [period] and reports whether a
+// chart was sent
+func execFxChart(ctx context.Context, b *qbot.Sender, msg *qbot.Message, args []string) bool {
+	if len(args) < 2 || len(args) > 3 {
+		b.SendGroupMsg(msg.GroupID, "Usage: /fx chart <from_currency> <to_currency> [period]")
+		return false
+	}
+	period := ""
+	if len(args) == 3 {
+		period = args[2]
+	}
+	days, err := parseChartPeriod(period, 30, fxChartMinDays)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+	from, to := strings.ToUpper(args[0]), strings.ToUpper(args[1])
+
+	points, err := getFxHistory(ctx, from, to, days)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
+		return false
+	}
+	if len(points) < 2 {
+		b.SendGroupMsg(msg.GroupID, "Not enough data to draw a chart")
+		return false
+	}
+	return sendChart(b, msg, &chart.Chart{
+		Title:  chartTitle(from+"/"+to, days, points),
+		Kind:   chart.Line,
+		Points: points,
+	})
+}
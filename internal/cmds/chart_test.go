@@ -0,0 +1,69 @@
+package cmds
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChartPeriod(t *testing.T) {
+	tests := []struct {
+		in      string
+		minDays int
+		want    int
+		wantErr bool
+	}{
+		{"", 1, 7, false},
+		{"1d", 1, 1, false},
+		{"30D", 1, 30, false},
+		{"180d", 1, 180, false},
+		{"181d", 1, 0, true},
+		{"0d", 1, 0, true},
+		{"7", 1, 0, true},
+		{"1w", 1, 0, true},
+		{"2d", fxChartMinDays, 0, true},
+		{"7d", fxChartMinDays, 7, false},
+	}
+	for _, tt := range tests {
+		got, err := parseChartPeriod(tt.in, 7, tt.minDays)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseChartPeriod(%q, 7, %d) = %d, %v; want %d, error %v", tt.in, tt.minDays, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseFxHistory(t *testing.T) {
+	f, err := os.Open("testdata/frankfurter_usd_cny.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	points, err := parseFxHistory(f, "CNY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 6 {
+		t.Fatalf("got %d points, want 6", len(points))
+	}
+	first, last := points[0], points[len(points)-1]
+	if want := time.Date(2026, 10, 9, 0, 0, 0, 0, time.UTC); !first.Time.Equal(want) || first.Close != 7.1302 {
+		t.Errorf("first point = %v %v", first.Time, first.Close)
+	}
+	if want := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC); !last.Time.Equal(want) || last.Close != 7.1187 {
+		t.Errorf("last point = %v %v", last.Time, last.Close)
+	}
+	for i := 1; i < len(points); i++ {
+		if !points[i-1].Time.Before(points[i].Time) {
+			t.Errorf("points not sorted at %d", i)
+		}
+	}
+
+	if points, err := parseFxHistory(strings.NewReader(`{"rates":{"2026-10-09":{"EUR":0.91}}}`), "CNY"); err != nil || len(points) != 0 {
+		t.Errorf("other currency: %v, %v", points, err)
+	}
+	if _, err := parseFxHistory(strings.NewReader(`<html>`), "CNY"); err == nil {
+		t.Error("no error for a broken response")
+	}
+}
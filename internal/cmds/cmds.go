@@ -1,6 +1,8 @@
 package cmds
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"slices"
 	"strconv"
@@ -13,13 +15,15 @@ import (
 )
 
 type Command struct {
-	Name       string            // Command name
-	HelpMsg    string            // Help message
-	Permission config.Permission // Permission requirement
-	NeedRawMsg bool
-	MaxArgs    int                                     // Maximum number of arguments
-	MinArgs    int                                     // Minimum number of arguments
-	Exec       func(b *qbot.Sender, msg *qbot.Message) // Execute function
+	Name         string            // Command name
+	HelpMsg      string            // Help message
+	Permission   config.Permission // Permission requirement
+	NeedRawMsg   bool
+	Slow         bool                                                         // Calls external services, handled by the slow worker pool
+	MaxArgs      int                                                          // Maximum number of arguments
+	MinArgs      int                                                          // Minimum number of arguments
+	ChargesQuota bool                                                         // Exec counts its quota through chargeQuota, only for calls that use a paid service
+	Exec         func(ctx context.Context, b *qbot.Sender, msg *qbot.Message) // Execute function
 }
 
 const commandPrefix = '/'
@@ -36,8 +40,11 @@ func init() {
 		"fx":           erCommand,
 		"group":        groupCommand,
 		"perm":         permCommand,
+		"quota":        quotaCommand,
+		"recall":       recallCommand,
 		"sh":           shCommand,
 		"specialtitle": specialtitleCommand,
+		"usage":        usageCommand,
 		"which":        whichCommand,
 		"calc":         calcCommand,
 	}
@@ -52,43 +59,34 @@ func InitCommandPermissions() {
 			continue
 		}
 
-		// Map config.Permission to int
-		// 0:guest, 1:admin, 2:master
-		var userAllow int
-		switch base.Permission {
-		case config.Guest:
-			userAllow = 0
-		case config.Admin:
-			userAllow = 1
-		case config.Master:
-			userAllow = 2
-		default:
-			userAllow = 2
-		}
-
 		newPerm := &db.DbPermissions{
-			Command:          name,
-			UserAllow:        userAllow,
-			SpecialUsers:     "",
-			IsWhitelistUsers: 0, // blacklist mode by default (empty blacklist = allow nobody? No, blacklist means if in list then block. If list empty, all allowed? Wait. Logic check needed.)
-			// Wait, if IsWhitelist, only those in list are allowed.
-			// If IsBlacklist (0), those in list are blocked.
-			// Default blacklist empty means NO special blocks.
-			// BUT GroupEnable is 0 (disable). So groups are disabled by default.
-			// UserAllow depends on role.
-			SpecialGroups:     "",
+			Command:           name,
+			RequiredRole:      string(base.Permission),
+			IsWhitelistUsers:  0, // blacklist mode, an empty list blocks nobody
 			IsWhitelistGroups: 0,
 		}
 
 		if err := db.SaveCommandPermission(newPerm); err != nil {
 			log.Printf("Failed to init permission for %s: %v", name, err)
 		} else {
-			log.Printf("Initialized permission for command: %s (user_allow: %d)", name, userAllow)
+			log.Printf("Initialized permission for command: %s (required_role: %s)", name, newPerm.RequiredRole)
 		}
 	}
 }
 
-func HandleCommand(b *qbot.Sender, msg *qbot.Message) {
+// IsSlowCommand reports whether msg invokes a command marked as Slow.
+func IsSlowCommand(msg *qbot.Message) bool {
+	cmdName, _, _ := parseCmd(msg)
+	if cmdName == "" {
+		return false
+	}
+	cmd, exists := cmdMap[cmdName]
+	return exists && cmd.Slow
+}
+
+// HandleCommand parses and runs the command in msg. ctx is cancelled when the
+// bot is shutting down, long-running commands should return once it is done.
+func HandleCommand(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	cmdName, argsItems, raw := parseCmd(msg)
 
 	if cmdName == "" {
@@ -97,13 +95,20 @@ func HandleCommand(b *qbot.Sender, msg *qbot.Message) {
 
 	cmd, exists := cmdMap[cmdName]
 	if !exists {
+		suggestCommand(b, msg, cmdName)
 		return
 	}
 
 	cmdBase := cmd
 
+	// commands switched off in this group behave as if they did not exist
+	if !commandEnabled(cmdBase.Name, msg.GroupID) {
+		return
+	}
+
 	// check permission
-	if !checkCmdPermission(cmdBase.Name, msg.UserID, msg.GroupID) {
+	rememberGroupRole(msg.GroupID, msg.UserID, msg.GroupRole)
+	if !checkCmdPermission(b, cmdBase.Name, msg.UserID, msg.GroupID) {
 		b.SendGroupMsg(msg.GroupID, cmdBase.Name+": Permission denied")
 		return
 	}
@@ -155,10 +160,18 @@ func HandleCommand(b *qbot.Sender, msg *qbot.Message) {
 		return
 	}
 
+	// daily limits, checked last so that help requests are not counted
+	ctx = withCaller(ctx, cmdBase.Name, msg.UserID, msg.GroupID)
+	if !cmdBase.ChargesQuota {
+		if _, ok := checkQuota(b, msg, cmdBase.Name); !ok {
+			return
+		}
+	}
+
 	// execute command
 	newMsg := *msg
 	newMsg.Array = args
-	cmd.Exec(b, &newMsg)
+	cmd.Exec(ctx, b, &newMsg)
 }
 
 // calculate the number of prefixes to skip
@@ -257,88 +270,116 @@ func getCmdPermLevel(cmdName string) config.Permission {
 	return config.Master
 }
 
-func checkCmdPermission(cmdName string, userID qbot.UserID, groupID qbot.GroupID) bool {
+func checkCmdPermission(b *qbot.Sender, cmdName string, userID qbot.UserID, groupID qbot.GroupID) bool {
+	return evalCmdPermission(b, cmdName, userID, groupID, nil)
+}
+
+// evalCmdPermission decides whether a user may run cmdName in groupID. If
+// trace is not nil every step appends its verdict to it, /perm explain uses
+// this to show why a command is allowed or denied.
+func evalCmdPermission(b *qbot.Sender, cmdName string, userID qbot.UserID, groupID qbot.GroupID, trace *[]string) bool {
+	note := func(format string, args ...any) {
+		if trace != nil {
+			*trace = append(*trace, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// 0. Group Switch
+	if !commandEnabled(cmdName, groupID) {
+		note("group switch: disabled in group %d -> deny", groupID)
+		return false
+	}
+	note("group switch: enabled")
+
 	// 1. Master Bypass
 	if userID == config.Cfg.Permissions.MasterID {
+		note("master bypass: yes -> allow")
 		return true
 	}
+	note("master bypass: no")
 
 	// 2. Load Permissions from DB
 	perm := db.GetCommandPermission(cmdName)
 
-	var userAllow int = 2 // default master
+	var requiredRole string = db.RoleMaster
 	var specialUsers []uint64
 	var isWhitelistUsers int = 0 // default blacklist
 	var specialGroups []uint64
 	var isWhitelistGroup int = 0 // default blacklist
 
 	if perm != nil {
-		userAllow = perm.UserAllow
-		specialUsers = perm.ParseSpecialUsers()
+		requiredRole = perm.RequiredRole
+		specialUsers = perm.SpecialUsers
 		isWhitelistUsers = perm.IsWhitelistUsers
-		specialGroups = perm.ParseSpecialGroups()
+		specialGroups = perm.SpecialGroups
 		isWhitelistGroup = perm.IsWhitelistGroups
+		note("rule: found, required role %s", requiredRole)
+	} else {
+		note("rule: none, required role defaults to %s", requiredRole)
 	}
 
 	// 3. User Special List Check
 	if slices.Contains(specialUsers, uint64(userID)) {
 		if isWhitelistUsers == 1 {
 			// Whitelist mode: User in list -> Allow
+			note("special users (whitelist): listed -> allow")
 			return true
 		} else {
 			// Blacklist mode: User in list -> Block
+			note("special users (blacklist): listed -> deny")
 			return false
 		}
 	}
-
-	// 4. User Role Check
-	userRole := GetUserPermission(userID)
-	var requiredPerm config.Permission
-	// Map DB int (0,1,2) to config.Permission
-	switch userAllow {
-	case 0:
-		requiredPerm = config.Guest
-	case 1:
-		requiredPerm = config.Admin
-	case 2:
-		requiredPerm = config.Master
-	default:
-		requiredPerm = config.Master
+	note("special users (%s): not listed", listMode(isWhitelistUsers))
+
+	// 4. User Role Check, commands that manage roles only count global
+	// roles so that a group role cannot be used to escalate
+	roleGroup := groupID
+	if slices.Contains(globalRoleCommands, cmdName) {
+		roleGroup = qbot.GroupID(db.GlobalGroup)
+		note("roles: only global roles count for %s", cmdName)
 	}
-
-	if userRole < requiredPerm {
+	if !userHasRole(b, userID, roleGroup, requiredRole) {
+		note("roles: [%s] do not satisfy %s -> deny", strings.Join(userRoles(b, userID, roleGroup), ", "), requiredRole)
 		return false
 	}
+	note("roles: [%s] satisfy %s", strings.Join(userRoles(b, userID, roleGroup), ", "), requiredRole)
 
 	// 5. Group Special List Check
 	if slices.Contains(specialGroups, uint64(groupID)) {
 		if isWhitelistGroup == 1 {
 			// Whitelist mode: Group in list -> Allow
+			note("special groups (whitelist): listed -> allow")
 			return true
 		} else {
 			// Blacklist mode: Group in list -> Block
+			note("special groups (blacklist): listed -> deny")
 			return false
 		}
 	}
+	note("special groups (%s): not listed -> allow", listMode(isWhitelistGroup))
 	return true
 }
 
-func GetUserPermission(userID qbot.UserID) config.Permission {
-	if userID == config.Cfg.Permissions.MasterID {
-		return config.Master
+func listMode(isWhitelist int) string {
+	if isWhitelist == 1 {
+		return "whitelist"
 	}
+	return "blacklist"
+}
 
-	perm := db.GetUserPerm(uint64(userID))
-	switch perm {
-	case 0:
-		return config.Guest
-	case 1:
-		return config.Admin
-	case 2:
-		return config.Master // Should not theoretically happen via DB if MasterID is separate, but allows granting Master via DB
-	default:
-		return config.Guest
+// globalRoleCommands are checked against global roles only, group roles and
+// mapped QQ roles do not count for them
+var globalRoleCommands = []string{"perm"}
+
+// userHasRole reports whether the user holds a role in groupID, or globally,
+// that satisfies required. The configured master always does. Pass
+// db.GlobalGroup to only consider global roles.
+func userHasRole(b *qbot.Sender, userID qbot.UserID, groupID qbot.GroupID, required string) bool {
+	if userID == config.Cfg.Permissions.MasterID {
+		return true
 	}
+	return db.RolesSatisfy(userRoles(b, userID, groupID), required)
 }
 
 func decodeSpecialChars(raw string) string {
@@ -1,16 +1,20 @@
 package cmds
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/market"
 	"github.com/awfufu/qbot"
 )
 
@@ -58,144 +62,314 @@ type OkxInstrument struct {
 	Uly              string `json:"uly"`
 }
 
-type TickerResp struct {
-	Code string `json:"code"`
-	Msg  string `json:"msg"`
-	Data []struct {
-		InstId string `json:"instId"`
-		Last   string `json:"last"`
-	} `json:"data"`
-}
-
 const cryptoHelpMsg string = `Query cryptocurrency prices.
 Usage:
-  /crypto <coin>                 - Query coin price in USDT
-  /crypto <from_coin> <to_coin>  - Query coin price in target currency
+  /crypto <coin>                 - Price, 24h change, range and volume in USDT
+  /crypto <from_coin> <currency> - Query coin price in a fiat currency
+  /crypto <coin> <coin> ...      - Compare up to 10 coins in a table
+  /crypto alert <coin> >|< <price> [--once] - @ you when the price crosses it
+  /crypto alerts [list]          - List your alerts
+  /crypto alerts rm <id>         - Remove an alert
+  /crypto chart <coin> [1d-180d] [--line] - Candlestick chart, 7d by default
+Perpetual swap prices are used unless --spot is given.
 Examples:
   /crypto BTC
-  /crypto BTC USD`
+  /crypto BTC USD --spot
+  /crypto BTC ETH SOL
+  /crypto alert ETH < 2000 --once`
 
 var cryptoCommand *Command = &Command{
-	Name:       "crypto",
-	HelpMsg:    cryptoHelpMsg,
-	Permission: getCmdPermLevel("crypto"),
-	NeedRawMsg: false,
-	MaxArgs:    3,
-	MinArgs:    2,
-	Exec:       execCrypto,
-}
-
-func execCrypto(b *qbot.Sender, msg *qbot.Message) {
-	if len(msg.Array) == 2 {
-		if msg.Array[1].Type() == qbot.TextType {
-			coin := strings.ToUpper(msg.Array[1].Text())
-			handleSingleCrypto(b, msg, coin)
+	Name:         "crypto",
+	HelpMsg:      cryptoHelpMsg,
+	Permission:   getCmdPermLevel("crypto"),
+	NeedRawMsg:   false,
+	Slow:         true,
+	MaxArgs:      cryptoMaxCoins + 2,
+	MinArgs:      2,
+	ChargesQuota: true,
+	Exec:         execCrypto,
+}
+
+// cryptoMaxCoins limits how many coins one /crypto table may show
+const cryptoMaxCoins = 10
+
+// fiatCurrencies are the currencies /crypto <coin> <currency> always
+// converts to, see isCurrency for the others
+var fiatCurrencies = map[string]bool{
+	"USD": true, "CNY": true, "HKD": true, "TWD": true, "JPY": true, "KRW": true,
+	"EUR": true, "GBP": true, "CHF": true, "RUB": true, "SGD": true, "AUD": true,
+	"CAD": true, "NZD": true, "INR": true, "THB": true, "MYR": true, "VND": true,
+	"PHP": true, "IDR": true, "TRY": true, "BRL": true, "MXN": true, "AED": true,
+	// stablecoins keep their old meaning
+	"USDT": true, "USDC": true,
+}
+
+// currencyCodes caches the currencies the exchange rate API lists
+var currencyCodes struct {
+	sync.Mutex
+	codes   map[string]bool
+	fetched time.Time
+}
+
+// isCurrency reports whether the second argument of /crypto <coin> <code>
+// is a currency to convert to rather than another coin. Besides
+// fiatCurrencies that is any 3 letter code the exchange rate API lists, the
+// list is fetched at most once a day.
+func isCurrency(ctx context.Context, code string) bool {
+	if fiatCurrencies[code] {
+		return true
+	}
+	if len(code) != 3 || config.Cfg.ApiKeys.ExchangeRateAPIKey == "" {
+		return false
+	}
+
+	currencyCodes.Lock()
+	defer currencyCodes.Unlock()
+	if time.Since(currencyCodes.fetched) > 24*time.Hour {
+		rates, err := getExchangeRates(ctx, "USD")
+		if err != nil {
+			log.Printf("failed to list currencies: %v", err)
+			return false
+		}
+		currencyCodes.codes = make(map[string]bool, len(rates))
+		for c := range rates {
+			currencyCodes.codes[c] = true
+		}
+		currencyCodes.fetched = time.Now()
+	}
+	return currencyCodes.codes[code]
+}
+
+var priceChain = market.NewChain(0)
+
+// InitPriceSources sets up the crypto price sources in the configured order
+func InitPriceSources() {
+	names := config.Cfg.Crypto.Sources
+	if len(names) == 0 {
+		if config.Cfg.ApiKeys.OkxMirrorAPIKey != "" {
+			names = append(names, market.SourceOKXMirror)
+		}
+		names = append(names, market.SourceOKX, market.SourceBinance, market.SourceCoinGecko)
+	}
+
+	var sources []market.Source
+	for _, name := range names {
+		proxy, apiKey := config.Cfg.Crypto.Proxy, ""
+		switch name {
+		case market.SourceOKXMirror:
+			proxy, apiKey = "", config.Cfg.ApiKeys.OkxMirrorAPIKey
+		case market.SourceCoinGecko:
+			apiKey = config.Cfg.Crypto.CoinGeckoKey
+		}
+		client, err := proxiedAPIClient(name, 10*time.Second, proxy)
+		if err != nil {
+			log.Printf("price source %s: %v", name, err)
+			continue
 		}
-	} else if len(msg.Array) == 3 {
-		coin := ""
-		currency := ""
-		if msg.Array[1].Type() == qbot.TextType {
-			coin = strings.ToUpper(msg.Array[1].Text())
+		s, err := market.New(name, apiKey, client)
+		if err != nil {
+			log.Printf("price source %s: %v", name, err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+	priceChain = market.NewChain(time.Duration(config.Cfg.Crypto.CacheTTL)*time.Second, sources...)
+	log.Printf("crypto price sources: %s", strings.Join(priceChain.Sources(), ", "))
+}
+
+func execCrypto(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
+	var args []string
+	spot := false
+	for _, item := range msg.Array[1:] {
+		if item.Type() != qbot.TextType {
+			continue
 		}
-		if msg.Array[2].Type() == qbot.TextType {
-			currency = strings.ToUpper(msg.Array[2].Text())
+		if item.Text() == "--spot" {
+			spot = true
+		} else {
+			args = append(args, strings.ToUpper(item.Text()))
 		}
-		if coin != "" && currency != "" {
-			handleCryptoCurrencyPair(b, msg, coin, currency)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "ALERT":
+			chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+				return execCryptoAlert(ctx, b, msg, args[1:], spot)
+			})
+			return
+		case "ALERTS":
+			// listing and removing alerts is not counted
+			execCryptoAlerts(b, msg, args[1:])
+			return
+		case "CHART":
+			chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+				return execCryptoChart(ctx, b, msg, args[1:], spot)
+			})
+			return
 		}
-	} else {
+	}
+
+	var query func(ctx context.Context) bool
+	switch {
+	case len(args) == 1:
+		query = func(ctx context.Context) bool { return handleSingleCrypto(ctx, b, msg, args[0], spot) }
+	case len(args) == 2 && isCurrency(ctx, args[1]):
+		query = func(ctx context.Context) bool { return handleCryptoCurrencyPair(ctx, b, msg, args[0], args[1], spot) }
+	case len(args) >= 2 && len(args) <= cryptoMaxCoins:
+		query = func(ctx context.Context) bool { return handleCryptoTable(ctx, b, msg, args, spot) }
+	default:
 		b.SendGroupMsg(msg.GroupID, cryptoHelpMsg)
+		return
 	}
+	chargeQuota(ctx, b, msg, query)
 }
 
-func handleSingleCrypto(b *qbot.Sender, msg *qbot.Message, coin string) {
+func handleSingleCrypto(ctx context.Context, b *qbot.Sender, msg *qbot.Message, coin string, spot bool) bool {
 	log.Printf("Query single cryptocurrency: %s", coin)
-	price, err := getCryptoPrice(coin, "USDT")
+	ticker, err := getCryptoPrice(ctx, coin, "USDT", spot)
 	if err != nil {
 		log.Printf("Failed to query %s price: %v", coin, err)
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Query failed: %s", err.Error()))
-		return
+		return false
 	}
-	b.SendGroupMsg(msg.GroupID, fmt.Sprintf("1 %s = %s USDT", coin, price))
+	b.SendGroupMsg(msg.GroupID, describeTicker(coin, ticker))
+	return true
 }
 
-func handleCryptoCurrencyPair(b *qbot.Sender, msg *qbot.Message, fromCoin string, toCurrency string) {
+// describeTicker shows the price of coin with the 24h statistics the source
+// reported
+func describeTicker(coin string, t *market.Ticker) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "1 %s = %s %s%s", coin, formatPrice(t.Last), t.Quote, describeTickerSource(t))
+	if abs, pct, ok := t.Change24h(); ok {
+		fmt.Fprintf(&sb, "\n24h: %s (%+.2f%%)", formatSigned(abs), pct)
+	}
+	if t.High24h > 0 && t.Low24h > 0 {
+		fmt.Fprintf(&sb, "\nRange: %s - %s", formatPrice(t.Low24h), formatPrice(t.High24h))
+	}
+	if t.Vol24h > 0 {
+		fmt.Fprintf(&sb, "\nVolume: %s %s", formatVolume(t.Vol24h), coin)
+	}
+	return sb.String()
+}
+
+// handleCryptoTable queries several coins at once and lists them one per
+// line. It reports whether any coin was found.
+func handleCryptoTable(ctx context.Context, b *qbot.Sender, msg *qbot.Message, coins []string, spot bool) bool {
+	log.Printf("Query cryptocurrencies: %s", strings.Join(coins, ", "))
+	tickers := make([]*market.Ticker, len(coins))
+	errs := make([]error, len(coins))
+	var wg sync.WaitGroup
+	for i, coin := range coins {
+		wg.Go(func() {
+			tickers[i], errs[i] = getCryptoPrice(ctx, coin, "USDT", spot)
+		})
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	sb.WriteString("Coin  Price (USDT)  24h")
+	for i, coin := range coins {
+		fmt.Fprintf(&sb, "\n%-5s ", coin)
+		t := tickers[i]
+		if errs[i] != nil {
+			log.Printf("Failed to query %s price: %v", coin, errs[i])
+			sb.WriteString("query failed")
+			continue
+		}
+		sb.WriteString(formatPrice(t.Last))
+		if _, pct, ok := t.Change24h(); ok {
+			fmt.Fprintf(&sb, "  %+.2f%%", pct)
+		}
+		sb.WriteString(describeTickerSource(t))
+	}
+	b.SendGroupMsg(msg.GroupID, sb.String())
+	return slices.ContainsFunc(errs, func(err error) bool { return err == nil })
+}
+
+func handleCryptoCurrencyPair(ctx context.Context, b *qbot.Sender, msg *qbot.Message, fromCoin string, toCurrency string, spot bool) bool {
 	log.Printf("Query cryptocurrency pair: %s -> %s", fromCoin, toCurrency)
 
-	usdPrice, err := getCryptoPrice(fromCoin, "USD")
+	ticker, err := getCryptoPrice(ctx, fromCoin, "USD", spot)
 	if err != nil {
 		log.Printf("Failed to query %s USD price: %v", fromCoin, err)
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Failed to query %s price: %s", fromCoin, err.Error()))
-		return
-	}
-
-	usdPriceFloat, err := strconv.ParseFloat(usdPrice, 64)
-	if err != nil {
-		log.Printf("Price parsing failed: %v", err)
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Price parsing failed: %s", err.Error()))
-		return
+		return false
 	}
+	usdPriceFloat := ticker.Last
 
 	if toCurrency == "USD" {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%s latest USD price: %.4f", fromCoin, usdPriceFloat))
-		return
+		return true
 	}
 
 	log.Printf("Need exchange rate conversion: USD -> %s", toCurrency)
-	exchangeRate, err := getExchangeRate("USD", toCurrency)
+	exchangeRate, err := getExchangeRate(ctx, "USD", toCurrency)
 	if err != nil {
 		log.Printf("Failed to get exchange rate: %v", err)
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Failed to get exchange rate: %s", err.Error()))
-		return
+		return false
 	}
 
 	finalPrice := usdPriceFloat * exchangeRate
 	log.Printf("Conversion complete: %s USD price %.4f, exchange rate %.4f, final price %.4f %s", fromCoin, usdPriceFloat, exchangeRate, finalPrice, toCurrency)
 	b.SendGroupMsg(msg.GroupID, fmt.Sprintf("1 %s=%.4f %s", fromCoin, finalPrice, toCurrency))
+	return true
 }
 
-func getCryptoPrice(coin string, quoteCurrency string) (string, error) {
-	instId := coin + "-" + quoteCurrency + "-SWAP"
-	url := "https://bot-forward.lavacreeper.net/api/v5/market/ticker?instId=" + instId
-
-	log.Printf("Request cryptocurrency price: %s", url)
-
-	req, err := http.NewRequest("GET", url, nil)
+// getCryptoPrice returns the price of coin in quoteCurrency from the first
+// source that has it, perpetual swaps unless spot is set
+func getCryptoPrice(ctx context.Context, coin string, quoteCurrency string, spot bool) (*market.Ticker, error) {
+	ticker, err := priceChain.Ticker(ctx, market.Instrument{Base: coin, Quote: quoteCurrency, Spot: spot})
 	if err != nil {
-		return "", fmt.Errorf("request creation failed: %v", err)
+		return nil, err
 	}
+	log.Printf("Got price: %s = %s (%s)", ticker.Instrument, formatPrice(ticker.Last), ticker.Source)
+	return ticker, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Okx-Python-Client")
-	req.Header.Set("X-API-Key", config.Cfg.ApiKeys.OkxMirrorAPIKey)
+func formatPrice(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("request failed: %v", err)
+// formatSigned is formatPrice with an explicit sign, rounded to hide float
+// noise from the subtraction
+func formatSigned(v float64) string {
+	s := strconv.FormatFloat(v, 'g', 6, 64)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		s = formatPrice(f)
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Printf("Failed to close response body: %v", err)
-		}
-	}(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	if v >= 0 {
+		return "+" + s
 	}
+	return s
+}
 
-	var ticker TickerResp
-	if err := json.NewDecoder(resp.Body).Decode(&ticker); err != nil {
-		return "", fmt.Errorf("parsing failed: %v", err)
+// formatVolume shortens large amounts to K, M and B
+func formatVolume(v float64) string {
+	switch {
+	case v >= 1e9:
+		return fmt.Sprintf("%.2fB", v/1e9)
+	case v >= 1e6:
+		return fmt.Sprintf("%.2fM", v/1e6)
+	case v >= 1e3:
+		return fmt.Sprintf("%.2fK", v/1e3)
+	default:
+		return fmt.Sprintf("%.2f", v)
 	}
+}
 
-	if ticker.Code != "0" || len(ticker.Data) == 0 {
-		return "", fmt.Errorf("API returned error: %s", ticker.Msg)
+// describeTickerSource notes where a price came from when it was not the
+// preferred source
+func describeTickerSource(t *market.Ticker) string {
+	if t.Approximate {
+		return " (" + t.Source + ", approximate)"
 	}
-
-	log.Printf("Got price: %s = %s", instId, ticker.Data[0].Last)
-	return ticker.Data[0].Last, nil
+	if sources := priceChain.Sources(); len(sources) > 0 && t.Source == sources[0] {
+		return ""
+	}
+	return " (" + t.Source + ")"
 }
 
 type ExchangeRateResponse struct {
@@ -203,19 +377,41 @@ type ExchangeRateResponse struct {
 	ConversionRates map[string]float64 `json:"conversion_rates"`
 }
 
-func getExchangeRate(baseCode string, targetCode string) (float64, error) {
+func getExchangeRate(ctx context.Context, baseCode string, targetCode string) (float64, error) {
+	rates, err := getExchangeRates(ctx, baseCode)
+	if err != nil {
+		return 0, err
+	}
+
+	rate, exists := rates[targetCode]
+	if !exists {
+		return 0, fmt.Errorf("unsupported currency: %s", targetCode)
+	}
+
+	log.Printf("Got exchange rate: 1 %s = %f %s", baseCode, rate, targetCode)
+	return rate, nil
+}
+
+// getExchangeRates returns the rates of every currency the exchange rate
+// API lists against baseCode
+func getExchangeRates(ctx context.Context, baseCode string) (map[string]float64, error) {
 	if config.Cfg.ApiKeys.ExchangeRateAPIKey == "" {
-		return 0, fmt.Errorf("exchange rate API key not configured")
+		return nil, fmt.Errorf("exchange rate API key not configured")
 	}
 
 	url := fmt.Sprintf("https://v6.exchangerate-api.com/v6/%s/latest/%s", config.Cfg.ApiKeys.ExchangeRateAPIKey, baseCode)
 
 	log.Printf("Request exchange rate: %s", url)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %v", err)
+	}
+
+	client := apiClient("exchangerate", 10*time.Second)
+	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("exchange rate request failed: %v", err)
+		return nil, fmt.Errorf("exchange rate request failed: %v", err)
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -225,23 +421,17 @@ func getExchangeRate(baseCode string, targetCode string) (float64, error) {
 	}(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("exchange rate API HTTP error: %d", resp.StatusCode)
+		return nil, fmt.Errorf("exchange rate API HTTP error: %d", resp.StatusCode)
 	}
 
 	var exchangeData ExchangeRateResponse
 	if err := json.NewDecoder(resp.Body).Decode(&exchangeData); err != nil {
-		return 0, fmt.Errorf("exchange rate data parsing failed: %v", err)
+		return nil, fmt.Errorf("exchange rate data parsing failed: %v", err)
 	}
 
 	if exchangeData.Result != "success" {
-		return 0, fmt.Errorf("exchange rate API returned error: %s", exchangeData.Result)
+		return nil, fmt.Errorf("exchange rate API returned error: %s", exchangeData.Result)
 	}
 
-	rate, exists := exchangeData.ConversionRates[targetCode]
-	if !exists {
-		return 0, fmt.Errorf("unsupported currency: %s", targetCode)
-	}
-
-	log.Printf("Got exchange rate: 1 %s = %f %s", baseCode, rate, targetCode)
-	return rate, nil
+	return exchangeData.ConversionRates, nil
 }
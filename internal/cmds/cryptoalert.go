@@ -0,0 +1,233 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/go-hurobot/internal/market"
+	"github.com/awfufu/qbot"
+)
+
+// alertExpr matches the condition of /crypto alert, e.g. BTC > 100000
+var alertExpr = regexp.MustCompile(`^([A-Z0-9]+)\s*([<>])\s*([0-9]*\.?[0-9]+)$`)
+
+// execCryptoAlert handles /crypto alert <coin> <>|<> <price> [--once] and
+// reports whether the alert was saved. args are upper case and do not
+// contain --spot.
+func execCryptoAlert(ctx context.Context, b *qbot.Sender, msg *qbot.Message, args []string, spot bool) bool {
+	once := slices.Contains(args, "--ONCE")
+	args = slices.DeleteFunc(args, func(s string) bool { return s == "--ONCE" })
+
+	m := alertExpr.FindStringSubmatch(decodeSpecialChars(strings.Join(args, " ")))
+	if m == nil {
+		b.SendGroupMsg(msg.GroupID, "Usage: /crypto alert <coin> >|< <price> [--once] [--spot]")
+		return false
+	}
+	coin, above := m[1], m[2] == ">"
+	threshold, err := strconv.ParseFloat(m[3], 64)
+	if err != nil || threshold <= 0 {
+		b.SendGroupMsg(msg.GroupID, "Invalid price: "+m[3])
+		return false
+	}
+
+	n, err := db.CountCryptoAlerts(uint64(msg.UserID), uint64(msg.GroupID))
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+	if n >= int64(config.Cfg.Crypto.AlertLimit) {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("You already have %d alerts here, remove one first", n))
+		return false
+	}
+
+	// also checks that some source lists the coin
+	ticker, err := getCryptoPrice(ctx, coin, "USDT", spot)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Query failed: %s", err.Error()))
+		return false
+	}
+
+	alert := &db.DbCryptoAlerts{
+		GroupID:   uint64(msg.GroupID),
+		UserID:    uint64(msg.UserID),
+		Coin:      coin,
+		Quote:     "USDT",
+		Spot:      spot,
+		Above:     above,
+		Threshold: threshold,
+		Once:      once,
+		// a condition that already holds only fires after the price has
+		// crossed the threshold again
+		Armed: !alertTriggered(above, threshold, ticker.Last),
+	}
+	if err := db.AddCryptoAlert(alert); err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+		return false
+	}
+
+	reply := fmt.Sprintf("Alert %d: %s, now %s", alert.ID, describeAlert(alert), formatPrice(ticker.Last))
+	if !alert.Armed {
+		reply += "\nThe price is already there, the alert fires once it crosses again"
+	}
+	b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, reply)
+	return true
+}
+
+// execCryptoAlerts handles /crypto alerts [list] and /crypto alerts rm <id>
+func execCryptoAlerts(b *qbot.Sender, msg *qbot.Message, args []string) {
+	if len(args) == 0 || args[0] == "LIST" {
+		alerts, err := db.GetCryptoAlerts(uint64(msg.UserID), uint64(msg.GroupID))
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		if len(alerts) == 0 {
+			b.SendGroupMsg(msg.GroupID, "You have no alerts here")
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("Your alerts:")
+		for _, a := range alerts {
+			fmt.Fprintf(&sb, "\n%d: %s", a.ID, describeAlert(&a))
+			if !a.Armed {
+				sb.WriteString(" (waiting to re-arm)")
+			}
+		}
+		b.SendGroupMsg(msg.GroupID, sb.String())
+		return
+	}
+
+	if args[0] != "RM" || len(args) != 2 {
+		b.SendGroupMsg(msg.GroupID, "Usage: /crypto alerts [list] | /crypto alerts rm <id>")
+		return
+	}
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, "Invalid id: "+args[1])
+		return
+	}
+	ok, err := db.RemoveCryptoAlert(uint64(msg.UserID), uint64(msg.GroupID), id)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+	} else if !ok {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("You have no alert %d here", id))
+	} else {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Removed alert %d", id))
+	}
+}
+
+func alertInstrument(a *db.DbCryptoAlerts) market.Instrument {
+	return market.Instrument{Base: a.Coin, Quote: a.Quote, Spot: a.Spot}
+}
+
+func describeAlert(a *db.DbCryptoAlerts) string {
+	op := "<"
+	if a.Above {
+		op = ">"
+	}
+	s := fmt.Sprintf("%s %s %s", alertInstrument(a), op, formatPrice(a.Threshold))
+	if a.Once {
+		s += " once"
+	}
+	return s
+}
+
+func alertTriggered(above bool, threshold float64, price float64) bool {
+	if above {
+		return price >= threshold
+	}
+	return price <= threshold
+}
+
+// alertRearmed reports whether price has moved back far enough from the
+// threshold of a fired alert for it to fire again
+func alertRearmed(above bool, threshold float64, price float64) bool {
+	margin := threshold * config.Cfg.Crypto.AlertHysteresis / 100
+	if above {
+		return price < threshold-margin
+	}
+	return price > threshold+margin
+}
+
+// RunCryptoAlerts checks the price alerts periodically until ctx is done
+func RunCryptoAlerts(ctx context.Context, b *qbot.Sender) {
+	ticker := time.NewTicker(time.Duration(config.Cfg.Crypto.AlertInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCryptoAlerts(ctx, b)
+		}
+	}
+}
+
+func checkCryptoAlerts(ctx context.Context, b *qbot.Sender) {
+	alerts, err := db.GetAllCryptoAlerts()
+	if err != nil {
+		log.Printf("failed to load crypto alerts: %v", err)
+		return
+	}
+	ctx = withCaller(ctx, "crypto_alert", 0, 0)
+
+	// every instrument is queried once however many alerts watch it
+	prices := make(map[market.Instrument]*market.Ticker)
+	for _, a := range alerts {
+		// alerts sleep while crypto is switched off in the group or the
+		// owner may no longer use it, and resume once that changes
+		groupID, userID := qbot.GroupID(a.GroupID), qbot.UserID(a.UserID)
+		if !commandEnabled(cryptoCommand.Name, groupID) || !checkCmdPermission(b, cryptoCommand.Name, userID, groupID) {
+			continue
+		}
+
+		inst := alertInstrument(&a)
+		t, seen := prices[inst]
+		if !seen {
+			t, err = getCryptoPrice(ctx, a.Coin, a.Quote, a.Spot)
+			if err != nil {
+				log.Printf("crypto alert: %v", err)
+			}
+			prices[inst] = t
+		}
+		if t == nil {
+			continue
+		}
+
+		if !a.Armed {
+			if alertRearmed(a.Above, a.Threshold, t.Last) {
+				if err := db.SetCryptoAlertArmed(a.ID, true); err != nil {
+					log.Printf("failed to re-arm crypto alert %d: %v", a.ID, err)
+				}
+			}
+			continue
+		}
+		if !alertTriggered(a.Above, a.Threshold, t.Last) {
+			continue
+		}
+
+		if a.Once {
+			err = db.DeleteCryptoAlert(a.ID)
+		} else {
+			err = db.SetCryptoAlertArmed(a.ID, false)
+		}
+		if err != nil {
+			log.Printf("failed to update crypto alert %d: %v", a.ID, err)
+			continue
+		}
+		text := fmt.Sprintf(" %s is now %s (alert %d: %s)", inst, formatPrice(t.Last), a.ID, describeAlert(&a))
+		if a.Once {
+			text += ", removed"
+		}
+		b.SendGroupMsg(groupID, qbot.At(userID), qbot.Text(text))
+	}
+}
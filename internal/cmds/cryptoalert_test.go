@@ -0,0 +1,90 @@
+package cmds
+
+import (
+	"testing"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+)
+
+func TestAlertTriggered(t *testing.T) {
+	tests := []struct {
+		above bool
+		price float64
+		want  bool
+	}{
+		{true, 1999.99, false},
+		{true, 2000, true},
+		{true, 2500, true},
+		{false, 2000.01, false},
+		{false, 2000, true},
+		{false, 1500, true},
+	}
+	for _, tt := range tests {
+		if got := alertTriggered(tt.above, 2000, tt.price); got != tt.want {
+			t.Errorf("alertTriggered(above %v, 2000, %v) = %v, want %v", tt.above, tt.price, got, tt.want)
+		}
+	}
+}
+
+func TestAlertRearmed(t *testing.T) {
+	old := config.Cfg.Crypto.AlertHysteresis
+	t.Cleanup(func() { config.Cfg.Crypto.AlertHysteresis = old })
+	config.Cfg.Crypto.AlertHysteresis = 0.5 // 10 around 2000
+
+	tests := []struct {
+		above bool
+		price float64
+		want  bool
+	}{
+		// an alert above 2000 re-arms once the price is back under 1990
+		{true, 2000, false},
+		{true, 1995, false},
+		{true, 1990, false},
+		{true, 1989.99, true},
+		{true, 1500, true},
+		// an alert below 2000 re-arms once the price is back over 2010
+		{false, 2000, false},
+		{false, 2005, false},
+		{false, 2010, false},
+		{false, 2010.01, true},
+		{false, 2500, true},
+	}
+	for _, tt := range tests {
+		if got := alertRearmed(tt.above, 2000, tt.price); got != tt.want {
+			t.Errorf("alertRearmed(above %v, 2000, %v) = %v, want %v", tt.above, tt.price, got, tt.want)
+		}
+	}
+
+	// a re-armed alert never fires at the same price
+	for _, tt := range tests {
+		if tt.want && alertTriggered(tt.above, 2000, tt.price) {
+			t.Errorf("price %v both re-arms and triggers the alert (above %v)", tt.price, tt.above)
+		}
+	}
+}
+
+func TestAlertExpr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"BTC > 100000", []string{"BTC", ">", "100000"}},
+		{"ETH<2000.5", []string{"ETH", "<", "2000.5"}},
+		{"SOL > .5", []string{"SOL", ">", ".5"}},
+		{"BTC >= 1", nil},
+		{"BTC > -1", nil},
+		{"> 1", nil},
+	}
+	for _, tt := range tests {
+		m := alertExpr.FindStringSubmatch(tt.in)
+		if tt.want == nil {
+			if m != nil {
+				t.Errorf("alertExpr matched %q", tt.in)
+			}
+			continue
+		}
+		if m == nil || m[1] != tt.want[0] || m[2] != tt.want[1] || m[3] != tt.want[2] {
+			t.Errorf("alertExpr(%q) = %q, want %q", tt.in, m, tt.want)
+		}
+	}
+}
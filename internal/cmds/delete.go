@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"context"
 	"log"
 
 	"github.com/awfufu/qbot"
@@ -16,7 +17,7 @@ var deleteCommand *Command = &Command{
 	NeedRawMsg: false,
 	MaxArgs:    1,
 	MinArgs:    1,
-	Exec: func(b *qbot.Sender, msg *qbot.Message) {
+	Exec: func(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 		if msg.ReplyID != 0 {
 			b.DeleteMsg(msg.ReplyID)
 			log.Printf("delete message %d", msg.ReplyID)
@@ -2,141 +2,284 @@ package cmds
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"log"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/imagegen"
 	"github.com/awfufu/qbot"
 )
 
 const drawHelpMsg string = `Generate images from text prompts.
-Usage: /draw <prompt> [--size <size>]
-Supported sizes: 1328x1328, 1584x1056, 1140x1472, 1664x928, 928x1664
-Example: /draw a cat --size 1328x1328`
+Usage: /draw <prompt> [options]
+Options:
+  --provider <name>   --model <model>   --size <size>
+  --neg <prompt>      Negative prompt
+  --seed <n>          Reuse the seed of an earlier result
+  --steps <1-100>     Inference steps
+  --cfg <0-20>        Guidance scale (default 7.5)
+  --n <1-4>           Number of images
+  --edit              Transform the attached or replied-to image
+  --strength <0-1>    How far --edit may move away from the source
+  /draw --providers     - List providers with their models and sizes
+  /draw --queue         - Show your pending jobs
+  /draw --cancel [id]   - Cancel a queued job, your latest by default
+  /draw history [@user] - List recent generations in this group, or of a user id
+  /draw again <id>      - Resend a stored generation
+  [Reply to a generated image] /draw reroll - Same prompt, new seed
+Admins:
+  /draw blocklist [add [--regex] <pattern> | rm <id>] - Prompt blocklist
+  /draw blocked [n]     - Show the last n refused prompts (default 10)
+Examples:
+  /draw a cat --size 1328x1328 --neg "blurry" --n 2
+  [Reply to an image] /draw --edit make it a watercolor`
+
+// drawTimeout bounds a single generation request. Requests wait for a free
+// worker in the draw queue first, see RunDrawQueue.
+const drawTimeout = 120 * time.Second
 
 var drawCommand *Command = &Command{
-	Name:       "draw",
-	HelpMsg:    drawHelpMsg,
-	Permission: getCmdPermLevel("draw"),
-	NeedRawMsg: false,
-	MinArgs:    2,
-	Exec:       execDraw,
+	Name:         "draw",
+	HelpMsg:      drawHelpMsg,
+	Permission:   getCmdPermLevel("draw"),
+	NeedRawMsg:   false,
+	Slow:         true,
+	MinArgs:      2,
+	ChargesQuota: true,
+	Exec:         execDraw,
 }
 
-type ImageGenerationRequest struct {
-	Model         string  `json:"model"`
-	Prompt        string  `json:"prompt"`
-	ImageSize     string  `json:"image_size"`
-	BatchSize     int     `json:"batch_size"`
-	GuidanceScale float64 `json:"guidance_scale"`
-}
+// InitDrawProviders registers the image suppliers from the config. The old
+// api_keys.draw_* settings still work as a provider named siliconflow.
+func InitDrawProviders() {
+	suppliers := config.Cfg.Suppliers
+	if _, ok := suppliers[imagegen.TypeSiliconFlow]; !ok && config.Cfg.ApiKeys.DrawApiKey != "" {
+		suppliers = maps.Clone(suppliers)
+		if suppliers == nil {
+			suppliers = make(map[string]config.SupplierConfig)
+		}
+		suppliers[imagegen.TypeSiliconFlow] = config.SupplierConfig{
+			Type:    imagegen.TypeSiliconFlow,
+			BaseURL: config.Cfg.ApiKeys.DrawUrlBase,
+			APIKey:  config.Cfg.ApiKeys.DrawApiKey,
+		}
+	}
 
-type ImageGenerationResponse struct {
-	Images []struct {
-		URL string `json:"url"`
-	} `json:"images"`
-	Timings struct {
-		Inference float64 `json:"inference"`
-	} `json:"timings"`
-	Seed int64 `json:"seed"`
+	for name, sc := range suppliers {
+		if sc.Type == "" {
+			continue
+		}
+		client, err := proxiedAPIClient(name, drawTimeout, sc.Proxy)
+		if err != nil {
+			log.Printf("image provider %s: %v", name, err)
+			continue
+		}
+		p, err := imagegen.New(name, sc, client)
+		if err != nil {
+			log.Printf("image provider %s: %v", name, err)
+			continue
+		}
+		imagegen.Register(p)
+		log.Printf("registered image provider %s (%s)", name, sc.Type)
+	}
 }
 
-func execDraw(b *qbot.Sender, msg *qbot.Message) {
-	if config.Cfg.ApiKeys.DrawApiKey == "" {
-		b.SendGroupMsg(msg.GroupID, "No API key")
-		return
+// defaultDrawProvider is the configured provider, or the first registered
+// one
+func defaultDrawProvider() string {
+	if config.Cfg.Draw.Provider != "" {
+		return config.Cfg.Draw.Provider
 	}
+	if names := imagegen.Names(); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
 
-	// msg.Array[0] is "/draw"
-	// Parse following args
+type drawOptions struct {
+	prompt   string
+	provider string
+	model    string
+	size     string
+	negative string
+	seed     *int64
+	steps    int
+	cfg      float64
+	n        int
+	edit     bool
+	strength float64
+}
+
+// drawArgs returns the text arguments after "/draw"
+func drawArgs(items []qbot.MsgItem) []string {
 	var args []string
-	for i := 1; i < len(msg.Array); i++ {
-		if msg.Array[i].Type() == qbot.TextType {
-			args = append(args, msg.Array[i].Text())
+	for i := 1; i < len(items); i++ {
+		if items[i].Type() == qbot.TextType {
+			args = append(args, items[i].Text())
 		}
 	}
+	return args
+}
 
-	prompt, imageSize, err := parseDrawArgs(args)
-	if err != nil {
-		b.SendGroupMsg(msg.GroupID, err.Error())
-		return
-	}
-
-	if prompt == "" {
-		b.SendGroupMsg(msg.GroupID, "Please provide a prompt")
-		return
-	}
+// isUintArg reports whether s is a user or item id
+func isUintArg(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
 
-	b.SendGroupMsg(msg.GroupID, "Image generating...")
+func execDraw(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
+	args := drawArgs(msg.Array)
 
-	reqData := ImageGenerationRequest{
-		Model:         "Qwen/Qwen-Image",
-		Prompt:        prompt,
-		ImageSize:     imageSize,
-		BatchSize:     1,
-		GuidanceScale: 7.5,
+	if len(args) > 0 {
+		switch args[0] {
+		case "--providers":
+			b.SendGroupMsg(msg.GroupID, describeDrawProviders())
+			return
+		case "--queue":
+			listDrawJobs(b, msg)
+			return
+		case "history":
+			if len(args) == 1 || isUintArg(args[1]) && len(args) == 2 {
+				listDrawHistory(b, msg)
+				return
+			}
+		case "reroll":
+			if len(args) == 1 {
+				chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+					return rerollDraw(ctx, b, msg)
+				})
+				return
+			}
+		case "blocklist":
+			if len(args) == 1 || args[1] == "add" || args[1] == "rm" {
+				handleBlocklist(b, msg, args[1:])
+				return
+			}
+		case "blocked":
+			if len(args) == 1 {
+				listBlockedPrompts(b, msg, 10)
+				return
+			}
+			if n, err := strconv.Atoi(args[1]); err == nil && len(args) == 2 {
+				if n < 1 || n > 50 {
+					b.SendGroupMsg(msg.GroupID, "Invalid count, must be 1-50")
+					return
+				}
+				listBlockedPrompts(b, msg, n)
+				return
+			}
+		case "again":
+			if len(args) == 2 {
+				id, err := strconv.ParseUint(args[1], 10, 64)
+				if err != nil {
+					b.SendGroupMsg(msg.GroupID, "again: invalid id "+args[1])
+					return
+				}
+				resendDraw(b, msg, id)
+				return
+			}
+		case "--cancel":
+			var id uint64
+			if len(args) > 1 {
+				v, err := strconv.ParseUint(args[1], 10, 64)
+				if err != nil {
+					b.SendGroupMsg(msg.GroupID, "--cancel: invalid job id "+args[1])
+					return
+				}
+				id = v
+			}
+			cancelDrawJob(b, msg, id)
+			return
+		}
 	}
 
-	jsonData, err := json.Marshal(reqData)
-	if err != nil {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
-	}
+	// the quota is only spent once a job is queued
+	chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+		return drawPrompt(ctx, b, msg, args)
+	})
+}
 
-	req, err := http.NewRequest("POST", config.Cfg.ApiKeys.DrawUrlBase, bytes.NewBuffer(jsonData))
+// drawPrompt queues a generation for /draw <prompt> [options] and reports
+// whether a job was queued
+func drawPrompt(ctx context.Context, b *qbot.Sender, msg *qbot.Message, args []string) bool {
+	opts, err := parseDrawArgs(args)
 	if err != nil {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
 	}
 
-	req.Header.Set("Authorization", "Bearer "+config.Cfg.ApiKeys.DrawApiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: 60 * time.Second,
+	if opts.prompt == "" {
+		b.SendGroupMsg(msg.GroupID, "Please provide a prompt")
+		return false
+	}
+	if !moderatePrompt(ctx, b, msg, "draw", opts.prompt) {
+		return false
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+	var source []byte
+	if opts.edit {
+		source, err = fetchDrawSource(ctx, b, msg)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return false
+		}
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	p, err := resolveDrawOptions(&opts, source)
 	if err != nil {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
 	}
 
-	if resp.StatusCode != 200 {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%d\n%s", resp.StatusCode, string(body)))
-		return
+	req := &imagegen.Request{
+		Model:          opts.model,
+		Prompt:         opts.prompt,
+		NegativePrompt: opts.negative,
+		Size:           opts.size,
+		Seed:           opts.seed,
+		Steps:          opts.steps,
+		GuidanceScale:  opts.cfg,
+		N:              opts.n,
+		Image:          source,
+		Strength:       opts.strength,
 	}
+	return queueDrawJob(ctx, b, msg, p.Name(), req, opts.edit)
+}
 
-	var imgResp ImageGenerationResponse
-	if err := json.Unmarshal(body, &imgResp); err != nil {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+// describeDrawResult is the caption of a result, id is its history entry or
+// 0 if it was not stored
+func describeDrawResult(id uint64, res *imagegen.Result) string {
+	var parts []string
+	if id != 0 {
+		parts = append(parts, fmt.Sprintf("#%d", id))
 	}
-
-	if len(imgResp.Images) == 0 {
-		b.SendGroupMsg(msg.GroupID, "error: no images generated")
-		return
+	if res.Seed != 0 {
+		parts = append(parts, fmt.Sprintf("seed %d", res.Seed))
 	}
-
-	imageURL := imgResp.Images[0].URL
-	// Use b.SendGroupReplyMsg instead of manual qbot.Reply/SendMsg
-	b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, qbot.Image(imageURL))
+	if res.Inference > 0 {
+		parts = append(parts, fmt.Sprintf("%.2fs", res.Inference.Seconds()))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, ", ") + "\n"
 }
 
-func parseDrawArgs(args []string) (prompt, imageSize string, err error) {
-	imageSize = "1328x1328" // default
-
+func parseDrawArgs(args []string) (opts drawOptions, err error) {
 	var promptParts []string
 	i := 0
 
@@ -144,33 +287,222 @@ func parseDrawArgs(args []string) (prompt, imageSize string, err error) {
 		arg := args[i]
 
 		switch arg {
-		case "--size":
-			if i+1 < len(args) {
-				size := args[i+1]
-				if !isValidSize(size) {
-					return "", "", fmt.Errorf("unsupported image size: %s\nSupported sizes: 1328x1328, 1584x1056, 1140x1472, 1664x928, 928x1664", size)
+		case "--edit":
+			opts.edit = true
+			i++
+		case "--strength", "--size", "--provider", "--model", "--neg", "--seed", "--steps", "--cfg", "--n":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s: value required", arg)
+			}
+			value := args[i+1]
+			switch arg {
+			case "--size":
+				opts.size = value
+			case "--provider":
+				opts.provider = value
+			case "--model":
+				opts.model = value
+			case "--neg":
+				opts.negative = value
+			case "--seed":
+				seed, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || seed < 0 {
+					return opts, fmt.Errorf("--seed: invalid seed %s", value)
 				}
-				imageSize = size
-				i += 2
-			} else {
-				return "", "", fmt.Errorf("--size: size value required")
+				opts.seed = &seed
+			case "--steps":
+				steps, err := strconv.Atoi(value)
+				if err != nil || steps < 1 || steps > 100 {
+					return opts, fmt.Errorf("--steps: must be 1-100")
+				}
+				opts.steps = steps
+			case "--cfg":
+				cfg, err := strconv.ParseFloat(value, 64)
+				if err != nil || cfg <= 0 || cfg > 20 {
+					return opts, fmt.Errorf("--cfg: must be between 0 and 20")
+				}
+				opts.cfg = cfg
+			case "--strength":
+				strength, err := strconv.ParseFloat(value, 64)
+				if err != nil || strength <= 0 || strength > 1 {
+					return opts, fmt.Errorf("--strength: must be between 0 and 1")
+				}
+				opts.strength = strength
+			case "--n":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 || n > 4 {
+					return opts, fmt.Errorf("--n: must be 1-4")
+				}
+				opts.n = n
 			}
+			i += 2
 		default:
 			promptParts = append(promptParts, arg)
 			i++
 		}
 	}
 
-	prompt = strings.Join(promptParts, " ")
-	return prompt, imageSize, nil
+	opts.prompt = strings.Join(promptParts, " ")
+	if opts.strength != 0 && !opts.edit {
+		return opts, fmt.Errorf("--strength only applies to --edit")
+	}
+	return opts, nil
+}
+
+// resolveDrawOptions fills in the provider defaults and checks the model and
+// size against what the provider supports. For --edit source is the image
+// to transform, its aspect ratio picks the default size.
+func resolveDrawOptions(opts *drawOptions, source []byte) (imagegen.Provider, error) {
+	if opts.provider == "" {
+		opts.provider = defaultDrawProvider()
+	}
+	if opts.provider == "" {
+		return nil, fmt.Errorf("No image provider configured")
+	}
+	p, ok := imagegen.Get(opts.provider)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider: %s\nAvailable: %s", opts.provider, strings.Join(imagegen.Names(), ", "))
+	}
+
+	models := p.Models()
+	if opts.edit {
+		editor, ok := p.(imagegen.Editor)
+		if !ok {
+			return nil, fmt.Errorf("%s does not support --edit", p.Name())
+		}
+		models = editor.EditModels()
+	}
+	if opts.model == "" {
+		opts.model = models[0]
+	} else if !slices.Contains(models, opts.model) {
+		return nil, fmt.Errorf("unsupported model for %s: %s\nSupported models: %s", p.Name(), opts.model, strings.Join(models, ", "))
+	}
+
+	if opts.size == "" {
+		opts.size = p.Sizes()[0]
+		if source != nil {
+			if cfg, _, err := image.DecodeConfig(bytes.NewReader(source)); err == nil {
+				opts.size = closestSize(p.Sizes(), cfg.Width, cfg.Height)
+			}
+		}
+	} else if !slices.Contains(p.Sizes(), opts.size) {
+		return nil, fmt.Errorf("unsupported image size: %s\nSupported sizes: %s", opts.size, strings.Join(p.Sizes(), ", "))
+	}
+	return p, nil
+}
+
+// closestSize picks the size whose aspect ratio is nearest to width:height
+func closestSize(sizes []string, width, height int) string {
+	want := math.Log(float64(width) / float64(height))
+	best, bestDiff := sizes[0], math.Inf(1)
+	for _, size := range sizes {
+		var w, h int
+		if _, err := fmt.Sscanf(size, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			continue
+		}
+		if diff := math.Abs(math.Log(float64(w)/float64(h)) - want); diff < bestDiff {
+			best, bestDiff = size, diff
+		}
+	}
+	return best
+}
+
+// maxSourceImage limits the size of a downloaded --edit source or result
+const maxSourceImage = 10 << 20
+
+// fetchDrawSource downloads the image attached to msg, or else the first
+// image of the message it replies to.
+func fetchDrawSource(ctx context.Context, b *qbot.Sender, msg *qbot.Message) ([]byte, error) {
+	var url string
+	for _, item := range msg.Array {
+		if item.Type() == qbot.ImageType {
+			url = item.Image().Url
+			break
+		}
+	}
+	if url == "" && msg.ReplyID != 0 {
+		replied, err := b.GetMsg(int32(msg.ReplyID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the replied message: %v", err)
+		}
+		for _, seg := range replied.Message {
+			if seg.Type != "image" {
+				continue
+			}
+			var data struct {
+				URL string `json:"url"`
+			}
+			if json.Unmarshal(seg.Data, &data) == nil && data.URL != "" {
+				url = data.URL
+				break
+			}
+		}
+	}
+	if url == "" {
+		return nil, fmt.Errorf("--edit: attach an image or reply to one")
+	}
+
+	data, err := downloadImage(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("--edit: %v", err)
+	}
+	return data, nil
 }
 
-func isValidSize(size string) bool {
-	validSizes := []string{"1328x1328", "1584x1056", "1140x1472", "1664x928", "928x1664"}
-	for _, valid := range validSizes {
-		if size == valid {
-			return true
+// downloadImage fetches an image of at most maxSourceImage bytes
+func downloadImage(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download the image: HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceImage+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the image: %v", err)
+	}
+	if len(data) > maxSourceImage {
+		return nil, fmt.Errorf("the image is larger than %d MB", maxSourceImage>>20)
+	}
+	return data, nil
+}
+
+func describeDrawProviders() string {
+	names := imagegen.Names()
+	if len(names) == 0 {
+		return "No image provider configured"
+	}
+	def := defaultDrawProvider()
+	var sb strings.Builder
+	for i, name := range names {
+		p, _ := imagegen.Get(name)
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(name)
+		if name == def {
+			sb.WriteString(" (default)")
+		}
+		models := slices.DeleteFunc(slices.Clone(p.Models()), func(m string) bool { return m == "" })
+		if len(models) > 0 {
+			sb.WriteString("\n  models: " + strings.Join(models, ", "))
+		}
+		if editor, ok := p.(imagegen.Editor); ok {
+			editModels := slices.DeleteFunc(slices.Clone(editor.EditModels()), func(m string) bool { return m == "" })
+			if len(editModels) > 0 {
+				sb.WriteString("\n  edit models: " + strings.Join(editModels, ", "))
+			} else {
+				sb.WriteString("\n  supports --edit")
+			}
 		}
+		sb.WriteString("\n  sizes: " + strings.Join(p.Sizes(), ", "))
 	}
-	return false
+	return sb.String()
 }
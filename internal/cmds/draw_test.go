@@ -0,0 +1,103 @@
+package cmds
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/imagegen"
+)
+
+func registerTestProvider(t *testing.T, name string, typ string) {
+	t.Helper()
+	p, err := imagegen.New(name, config.SupplierConfig{Type: typ, BaseURL: "http://127.0.0.1:1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagegen.Register(p)
+}
+
+func TestResolveDrawOptions(t *testing.T) {
+	registerTestProvider(t, "sf", imagegen.TypeSiliconFlow)
+	registerTestProvider(t, "oa", imagegen.TypeOpenAI)
+
+	tests := []struct {
+		name    string
+		opts    drawOptions
+		want    drawOptions
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			opts: drawOptions{provider: "sf"},
+			want: drawOptions{provider: "sf", model: "Qwen/Qwen-Image", size: "1328x1328"},
+		},
+		{
+			name: "edit default model",
+			opts: drawOptions{provider: "oa", edit: true},
+			want: drawOptions{provider: "oa", model: "dall-e-2", size: "1024x1024", edit: true},
+		},
+		{
+			name: "explicit",
+			opts: drawOptions{provider: "oa", model: "dall-e-3", size: "1792x1024"},
+			want: drawOptions{provider: "oa", model: "dall-e-3", size: "1792x1024"},
+		},
+		{
+			name:    "unknown provider",
+			opts:    drawOptions{provider: "nope"},
+			wantErr: "unknown provider: nope",
+		},
+		{
+			name:    "unknown model",
+			opts:    drawOptions{provider: "sf", model: "dall-e-3"},
+			wantErr: "unsupported model for sf: dall-e-3",
+		},
+		{
+			name:    "generation model for edit",
+			opts:    drawOptions{provider: "oa", model: "dall-e-3", edit: true},
+			wantErr: "unsupported model for oa: dall-e-3",
+		},
+		{
+			name:    "unknown size",
+			opts:    drawOptions{provider: "oa", size: "512x512"},
+			wantErr: "unsupported image size: 512x512",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			p, err := resolveDrawOptions(&opts, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Name() != tt.want.provider || opts != tt.want {
+				t.Errorf("opts = %+v, want %+v", opts, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDrawOptionsSourceSize(t *testing.T) {
+	registerTestProvider(t, "sf", imagegen.TypeSiliconFlow)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 90, 160))); err != nil {
+		t.Fatal(err)
+	}
+	opts := drawOptions{provider: "sf", edit: true}
+	if _, err := resolveDrawOptions(&opts, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if opts.size != "928x1664" {
+		t.Errorf("size = %s, want the portrait size closest to 9:16", opts.size)
+	}
+}
@@ -0,0 +1,120 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/go-hurobot/internal/imagegen"
+	"github.com/awfufu/qbot"
+)
+
+// drawHistoryLimit is how many generations /draw history lists
+const drawHistoryLimit = 10
+
+func listDrawHistory(b *qbot.Sender, msg *qbot.Message) {
+	var userID uint64
+	for _, item := range msg.Array[2:] {
+		if item.Type() == qbot.AtType {
+			userID = uint64(item.At())
+		} else if item.Type() == qbot.TextType {
+			if id, err := strconv.ParseUint(strings.TrimSpace(item.Text()), 10, 64); err == nil {
+				userID = id
+			}
+		}
+	}
+
+	entries, err := db.GetRecentDrawHistory(uint64(msg.GroupID), userID, drawHistoryLimit)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No generations yet")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Recent generations:")
+	for _, h := range entries {
+		fmt.Fprintf(&sb, "\n#%d %s %d %s", h.ID, h.CreatedAt.Local().Format("01-02 15:04"), h.UserID, shortPrompt(h.Prompt))
+		if h.Edit {
+			sb.WriteString(" (edit)")
+		}
+	}
+	sb.WriteString("\n/draw again <id> to view one")
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
+
+// rerollDraw queues the generation the message replies to again with a new
+// seed and reports whether a job was queued
+func rerollDraw(ctx context.Context, b *qbot.Sender, msg *qbot.Message) bool {
+	if msg.ReplyID == 0 {
+		b.SendGroupMsg(msg.GroupID, "Reply to a generated image with /draw reroll")
+		return false
+	}
+	h, err := db.GetDrawHistoryByMsg(uint64(msg.GroupID), uint64(msg.ReplyID))
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+	if h == nil {
+		b.SendGroupMsg(msg.GroupID, "Not a generated image")
+		return false
+	}
+	if h.Edit {
+		b.SendGroupMsg(msg.GroupID, "--edit results cannot be rerolled, the source image is not kept")
+		return false
+	}
+	if _, ok := imagegen.Get(h.Provider); !ok {
+		b.SendGroupMsg(msg.GroupID, "Provider "+h.Provider+" is no longer available")
+		return false
+	}
+
+	var req imagegen.Request
+	if err := json.Unmarshal([]byte(h.Params), &req); err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+	// the blocklist may have changed since
+	if !moderatePrompt(ctx, b, msg, "draw", req.Prompt) {
+		return false
+	}
+	req.Seed = nil
+	return queueDrawJob(ctx, b, msg, h.Provider, &req, false)
+}
+
+// resendDraw sends the stored images of a generation
+func resendDraw(b *qbot.Sender, msg *qbot.Message, id uint64) {
+	h, err := db.GetDrawHistory(uint64(msg.GroupID), id)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if h == nil {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("No generation #%d in this group", id))
+		return
+	}
+	images, err := db.GetDrawImages(h.ID)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(images) == 0 {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("The images of #%d were not stored or have been pruned", id))
+		return
+	}
+
+	caption := fmt.Sprintf("#%d by %d: %s", h.ID, h.UserID, h.Prompt)
+	if h.Seed != 0 {
+		caption += fmt.Sprintf("\nseed %d", h.Seed)
+	}
+	reply := []any{qbot.Text(caption + "\n")}
+	for _, data := range images {
+		reply = append(reply, qbot.Image(imagegen.Image{Data: data}.File()))
+	}
+	b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, reply...)
+}
@@ -0,0 +1,302 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/go-hurobot/internal/imagegen"
+	"github.com/awfufu/qbot"
+)
+
+// drawPollInterval is how often idle draw workers look for jobs they were
+// not woken up for
+const drawPollInterval = 10 * time.Second
+
+var (
+	drawWakeMu sync.RWMutex
+	drawWake   = make(map[string]chan struct{}) // provider -> wake-up signal
+)
+
+// RunDrawQueue runs the persisted /draw jobs with the configured concurrency
+// of every provider until ctx is done. Jobs that are running when ctx ends
+// go back into the queue and resume on the next start.
+func RunDrawQueue(ctx context.Context, b *qbot.Sender) {
+	if n, err := db.RequeueRunningDrawJobs(); err != nil {
+		log.Printf("failed to requeue draw jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("requeued %d interrupted draw jobs", n)
+	}
+
+	names := imagegen.Names()
+	orphans, err := db.FailOrphanDrawJobs(names)
+	if err != nil {
+		log.Printf("failed to clean up draw jobs: %v", err)
+	}
+	for _, job := range orphans {
+		refundDrawJob(&job)
+		b.SendGroupReplyMsg(qbot.GroupID(job.GroupID), qbot.MsgID(job.MsgID), "Draw failed: provider "+job.Provider+" is no longer available")
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wake := make(chan struct{}, 1)
+		drawWakeMu.Lock()
+		drawWake[name] = wake
+		drawWakeMu.Unlock()
+
+		n := max(config.Cfg.Suppliers[name].Concurrency, 1)
+		for range n {
+			wg.Go(func() {
+				drawWorker(ctx, b, name, wake)
+			})
+		}
+	}
+	wg.Wait()
+}
+
+// wakeDrawQueue tells an idle worker of provider that a job was queued
+func wakeDrawQueue(provider string) {
+	drawWakeMu.RLock()
+	wake := drawWake[provider]
+	drawWakeMu.RUnlock()
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func drawWorker(ctx context.Context, b *qbot.Sender, provider string, wake chan struct{}) {
+	ticker := time.NewTicker(drawPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := db.ClaimDrawJob(provider)
+		if err != nil {
+			log.Printf("failed to claim %s draw job: %v", provider, err)
+		}
+		if job != nil {
+			runDrawJob(ctx, b, job)
+			// another job may be waiting, and the signal was consumed
+			wakeDrawQueue(provider)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func runDrawJob(ctx context.Context, b *qbot.Sender, job *db.DbDrawJobs) {
+	groupID, msgID := qbot.GroupID(job.GroupID), qbot.MsgID(job.MsgID)
+	fail := func(err error) {
+		if ferr := db.FinishDrawJob(job.ID, db.JobFailed, err.Error()); ferr != nil {
+			log.Printf("failed to save draw job %d: %v", job.ID, ferr)
+		}
+		refundDrawJob(job)
+		b.SendGroupReplyMsg(groupID, msgID, fmt.Sprintf("Draw failed: %v", err))
+	}
+
+	p, ok := imagegen.Get(job.Provider)
+	if !ok {
+		fail(fmt.Errorf("provider %s is no longer available", job.Provider))
+		return
+	}
+	var req imagegen.Request
+	if err := json.Unmarshal([]byte(job.Params), &req); err != nil {
+		fail(err)
+		return
+	}
+	req.Image = job.Source
+
+	jobCtx := withCaller(ctx, drawCommand.Name, qbot.UserID(job.UserID), groupID)
+	jobCtx = withUsageUnits(jobCtx, max(req.N, 1))
+
+	var res *imagegen.Result
+	var err error
+	if job.Edit {
+		editor, ok := p.(imagegen.Editor)
+		if !ok {
+			fail(fmt.Errorf("%s does not support --edit", p.Name()))
+			return
+		}
+		res, err = editor.Edit(jobCtx, &req)
+	} else {
+		res, err = p.Generate(jobCtx, &req)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		// shutting down, pick the job up again after the restart
+		if rerr := db.RequeueDrawJob(job.ID); rerr != nil {
+			log.Printf("failed to requeue draw job %d: %v", job.ID, rerr)
+		}
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if err := db.FinishDrawJob(job.ID, db.JobDone, ""); err != nil {
+		log.Printf("failed to save draw job %d: %v", job.ID, err)
+	}
+
+	// keep the images, the URLs of some providers expire after an hour
+	images := downloadDrawResult(ctx, res)
+	h := &db.DbDrawHistory{
+		JobID:    job.ID,
+		GroupID:  job.GroupID,
+		UserID:   job.UserID,
+		MsgID:    job.MsgID,
+		Provider: job.Provider,
+		Model:    req.Model,
+		Prompt:   req.Prompt,
+		Params:   job.Params,
+		Seed:     res.Seed,
+		Edit:     job.Edit,
+	}
+	if h.Seed == 0 && req.Seed != nil {
+		h.Seed = *req.Seed
+	}
+	if err := db.SaveDrawHistory(h, images); err != nil {
+		log.Printf("failed to save draw history of job %d: %v", job.ID, err)
+		h.ID = 0
+	} else if n, err := db.PruneDrawImages(int64(config.Cfg.Draw.HistoryMaxMB) << 20); err != nil {
+		log.Printf("failed to prune draw images: %v", err)
+	} else if n > 0 {
+		log.Printf("pruned the images of %d old generations", n)
+	}
+
+	var reply []any
+	if caption := describeDrawResult(h.ID, res); caption != "" {
+		reply = append(reply, qbot.Text(caption))
+	}
+	if len(images) == len(res.Images) {
+		for _, data := range images {
+			reply = append(reply, qbot.Image(imagegen.Image{Data: data}.File()))
+		}
+	} else {
+		for _, img := range res.Images {
+			reply = append(reply, qbot.Image(img.File()))
+		}
+	}
+	replyID, err := b.SendGroupReplyMsg(groupID, msgID, reply...)
+	if err == nil && h.ID != 0 {
+		if err := db.SetDrawHistoryReply(h.ID, replyID); err != nil {
+			log.Printf("failed to save draw history %d: %v", h.ID, err)
+		}
+	}
+}
+
+// downloadDrawResult returns the encoded images of res, skipping those that
+// cannot be downloaded
+func downloadDrawResult(ctx context.Context, res *imagegen.Result) [][]byte {
+	var images [][]byte
+	for _, img := range res.Images {
+		if img.Data != nil {
+			images = append(images, img.Data)
+			continue
+		}
+		data, err := downloadImage(ctx, img.URL)
+		if err != nil {
+			log.Printf("failed to store draw result: %v", err)
+			continue
+		}
+		images = append(images, data)
+	}
+	return images
+}
+
+// queueDrawJob stores a validated request and tells the user where it is in
+// the queue, it reports whether the job was stored
+func queueDrawJob(ctx context.Context, b *qbot.Sender, msg *qbot.Message, provider string, req *imagegen.Request, edit bool) bool {
+	source := req.Image
+	params := *req
+	params.Image = nil
+	data, err := json.Marshal(&params)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return false
+	}
+
+	job := &db.DbDrawJobs{
+		GroupID:  uint64(msg.GroupID),
+		UserID:   uint64(msg.UserID),
+		MsgID:    uint64(msg.MsgID),
+		Provider: provider,
+		Edit:     edit,
+		Params:   string(data),
+		Source:   source,
+
+		QuotaPeriod: chargedPeriod(ctx),
+	}
+	if err := db.CreateDrawJob(job); err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to queue: "+err.Error())
+		return false
+	}
+	pos := db.DrawQueuePosition(job)
+	wakeDrawQueue(provider)
+
+	if pos <= 1 {
+		b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, fmt.Sprintf("Image generating... (job %d)", job.ID))
+	} else {
+		b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, fmt.Sprintf("Queued as job %d, you are #%d", job.ID, pos))
+	}
+	return true
+}
+
+func cancelDrawJob(b *qbot.Sender, msg *qbot.Message, id uint64) {
+	job, err := db.CancelDrawJob(uint64(msg.UserID), uint64(msg.GroupID), id)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+	} else if job == nil {
+		b.SendGroupMsg(msg.GroupID, "You have no queued draw job here")
+	} else {
+		refundDrawJob(job)
+		b.SendGroupReplyMsg(msg.GroupID, qbot.MsgID(job.MsgID), fmt.Sprintf("Cancelled job %d", job.ID))
+	}
+}
+
+func listDrawJobs(b *qbot.Sender, msg *qbot.Message) {
+	jobs, err := db.GetPendingDrawJobs(uint64(msg.UserID), uint64(msg.GroupID))
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(jobs) == 0 {
+		b.SendGroupMsg(msg.GroupID, "You have no pending draw jobs here")
+		return
+	}
+	text := "Your draw jobs:"
+	for _, job := range jobs {
+		prompt := "(unreadable params)"
+		var req imagegen.Request
+		if err := json.Unmarshal([]byte(job.Params), &req); err == nil {
+			prompt = shortPrompt(req.Prompt)
+		}
+		state := "running"
+		if job.Status == db.JobQueued {
+			state = fmt.Sprintf("#%d in the %s queue", db.DrawQueuePosition(&job), job.Provider)
+		}
+		text += fmt.Sprintf("\n%d: %s, %s", job.ID, state, prompt)
+	}
+	b.SendGroupMsg(msg.GroupID, text)
+}
+
+// shortPrompt cuts a prompt down for listings
+func shortPrompt(s string) string {
+	const maxRunes = 30
+	if r := []rune(s); len(r) > maxRunes {
+		return string(r[:maxRunes]) + "..."
+	}
+	return s
+}
@@ -1,6 +1,8 @@
 package cmds
 
 import (
+	"context"
+
 	"github.com/awfufu/qbot"
 )
 
@@ -14,7 +16,7 @@ var echoCommand *Command = &Command{
 	Permission: getCmdPermLevel("echo"),
 	NeedRawMsg: false,
 	MinArgs:    2,
-	Exec: func(b *qbot.Sender, msg *qbot.Message) {
+	Exec: func(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 		b.SendGroupMsg(msg.GroupID, msg.Array[1:])
 	},
 }
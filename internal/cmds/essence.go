@@ -1,6 +1,8 @@
 package cmds
 
 import (
+	"context"
+
 	"github.com/awfufu/qbot"
 )
 
@@ -15,7 +17,7 @@ var essenceCommand *Command = &Command{
 	Exec:       execEssence,
 }
 
-func execEssence(b *qbot.Sender, msg *qbot.Message) {
+func execEssence(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	if msg.ReplyID == 0 {
 		b.SendGroupMsg(msg.GroupID, essenceHelpMsg)
 		return
@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -19,29 +20,26 @@ type FxRateResponse struct {
 }
 
 const erHelpMsg string = `Query foreign exchange rates.
-Usage: fx <from_currency> <to_currency>
-Example: fx CNY HKD`
+Usage:
+  fx <from_currency> <to_currency>
+  fx chart <from_currency> <to_currency> [7d-180d] - Daily rate chart, 30d by default
+Examples:
+  fx CNY HKD
+  fx chart USD CNY 30d`
 
 var erCommand *Command = &Command{
-	Name:       "fx",
-	HelpMsg:    erHelpMsg,
-	Permission: getCmdPermLevel("fx"),
-	NeedRawMsg: false,
-	MaxArgs:    3,
-	MinArgs:    3,
-	Exec:       execEr,
+	Name:         "fx",
+	HelpMsg:      erHelpMsg,
+	Permission:   getCmdPermLevel("fx"),
+	NeedRawMsg:   false,
+	Slow:         true,
+	MaxArgs:      5,
+	MinArgs:      3,
+	ChargesQuota: true,
+	Exec:         execEr,
 }
 
-func execEr(b *qbot.Sender, msg *qbot.Message) {
-	if config.Cfg.ApiKeys.ExchangeRateAPIKey == "" {
-		return
-	}
-
-	if len(msg.Array) < 3 {
-		b.SendGroupMsg(msg.GroupID, erHelpMsg)
-		return
-	}
-
+func execEr(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	getText := func(i int) string {
 		if i < len(msg.Array) {
 			if msg.Array[i].Type() == qbot.TextType {
@@ -51,50 +49,82 @@ func execEr(b *qbot.Sender, msg *qbot.Message) {
 		return ""
 	}
 
+	// charts come from Frankfurter, which needs no key
+	if strings.ToLower(getText(1)) == "chart" {
+		var args []string
+		for i := 2; i < len(msg.Array); i++ {
+			args = append(args, getText(i))
+		}
+		chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+			return execFxChart(ctx, b, msg, args)
+		})
+		return
+	}
+
+	if config.Cfg.ApiKeys.ExchangeRateAPIKey == "" {
+		return
+	}
+
+	if len(msg.Array) != 3 {
+		b.SendGroupMsg(msg.GroupID, erHelpMsg)
+		return
+	}
+
 	fromCurrency := strings.ToUpper(getText(1))
 	toCurrency := strings.ToUpper(getText(2))
+	chargeQuota(ctx, b, msg, func(ctx context.Context) bool {
+		return sendFxRate(ctx, b, msg, fromCurrency, toCurrency)
+	})
+}
 
+// sendFxRate replies with the rates between two currencies and reports
+// whether it could
+func sendFxRate(ctx context.Context, b *qbot.Sender, msg *qbot.Message, fromCurrency string, toCurrency string) bool {
 	url := fmt.Sprintf("https://v6.exchangerate-api.com/v6/%s/latest/%s", config.Cfg.ApiKeys.ExchangeRateAPIKey, fromCurrency)
 
 	log.Println(url)
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	client := apiClient("exchangerate", 10*time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
+		return false
 	}
 
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+		return false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%d", resp.StatusCode))
-		return
+		return false
 	}
 
 	var exchangeData FxRateResponse
 	if err := json.NewDecoder(resp.Body).Decode(&exchangeData); err != nil {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", err))
-		return
+		return false
 	}
 
 	if exchangeData.Result != "success" {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%v", exchangeData.Result))
-		return
+		return false
 	}
 
 	toRate, exists := exchangeData.ConversionRates[toCurrency]
 	if !exists {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Unsupported %s", toCurrency))
-		return
+		return false
 	}
 
 	fromRate, exists := exchangeData.ConversionRates[fromCurrency]
 	if !exists {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Unsupported %s", fromCurrency))
-		return
+		return false
 	}
 
 	rate1to2 := toRate / fromRate
@@ -105,4 +135,5 @@ func execEr(b *qbot.Sender, msg *qbot.Message) {
 		toCurrency, rate2to1, fromCurrency)
 
 	b.SendGroupMsg(msg.GroupID, result)
+	return true
 }
@@ -1,11 +1,15 @@
 package cmds
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
 	"github.com/awfufu/qbot"
 )
 
@@ -24,7 +28,7 @@ var groupCommand *Command = &Command{
 	Exec:       execGroup,
 }
 
-func execGroup(b *qbot.Sender, msg *qbot.Message) {
+func execGroup(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	getText := func(i int) string {
 		if i < len(msg.Array) {
 			if msg.Array[i].Type() == qbot.TextType {
@@ -73,7 +77,9 @@ func execGroup(b *qbot.Sender, msg *qbot.Message) {
 		}
 
 		if targetUserID != 0 {
-			b.SetGroupBan(msg.GroupID, targetUserID, mins*60)
+			if err := b.SetGroupBan(msg.GroupID, targetUserID, mins*60); err == nil {
+				saveGroupEvent(msg, db.EventBan, targetUserID, mins*60)
+			}
 		} else {
 			b.SendGroupMsg(msg.GroupID, "Please mention a user to ban")
 		}
@@ -127,8 +133,14 @@ func setGroupAdmin(b *qbot.Sender, msg *qbot.Message, isOp bool) {
 		return
 	}
 
+	kind := db.EventAdminSet
+	if !isOp {
+		kind = db.EventAdminUnset
+	}
 	for _, userID := range validUserIDs {
-		b.SetGroupAdmin(msg.GroupID, userID, isOp)
+		if err := b.SetGroupAdmin(msg.GroupID, userID, isOp); err == nil {
+			saveGroupEvent(msg, kind, userID, 0)
+		}
 	}
 
 	if len(validUserIDs) == 1 {
@@ -142,6 +154,22 @@ func setGroupAdmin(b *qbot.Sender, msg *qbot.Message, isOp bool) {
 	}
 }
 
+// saveGroupEvent records a moderation action the bot performed on behalf of
+// the sender of msg.
+func saveGroupEvent(msg *qbot.Message, kind string, target qbot.UserID, duration int) {
+	err := db.SaveEvent(&db.DbEvents{
+		Kind:       kind,
+		GroupID:    uint64(msg.GroupID),
+		UserID:     uint64(target),
+		OperatorID: uint64(msg.UserID),
+		Duration:   duration,
+		Time:       time.Now(),
+	})
+	if err != nil {
+		log.Printf("failed to save %s event: %v", kind, err)
+	}
+}
+
 func extractTargetUsersFromMsg(items []qbot.MsgItem, startIndex int, defaultUserID qbot.UserID) []qbot.UserID {
 	var targetUserIDs []qbot.UserID
 	hasAtUsers := false
@@ -0,0 +1,204 @@
+package cmds
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+// alwaysEnabled commands cannot be switched off, otherwise a group could lock
+// itself out of /perm group
+var alwaysEnabled = []string{"perm"}
+
+// commandEnabled reports whether cmdName is switched on in groupID
+func commandEnabled(cmdName string, groupID qbot.GroupID) bool {
+	if groupID == 0 || slices.Contains(alwaysEnabled, cmdName) {
+		return true
+	}
+	return db.GetGroupCommandPolicy(uint64(groupID)).Enabled(cmdName)
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(cmdMap))
+	for name := range cmdMap {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// parseCommandList accepts command names separated by spaces and commas
+func parseCommandList(args []qbot.MsgItem) ([]string, error) {
+	var names []string
+	for _, arg := range args {
+		if arg.Type() != qbot.TextType {
+			continue
+		}
+		for _, name := range strings.Split(arg.Text(), ",") {
+			name = strings.TrimPrefix(strings.TrimSpace(name), "/")
+			if name == "" {
+				continue
+			}
+			if _, ok := cmdMap[name]; !ok {
+				return nil, fmt.Errorf("Unknown command: %s", name)
+			}
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func describeSwitches(p *db.GroupCommandPolicy, names []string) string {
+	strs := make([]string, len(names))
+	for i, name := range names {
+		state := "off"
+		if p.Enabled(name) {
+			state = "on"
+		}
+		strs[i] = name + "=" + state
+	}
+	return strings.Join(strs, ",")
+}
+
+func describeDefault(enabled bool) string {
+	if enabled {
+		return "enable"
+	}
+	return "disable"
+}
+
+func handleGroupCommands(b *qbot.Sender, msg *qbot.Message) {
+	// group [list|enable|disable|only|default|reset|suggest] [args...] [--group id]
+	// 1      2                                       3...
+	args, groupID, ok := parseGroupFlag(msg.Array, msg.GroupID)
+	if !ok {
+		b.SendGroupMsg(msg.GroupID, "Usage: perm group <list|enable|disable|only|default|reset|suggest> [args...] [--group id]")
+		return
+	}
+	if groupID == db.GlobalGroup {
+		groupID = uint64(msg.GroupID)
+	}
+
+	action := "list"
+	if len(args) > 2 && args[2].Type() == qbot.TextType {
+		action = args[2].Text()
+	}
+	var rest []qbot.MsgItem
+	if len(args) > 3 {
+		rest = args[3:]
+	}
+
+	policy := db.GetGroupCommandPolicy(groupID)
+	target := describeScope(groupID)
+
+	switch action {
+	case "list":
+		var on, off []string
+		for _, name := range commandNames() {
+			if slices.Contains(alwaysEnabled, name) || policy.Enabled(name) {
+				on = append(on, name)
+			} else {
+				off = append(off, name)
+			}
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Commands in %s (default: %s)\nEnabled: %s\nDisabled: %s",
+			target, describeDefault(policy.DefaultEnabled), joinOrNone(on), joinOrNone(off)))
+
+	case "enable", "disable":
+		names, err := parseCommandList(rest)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		if len(names) == 0 {
+			b.SendGroupMsg(msg.GroupID, "No commands specified.")
+			return
+		}
+		enable := action == "enable"
+		if !enable {
+			for _, name := range names {
+				if slices.Contains(alwaysEnabled, name) {
+					b.SendGroupMsg(msg.GroupID, name+" cannot be disabled")
+					return
+				}
+			}
+		}
+		oldValue := describeSwitches(policy, names)
+		if err := db.SetGroupCommands(groupID, names, enable); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%sd in %s: %s", strings.ToUpper(action[:1])+action[1:], target, strings.Join(names, ", ")))
+		auditPerm(msg, "group", target, oldValue, describeSwitches(db.GetGroupCommandPolicy(groupID), names))
+
+	case "only":
+		names, err := parseCommandList(rest)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		all := commandNames()
+		oldValue := describeSwitches(policy, all)
+		if err := db.SetGroupOnlyCommands(groupID, names); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Only enabled in %s: %s", target, joinOrNone(names)))
+		auditPerm(msg, "group", target, oldValue, describeSwitches(db.GetGroupCommandPolicy(groupID), all))
+
+	case "default":
+		if len(rest) != 1 || (rest[0].Text() != "enable" && rest[0].Text() != "disable") {
+			b.SendGroupMsg(msg.GroupID, "Usage: perm group default <enable|disable>")
+			return
+		}
+		enable := rest[0].Text() == "enable"
+		if err := db.SetGroupCommandDefault(groupID, enable); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Default policy of %s set to %s", target, describeDefault(enable)))
+		auditPerm(msg, "group", target+" default", describeDefault(policy.DefaultEnabled), describeDefault(enable))
+
+	case "reset":
+		names, err := parseCommandList(rest)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		shown := names
+		if len(shown) == 0 {
+			shown = commandNames()
+		}
+		oldValue := describeSwitches(policy, shown)
+		if err := db.ResetGroupCommands(groupID, names); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Reset command switches of %s", target))
+		auditPerm(msg, "group", target, oldValue, describeSwitches(db.GetGroupCommandPolicy(groupID), shown))
+
+	case "suggest":
+		if len(rest) != 1 || (rest[0].Text() != "on" && rest[0].Text() != "off") {
+			b.SendGroupMsg(msg.GroupID, "Usage: perm group suggest <on|off>")
+			return
+		}
+		oldValue := "on"
+		if db.GetGroupSettings(groupID).SuggestDisabled {
+			oldValue = "off"
+		}
+		if err := db.SetSuggestDisabled(groupID, rest[0].Text() == "off"); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Command suggestions in %s: %s", target, rest[0].Text()))
+		auditPerm(msg, "group", target+" suggest", oldValue, rest[0].Text())
+
+	default:
+		b.SendGroupMsg(msg.GroupID, "Unknown action: "+action)
+	}
+}
@@ -0,0 +1,100 @@
+package cmds
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+// QQ group roles are looked up through get_group_member_info and cached for
+// groupRoleTTL. Every incoming message refreshes the sender's entry for free.
+const groupRoleTTL = 10 * time.Minute
+
+type groupRoleKey struct {
+	groupID qbot.GroupID
+	userID  qbot.UserID
+}
+
+type groupRoleEntry struct {
+	role    qbot.GroupRole
+	expires time.Time
+}
+
+var (
+	groupRoleMu    sync.Mutex
+	groupRoleCache = make(map[groupRoleKey]groupRoleEntry)
+)
+
+func rememberGroupRole(groupID qbot.GroupID, userID qbot.UserID, role qbot.GroupRole) {
+	if role == qbot.NotAGroup {
+		return
+	}
+	groupRoleMu.Lock()
+	defer groupRoleMu.Unlock()
+	groupRoleCache[groupRoleKey{groupID, userID}] = groupRoleEntry{
+		role:    role,
+		expires: time.Now().Add(groupRoleTTL),
+	}
+}
+
+func getGroupRole(b *qbot.Sender, groupID qbot.GroupID, userID qbot.UserID) qbot.GroupRole {
+	key := groupRoleKey{groupID, userID}
+	groupRoleMu.Lock()
+	entry, ok := groupRoleCache[key]
+	groupRoleMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.role
+	}
+	if b == nil {
+		return qbot.NotAGroup
+	}
+
+	info, err := b.GetGroupMemberInfo(groupID, userID, false)
+	if err != nil {
+		log.Printf("failed to get member info of %d in %d: %v", userID, groupID, err)
+		return qbot.NotAGroup
+	}
+	role := qbot.GroupMember
+	switch info.Role {
+	case "owner":
+		role = qbot.GroupOwner
+	case "admin":
+		role = qbot.GroupAdmin
+	}
+	rememberGroupRole(groupID, userID, role)
+	return role
+}
+
+// mappedGroupRole returns the bot role configured for the user's QQ role in
+// the group, or "" if mapping is disabled or the user is a plain member.
+func mappedGroupRole(b *qbot.Sender, groupID qbot.GroupID, userID qbot.UserID) string {
+	perms := config.Cfg.Permissions
+	if !perms.MapGroupRoles {
+		return ""
+	}
+	switch getGroupRole(b, groupID, userID) {
+	case qbot.GroupOwner:
+		return perms.GroupOwnerRole
+	case qbot.GroupAdmin:
+		return perms.GroupAdminRole
+	}
+	return ""
+}
+
+// userRoles collects the global roles of a user plus, unless groupID is
+// db.GlobalGroup, the roles held in that group and the mapped QQ role.
+func userRoles(b *qbot.Sender, userID qbot.UserID, groupID qbot.GroupID) []string {
+	roles := db.GetUserRoles(uint64(userID), db.GlobalGroup)
+	if uint64(groupID) == db.GlobalGroup {
+		return roles
+	}
+	roles = append(roles, db.GetUserRoles(uint64(userID), uint64(groupID))...)
+	if r := mappedGroupRole(b, groupID, userID); r != "" {
+		roles = append(roles, r)
+	}
+	return roles
+}
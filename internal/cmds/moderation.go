@@ -0,0 +1,284 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+const promptRefusal = "Sorry, I can't help with that prompt here."
+
+// moderatePrompt checks a prompt against the blocklist of the group and the
+// configured moderation endpoint. A refused prompt is logged and answered
+// with a polite refusal, the caller only has to stop.
+func moderatePrompt(ctx context.Context, b *qbot.Sender, msg *qbot.Message, command string, prompt string) bool {
+	reason, err := promptBlockReason(ctx, uint64(msg.GroupID), prompt)
+	if err != nil {
+		log.Printf("prompt moderation failed: %v", err)
+		if !config.Cfg.Moderation.FailClosed {
+			return true
+		}
+		reason = "moderation unavailable"
+	}
+	if reason == "" {
+		return true
+	}
+
+	if err := db.LogBlockedPrompt(&db.DbBlockedPrompts{
+		GroupID: uint64(msg.GroupID),
+		UserID:  uint64(msg.UserID),
+		Command: command,
+		Prompt:  prompt,
+		Reason:  reason,
+	}); err != nil {
+		log.Printf("failed to log blocked prompt: %v", err)
+	}
+	b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, promptRefusal)
+	return false
+}
+
+// promptBlockReason returns why prompt is not allowed in groupID, or "" if
+// it is
+func promptBlockReason(ctx context.Context, groupID uint64, prompt string) (string, error) {
+	rules, err := db.GetBlockRules(groupID)
+	if err != nil {
+		return "", err
+	}
+	lower := strings.ToLower(prompt)
+	for _, rule := range rules {
+		switch rule.Kind {
+		case db.BlockKeyword:
+			if strings.Contains(lower, strings.ToLower(rule.Pattern)) {
+				return fmt.Sprintf("keyword #%d", rule.ID), nil
+			}
+		case db.BlockRegex:
+			re, err := compileBlockRegex(rule.Pattern)
+			if err != nil {
+				log.Printf("block rule %d: %v", rule.ID, err)
+				continue
+			}
+			if re.MatchString(prompt) {
+				return fmt.Sprintf("regex #%d", rule.ID), nil
+			}
+		}
+	}
+
+	if config.Cfg.Moderation.Supplier == "" {
+		return "", nil
+	}
+	return classifyPrompt(ctx, prompt)
+}
+
+var blockRegexCache sync.Map // pattern -> *regexp.Regexp
+
+// compileBlockRegex compiles a case-insensitive blocklist pattern
+func compileBlockRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := blockRegexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	blockRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// moderationClient sends the classification requests, nil if no moderation
+// supplier is configured
+var moderationClient *http.Client
+
+// InitModeration sets up the client of the configured moderation supplier
+func InitModeration() {
+	name := config.Cfg.Moderation.Supplier
+	if name == "" {
+		return
+	}
+	client, err := proxiedAPIClient(name+"_moderation", 15*time.Second, config.Cfg.Suppliers[name].Proxy)
+	if err != nil {
+		log.Printf("moderation supplier %s: %v", name, err)
+		return
+	}
+	moderationClient = client
+}
+
+type moderationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+// classifyPrompt asks the OpenAI style /moderations endpoint of the
+// configured supplier whether prompt should be refused
+func classifyPrompt(ctx context.Context, prompt string) (string, error) {
+	name := config.Cfg.Moderation.Supplier
+	sc, ok := config.Cfg.Suppliers[name]
+	if !ok || moderationClient == nil {
+		return "", fmt.Errorf("moderation supplier %s is not configured", name)
+	}
+
+	body := map[string]string{"input": prompt}
+	if config.Cfg.Moderation.Model != "" {
+		body["model"] = config.Cfg.Moderation.Model
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(sc.BaseURL, "/")+"/moderations", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sc.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+sc.APIKey)
+	}
+
+	resp, err := moderationClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("moderation: %d %s", resp.StatusCode, msg)
+	}
+
+	var res moderationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	for _, r := range res.Results {
+		if !r.Flagged {
+			continue
+		}
+		var categories []string
+		for c, flagged := range r.Categories {
+			if flagged {
+				categories = append(categories, c)
+			}
+		}
+		slices.Sort(categories)
+		return "moderation: " + strings.Join(categories, ", "), nil
+	}
+	return "", nil
+}
+
+// handleBlocklist manages the prompt blocklist of the group:
+// blocklist, blocklist add [--regex] <pattern>, blocklist rm <id>
+func handleBlocklist(b *qbot.Sender, msg *qbot.Message, args []string) {
+	if !userHasRole(b, msg.UserID, msg.GroupID, db.RoleAdmin) {
+		b.SendGroupMsg(msg.GroupID, "blocklist: Permission denied")
+		return
+	}
+
+	if len(args) == 0 {
+		rules, err := db.GetBlockRules(uint64(msg.GroupID))
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		if len(rules) == 0 {
+			b.SendGroupMsg(msg.GroupID, "The blocklist of this group is empty")
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("Blocklist:")
+		for _, rule := range rules {
+			fmt.Fprintf(&sb, "\n%d: %s %s", rule.ID, rule.Kind, rule.Pattern)
+		}
+		b.SendGroupMsg(msg.GroupID, sb.String())
+		return
+	}
+
+	switch args[0] {
+	case "add":
+		kind := db.BlockKeyword
+		args = args[1:]
+		if len(args) > 0 && args[0] == "--regex" {
+			kind, args = db.BlockRegex, args[1:]
+		}
+		pattern := strings.Join(args, " ")
+		if pattern == "" {
+			b.SendGroupMsg(msg.GroupID, "Usage: /draw blocklist add [--regex] <pattern>")
+			return
+		}
+		if kind == db.BlockRegex {
+			if _, err := compileBlockRegex(pattern); err != nil {
+				b.SendGroupMsg(msg.GroupID, "Invalid regex: "+err.Error())
+				return
+			}
+		}
+		rule := &db.DbBlockRules{
+			GroupID:   uint64(msg.GroupID),
+			Kind:      kind,
+			Pattern:   pattern,
+			CreatedBy: uint64(msg.UserID),
+		}
+		if err := db.AddBlockRule(rule); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Added %s rule %d", kind, rule.ID))
+	case "rm":
+		if len(args) != 2 {
+			b.SendGroupMsg(msg.GroupID, "Usage: /draw blocklist rm <id>")
+			return
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, "Invalid id: "+args[1])
+			return
+		}
+		ok, err := db.RemoveBlockRule(uint64(msg.GroupID), id)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+		} else if !ok {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("No rule %d in this group", id))
+		} else {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Removed rule %d", id))
+		}
+	default:
+		b.SendGroupMsg(msg.GroupID, "Usage: /draw blocklist [add [--regex] <pattern> | rm <id>]")
+	}
+}
+
+// listBlockedPrompts shows the latest n refused prompts of the group
+func listBlockedPrompts(b *qbot.Sender, msg *qbot.Message, n int) {
+	if !userHasRole(b, msg.UserID, msg.GroupID, db.RoleAdmin) {
+		b.SendGroupMsg(msg.GroupID, "blocked: Permission denied")
+		return
+	}
+	entries, err := db.GetBlockedPrompts(uint64(msg.GroupID), n)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No blocked prompts.")
+		return
+	}
+	var sb strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%s %d /%s (%s)\n%s", e.Time.Local().Format("01-02 15:04"), e.UserID, e.Command, e.Reason, e.Prompt)
+	}
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
@@ -1,10 +1,14 @@
 package cmds
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"math"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/awfufu/go-hurobot/internal/config"
 	"github.com/awfufu/go-hurobot/internal/db"
@@ -15,15 +19,40 @@ const permHelpMsg string = `Manage command permissions.
 Usage: perm <subcommand> [args...]
 Subcommands:
   set <cmd> <key> <value>
-    Keys: user_allow (0-2/guest/admin/master), group_enable (0-1), whitelist_user (0-1), whitelist_group (0-1)
-  special <cmd> <user|group> <add|rm|list> [targets...]
-  user <target> <level>
-    Levels: 0/guest, 1/admin, 2/master
+    Keys: user_allow (role name), group_enable (0-1, this group), whitelist_user (0-1), whitelist_group (0-1)
+  group [list|enable|disable|only|default|reset] [cmds...] [--group id]
+    Switch commands on or off in this group. default sets the policy
+    for commands without a switch, reset drops the switches.
+  group suggest <on|off> [--group id]
+    Reply "did you mean" to mistyped commands (default on)
+  special <cmd> <user|group> <add|rm|list> [targets...] [--for <duration>|--until <time>]
+  user <target> [rm] [role] [--group [id]] [--for <duration>|--until <time>]
+    Grant, revoke or list the roles of a user. Granting guest clears them.
+    With --group the role only applies in that group (default: this group).
+    Durations look like 30m, 3h or 7d, times like 2026-12-01 or 2026-12-01T18:00.
+  role <add|rm|list> [name] [rank] [inherits]
+    Built-in roles: guest (0), admin (100), master (1000)
+  explain <cmd> [@user] [group]
+    Show each permission check and its verdict
+  log [n]
+    Show the last n permission changes
+  export [path]
+    Upload all permissions as a YAML file, or write them to path
+  import <path> [--apply]
+    Show how the YAML file at path differs, --apply replaces the
+    sections it contains
 Examples:
-  /perm set draw user_allow 0
+  /perm set draw user_allow guest
   /perm set draw group_enable 1
-  /perm special draw user add @user
-  /perm user @user admin`
+  /perm special draw user add @user --for 3h
+  /perm group disable draw
+  /perm group only calc,fx,crypto
+  /perm user @user admin
+  /perm user @user moderator --group
+  /perm user @user admin --until 2026-12-01
+  /perm role add drawer 10
+  /perm explain draw @user
+  /perm import perms.yaml --apply`
 
 var permCommand *Command = &Command{
 	Name:       "perm",
@@ -34,7 +63,7 @@ var permCommand *Command = &Command{
 	Exec:       execPerm,
 }
 
-func execPerm(b *qbot.Sender, msg *qbot.Message) {
+func execPerm(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	if len(msg.Array) < 2 {
 		b.SendGroupMsg(msg.GroupID, permHelpMsg)
 		return
@@ -57,6 +86,18 @@ func execPerm(b *qbot.Sender, msg *qbot.Message) {
 		handleSpecial(b, msg)
 	case "user":
 		handleUserRole(b, msg)
+	case "role":
+		handleRole(b, msg)
+	case "group":
+		handleGroupCommands(b, msg)
+	case "explain":
+		handleExplain(b, msg)
+	case "log":
+		handlePermLog(b, msg)
+	case "export":
+		handlePermExport(b, msg)
+	case "import":
+		handlePermImport(b, msg)
 	default:
 		b.SendGroupMsg(msg.GroupID, "Unknown subcommand: "+subCmd)
 	}
@@ -86,36 +127,51 @@ func handleSet(b *qbot.Sender, msg *qbot.Message) {
 		// Initialize if not exists (should theoretically exist from startup, but safe fallback)
 		perm = &db.DbPermissions{
 			Command:           cmdName,
-			UserAllow:         2,
-			SpecialUsers:      "",
+			RequiredRole:      db.RoleMaster,
 			IsWhitelistUsers:  0,
-			SpecialGroups:     "",
 			IsWhitelistGroups: 0,
 		}
 	}
 
+	var oldValue string
 	switch key {
 	case "user_allow":
-		valInt := 2
-		switch value {
-		case "0", "guest":
-			valInt = 0
-		case "1", "admin":
-			valInt = 1
-		case "2", "master":
-			valInt = 2
-		default:
-			b.SendGroupMsg(msg.GroupID, "Invalid user_allow. Use 0/guest, 1/admin, 2/master")
+		oldValue = perm.RequiredRole
+		role := parseRoleName(value)
+		if db.GetRole(role) == nil {
+			b.SendGroupMsg(msg.GroupID, "Unknown role: "+value)
 			return
 		}
-		perm.UserAllow = valInt
+		perm.RequiredRole = role
+	case "group_enable":
+		// a per-group switch, not a column of the permission row
+		if _, ok := cmdMap[cmdName]; !ok {
+			b.SendGroupMsg(msg.GroupID, "Unknown command: "+cmdName)
+			return
+		}
+		enable := value == "1" || value == "enable" || value == "true"
+		if !enable && slices.Contains(alwaysEnabled, cmdName) {
+			b.SendGroupMsg(msg.GroupID, cmdName+" cannot be disabled")
+			return
+		}
+		oldValue = describeSwitches(db.GetGroupCommandPolicy(uint64(msg.GroupID)), []string{cmdName})
+		if err := db.SetGroupCommands(uint64(msg.GroupID), []string{cmdName}, enable); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Updated %s %s to %s", cmdName, key, value))
+		auditPerm(msg, "group", describeScope(uint64(msg.GroupID)), oldValue,
+			describeSwitches(db.GetGroupCommandPolicy(uint64(msg.GroupID)), []string{cmdName}))
+		return
 	case "whitelist_user":
+		oldValue = strconv.Itoa(perm.IsWhitelistUsers)
 		if value == "1" || value == "enable" || value == "true" {
 			perm.IsWhitelistUsers = 1
 		} else {
 			perm.IsWhitelistUsers = 0
 		}
 	case "whitelist_group":
+		oldValue = strconv.Itoa(perm.IsWhitelistGroups)
 		if value == "1" || value == "enable" || value == "true" {
 			perm.IsWhitelistGroups = 1
 		} else {
@@ -130,6 +186,7 @@ func handleSet(b *qbot.Sender, msg *qbot.Message) {
 		b.SendGroupMsg(msg.GroupID, "Failed to save permission: "+err.Error())
 	} else {
 		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Updated %s %s to %s", cmdName, key, value))
+		auditPerm(msg, "set", cmdName+" "+key, oldValue, value)
 	}
 }
 
@@ -143,9 +200,14 @@ func handleSpecial(b *qbot.Sender, msg *qbot.Message) {
 		return ""
 	}
 
-	// special <cmd> <user|group> <add|rm|list> [targets...]
+	// special <cmd> <user|group> <add|rm|list> [targets...] [--for|--until x]
 	// 0       1     2            3             4
-	if len(msg.Array) < 5 {
+	args, expires, err := parseExpiryFlag(msg.Array)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(args) < 5 {
 		b.SendGroupMsg(msg.GroupID, "Usage: perm special <cmd> <user|group> <add|rm|list> [targets...]")
 		return
 	}
@@ -154,103 +216,76 @@ func handleSpecial(b *qbot.Sender, msg *qbot.Message) {
 	targetType := getText(3)
 	action := getText(4)
 
-	if targetType != "user" && targetType != "group" {
+	if targetType != db.TargetUser && targetType != db.TargetGroup {
 		b.SendGroupMsg(msg.GroupID, "Invalid target type. Must be user or group.")
 		return
 	}
 
-	var currentList []uint64
-	var rawStr string
-
-	perm := db.GetCommandPermission(cmdName)
-	if perm == nil {
-		perm = &db.DbPermissions{
-			Command:           cmdName,
-			UserAllow:         2,
-			SpecialUsers:      "",
-			IsWhitelistUsers:  0,
-			SpecialGroups:     "",
-			IsWhitelistGroups: 0,
-		}
-	} else {
-		if targetType == "user" {
-			rawStr = perm.SpecialUsers
-		} else {
-			rawStr = perm.SpecialGroups
-		}
-	}
-
-	currentList = db.ParseIDList(rawStr)
+	currentList := specialList(cmdName, targetType)
 
 	switch action {
-	case "add":
-		targets := extractTargets(msg.Array, targetType)
+	case "add", "rm":
+		targets := extractTargets(args[5:], targetType)
 		if len(targets) == 0 {
 			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("No %ss specified.", targetType))
 			return
 		}
-		count := 0
-		for _, t := range targets {
-			if !slices.Contains(currentList, uint64(t)) {
-				currentList = append(currentList, uint64(t))
-				count++
-			}
-		}
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Added %d %ss.", count, targetType))
 
-	case "rm":
-		targets := extractTargets(msg.Array, targetType)
-		if len(targets) == 0 {
-			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("No %ss specified.", targetType))
+		var count int64
+		if action == "add" {
+			count, err = db.AddSpecialTargets(cmdName, targetType, targets, expires, uint64(msg.GroupID))
+		} else {
+			count, err = db.RemoveSpecialTargets(cmdName, targetType, targets)
+		}
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
 			return
 		}
-		count := 0
-		for _, t := range targets {
-			idx := slices.Index(currentList, uint64(t))
-			if idx != -1 {
-				currentList = append(currentList[:idx], currentList[idx+1:]...)
-				count++
-			}
+
+		if action == "add" {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Added %d %ss%s.", count, targetType, describeExpiry(expires)))
+		} else {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Removed %d %ss.", count, targetType))
+		}
+		if count > 0 {
+			auditPerm(msg, "special", cmdName+" "+targetType,
+				db.JoinIDList(currentList), db.JoinIDList(specialList(cmdName, targetType)))
 		}
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Removed %d %ss.", count, targetType))
 
 	case "list":
-		if len(currentList) == 0 {
+		targets, err := db.GetSpecialTargets(cmdName, targetType)
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+		} else if len(targets) == 0 {
 			b.SendGroupMsg(msg.GroupID, "List is empty.")
 		} else {
-			strs := make([]string, len(currentList))
-			for i, v := range currentList {
-				strs[i] = strconv.FormatUint(v, 10)
+			strs := make([]string, len(targets))
+			for i, t := range targets {
+				strs[i] = strconv.FormatUint(t.ID, 10) + describeExpiry(t.ExpiresAt)
 			}
 			b.SendGroupMsg(msg.GroupID, strings.Join(strs, ", "))
 		}
-		return // No save needed for list
 
 	default:
 		b.SendGroupMsg(msg.GroupID, "Unknown action: "+action)
-		return
 	}
+}
 
-	// Update struct
-	newStr := db.JoinIDList(currentList)
-
-	if targetType == "user" {
-		perm.SpecialUsers = newStr
-	} else {
-		perm.SpecialGroups = newStr
+func specialList(cmdName string, targetType string) []uint64 {
+	perm := db.GetCommandPermission(cmdName)
+	if perm == nil {
+		return nil
 	}
-
-	if err := db.SaveCommandPermission(perm); err != nil {
-		b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
-	} else {
-		b.SendGroupMsg(msg.GroupID, "Permission updated.")
+	if targetType == db.TargetUser {
+		return perm.SpecialUsers
 	}
+	return perm.SpecialGroups
 }
 
 func extractTargets(args []qbot.MsgItem, targetType string) []uint64 {
 	var targets []uint64
 	for _, arg := range args {
-		if targetType == "user" {
+		if targetType == db.TargetUser {
 			if arg.Type() == qbot.AtType {
 				targets = append(targets, uint64(arg.At()))
 			} else if arg.Type() == qbot.TextType {
@@ -277,54 +312,409 @@ func extractTargets(args []qbot.MsgItem, targetType string) []uint64 {
 	return targets
 }
 
+// parseRoleName accepts the old numeric levels as aliases of the built-in
+// roles.
+func parseRoleName(s string) string {
+	switch s {
+	case "0":
+		return db.RoleGuest
+	case "1":
+		return db.RoleAdmin
+	case "2":
+		return db.RoleMaster
+	}
+	return strings.ToLower(s)
+}
+
+func parseUserTarget(item qbot.MsgItem) qbot.UserID {
+	if item.Type() == qbot.AtType {
+		return item.At()
+	} else if item.Type() == qbot.TextType {
+		if id, err := strconv.ParseUint(item.Text(), 10, 64); err == nil {
+			return qbot.UserID(id)
+		}
+	}
+	return qbot.InvalidUser
+}
+
+// parseGroupFlag removes a trailing "--group [id]" from args and returns the
+// group it names. Without an id the current group is used, without the flag
+// the result is db.GlobalGroup.
+func parseGroupFlag(args []qbot.MsgItem, current qbot.GroupID) ([]qbot.MsgItem, uint64, bool) {
+	for i, arg := range args {
+		if arg.Type() != qbot.TextType || arg.Text() != "--group" {
+			continue
+		}
+		rest := args[i+1:]
+		if len(rest) == 0 {
+			return args[:i], uint64(current), true
+		}
+		if len(rest) == 1 && rest[0].Type() == qbot.TextType {
+			id, err := strconv.ParseUint(rest[0].Text(), 10, 64)
+			if err != nil {
+				return nil, 0, false
+			}
+			return args[:i], id, true
+		}
+		return nil, 0, false
+	}
+	return args, db.GlobalGroup, true
+}
+
+func describeScope(groupID uint64) string {
+	if groupID == db.GlobalGroup {
+		return "global"
+	}
+	return fmt.Sprintf("group %d", groupID)
+}
+
 func handleUserRole(b *qbot.Sender, msg *qbot.Message) {
+	// user <target> [rm] [role] [--group [id]] [--for|--until x]
+	args, expires, err := parseExpiryFlag(msg.Array)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	args, groupID, ok := parseGroupFlag(args, msg.GroupID)
+	if !ok || len(args) < 3 {
+		b.SendGroupMsg(msg.GroupID, "Usage: perm user <target> [rm] [role] [--group [id]]")
+		return
+	}
+
 	getText := func(i int) string {
-		if i < len(msg.Array) {
-			if msg.Array[i].Type() == qbot.TextType {
-				return msg.Array[i].Text()
+		if i < len(args) {
+			if args[i].Type() == qbot.TextType {
+				return args[i].Text()
 			}
 		}
 		return ""
 	}
 
-	// user <target> <level>
-	if len(msg.Array) < 4 {
-		b.SendGroupMsg(msg.GroupID, "Usage: perm user <target> <level>\nLevels: 0/guest, 1/admin, 2/master")
+	targetID := parseUserTarget(args[2])
+	if targetID == qbot.InvalidUser {
+		b.SendGroupMsg(msg.GroupID, "Invalid user target.")
 		return
 	}
 
-	// Target should be an At item or Int ID
-	targetID := qbot.InvalidUser
-	if msg.Array[2].Type() == qbot.AtType {
-		targetID = msg.Array[2].At()
-	} else if msg.Array[2].Type() == qbot.TextType {
-		if id, err := strconv.ParseUint(msg.Array[2].Text(), 10, 64); err == nil {
-			targetID = qbot.UserID(id)
+	if len(args) == 3 {
+		global := describeGrants(db.GetUserRoleGrants(uint64(targetID), db.GlobalGroup))
+		text := fmt.Sprintf("User %d global roles: %s", targetID, joinOrNone(global))
+		if groupID != db.GlobalGroup {
+			local := describeGrants(db.GetUserRoleGrants(uint64(targetID), groupID))
+			text += fmt.Sprintf("\n%s roles: %s", describeScope(groupID), joinOrNone(local))
 		}
+		b.SendGroupMsg(msg.GroupID, text)
+		return
 	}
 
-	if targetID == qbot.InvalidUser {
-		b.SendGroupMsg(msg.GroupID, "Invalid user target.")
+	oldRoles := strings.Join(db.GetUserRoles(uint64(targetID), groupID), ",")
+	target := fmt.Sprintf("%d %s", targetID, describeScope(groupID))
+
+	// nobody may hand out or take away more than they hold themselves
+	limit := granterRank(msg.UserID)
+	if db.HighestRank(db.GetUserRoles(uint64(targetID), groupID)) > limit {
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("User %d holds a higher role than you", targetID))
 		return
 	}
 
-	levelStr := getText(3)
-	var level int
-	switch levelStr {
-	case "0", "guest":
-		level = 0
-	case "1", "admin":
-		level = 1
-	case "2", "master":
-		level = 2
-	default:
-		b.SendGroupMsg(msg.GroupID, "Invalid level. Usage: 0/guest, 1/admin, 2/master")
+	if getText(3) == "rm" {
+		role := parseRoleName(getText(4))
+		if role == "" {
+			b.SendGroupMsg(msg.GroupID, "Usage: perm user <target> rm <role> [--group [id]]")
+			return
+		}
+		if err := db.RemoveUserRole(uint64(targetID), groupID, role); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to update user role: "+err.Error())
+		} else {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Removed %s role %s from user %d", describeScope(groupID), role, targetID))
+			auditPerm(msg, "user", target, oldRoles, strings.Join(db.GetUserRoles(uint64(targetID), groupID), ","))
+		}
 		return
 	}
 
-	if err := db.UpdateUserPerm(uint64(targetID), level); err != nil {
+	role := parseRoleName(getText(3))
+	if rank := db.RoleRank(role); rank > limit {
+		b.SendGroupMsg(msg.GroupID, "Cannot grant a role above your own: "+role)
+		return
+	} else if groupID != db.GlobalGroup && rank >= db.RoleRank(db.RoleMaster) {
+		b.SendGroupMsg(msg.GroupID, "Roles ranked like master can only be granted globally")
+		return
+	}
+	if role == db.RoleGuest {
+		err = db.ClearUserRoles(uint64(targetID), groupID)
+	} else {
+		err = db.AddUserRole(uint64(targetID), groupID, role, expires, uint64(msg.GroupID))
+	}
+	if err != nil {
 		b.SendGroupMsg(msg.GroupID, "Failed to update user role: "+err.Error())
 	} else {
-		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Updated user %d role to %d", targetID, level))
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Updated user %d %s role to %s%s", targetID, describeScope(groupID), role, describeExpiry(expires)))
+		auditPerm(msg, "user", target, oldRoles, strings.Join(db.GetUserRoles(uint64(targetID), groupID), ","))
+	}
+}
+
+// parseExpiryFlag removes "--for <duration>" or "--until <time>" from args
+// and returns the expiry time, nil if neither is given.
+func parseExpiryFlag(args []qbot.MsgItem) ([]qbot.MsgItem, *time.Time, error) {
+	for i, arg := range args {
+		if arg.Type() != qbot.TextType || (arg.Text() != "--for" && arg.Text() != "--until") {
+			continue
+		}
+		if i+1 >= len(args) || args[i+1].Type() != qbot.TextType {
+			return nil, nil, fmt.Errorf("%s: value required", arg.Text())
+		}
+		value := args[i+1].Text()
+
+		var expires time.Time
+		if arg.Text() == "--for" {
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, nil, fmt.Errorf("invalid duration: %s", value)
+			}
+			expires = time.Now().Add(d)
+		} else {
+			t, err := parseTime(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid time: %s", value)
+			}
+			if !t.After(time.Now()) {
+				return nil, nil, fmt.Errorf("time is in the past: %s", value)
+			}
+			expires = t
+		}
+
+		rest := append(slices.Clone(args[:i]), args[i+2:]...)
+		return rest, &expires, nil
+	}
+	return args, nil, nil
+}
+
+// parseDuration extends time.ParseDuration with d (day) and w (week) units.
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(v * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format")
+}
+
+func describeExpiry(expires *time.Time) string {
+	if expires == nil {
+		return ""
+	}
+	return " (until " + expires.Local().Format("2006-01-02 15:04") + ")"
+}
+
+func describeGrants(grants []db.DbUserRoles) []string {
+	res := make([]string, len(grants))
+	for i, g := range grants {
+		res[i] = g.Role + describeExpiry(g.ExpiresAt)
+	}
+	return res
+}
+
+func joinOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
+
+func handleRole(b *qbot.Sender, msg *qbot.Message) {
+	getText := func(i int) string {
+		if i < len(msg.Array) {
+			if msg.Array[i].Type() == qbot.TextType {
+				return msg.Array[i].Text()
+			}
+		}
+		return ""
+	}
+
+	// role <add|rm|list> [name] [rank] [inherits]
+	// 1    2             3      4      5
+	switch getText(2) {
+	case "add":
+		name := strings.ToLower(getText(3))
+		rank, err := strconv.Atoi(getText(4))
+		if name == "" || err != nil {
+			b.SendGroupMsg(msg.GroupID, "Usage: perm role add <name> <rank> [inherits]")
+			return
+		}
+		if db.IsBuiltinRole(name) {
+			b.SendGroupMsg(msg.GroupID, "Cannot modify built-in role "+name)
+			return
+		}
+		limit := granterRank(msg.UserID)
+		if rank > limit || db.RoleRank(strings.ToLower(getText(5))) > limit || db.RoleRank(name) > limit {
+			b.SendGroupMsg(msg.GroupID, "Cannot define a role above your own rank")
+			return
+		}
+		oldRole := describeRole(db.GetRole(name))
+		role := &db.DbRoles{Name: name, Rank: rank, Inherits: strings.ToLower(getText(5))}
+		if err := db.SaveRole(role); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save role: "+err.Error())
+		} else {
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Saved role %s (rank %d)", name, rank))
+			auditPerm(msg, "role", name, oldRole, describeRole(role))
+		}
+	case "rm":
+		name := strings.ToLower(getText(3))
+		if name == "" {
+			b.SendGroupMsg(msg.GroupID, "Usage: perm role rm <name>")
+			return
+		}
+		if db.RoleRank(name) > granterRank(msg.UserID) {
+			b.SendGroupMsg(msg.GroupID, "Cannot remove a role above your own rank")
+			return
+		}
+		oldRole := describeRole(db.GetRole(name))
+		if err := db.DeleteRole(name); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to remove role: "+err.Error())
+		} else {
+			b.SendGroupMsg(msg.GroupID, "Removed role "+name)
+			auditPerm(msg, "role", name, oldRole, "")
+		}
+	case "list":
+		roles, err := db.GetRoles()
+		if err != nil {
+			b.SendGroupMsg(msg.GroupID, err.Error())
+			return
+		}
+		lines := make([]string, len(roles))
+		for i, r := range roles {
+			lines[i] = describeRole(&r)
+		}
+		b.SendGroupMsg(msg.GroupID, strings.Join(lines, "\n"))
+	default:
+		b.SendGroupMsg(msg.GroupID, "Usage: perm role <add|rm|list> [name] [rank] [inherits]")
+	}
+}
+
+// granterRank is the highest rank among the global roles of userID, the
+// configured master outranks everything
+func granterRank(userID qbot.UserID) int {
+	if userID == config.Cfg.Permissions.MasterID {
+		return math.MaxInt
+	}
+	return db.HighestRank(db.GetUserRoles(uint64(userID), db.GlobalGroup))
+}
+
+func describeRole(r *db.DbRoles) string {
+	if r == nil {
+		return ""
+	}
+	desc := fmt.Sprintf("%s: %d", r.Name, r.Rank)
+	if r.Inherits != "" {
+		desc += " (inherits " + r.Inherits + ")"
+	}
+	return desc
+}
+
+func auditPerm(msg *qbot.Message, action, target, oldValue, newValue string) {
+	err := db.SavePermAudit(&db.DbPermAudit{
+		ActorID:  uint64(msg.UserID),
+		GroupID:  uint64(msg.GroupID),
+		Action:   action,
+		Target:   target,
+		OldValue: oldValue,
+		NewValue: newValue,
+	})
+	if err != nil {
+		log.Printf("failed to save perm audit: %v", err)
+	}
+}
+
+func handleExplain(b *qbot.Sender, msg *qbot.Message) {
+	// explain <cmd> [@user] [group]
+	// 1       2     3...
+	if len(msg.Array) < 3 || msg.Array[2].Type() != qbot.TextType {
+		b.SendGroupMsg(msg.GroupID, "Usage: perm explain <cmd> [@user] [group]")
+		return
+	}
+	cmdName := msg.Array[2].Text()
+
+	userID := msg.UserID
+	groupID := msg.GroupID
+	var ids []uint64
+	hasAt := false
+	for _, arg := range msg.Array[3:] {
+		switch arg.Type() {
+		case qbot.AtType:
+			userID = arg.At()
+			hasAt = true
+		case qbot.TextType:
+			id, err := strconv.ParseUint(arg.Text(), 10, 64)
+			if err != nil {
+				b.SendGroupMsg(msg.GroupID, "Invalid argument: "+arg.Text())
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+	// with a mention the only number is the group, otherwise it is user then group
+	if !hasAt && len(ids) > 0 {
+		userID = qbot.UserID(ids[0])
+		ids = ids[1:]
+	}
+	if len(ids) > 0 {
+		groupID = qbot.GroupID(ids[0])
+	}
+
+	var trace []string
+	allowed := evalCmdPermission(b, cmdName, userID, groupID, &trace)
+	verdict := "denied"
+	if allowed {
+		verdict = "allowed"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s for user %d in group %d:", cmdName, userID, groupID)
+	for i, step := range trace {
+		fmt.Fprintf(&sb, "\n%d. %s", i+1, step)
+	}
+	sb.WriteString("\nresult: " + verdict)
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
+
+func handlePermLog(b *qbot.Sender, msg *qbot.Message) {
+	n := 10
+	if len(msg.Array) > 2 && msg.Array[2].Type() == qbot.TextType {
+		v, err := strconv.Atoi(msg.Array[2].Text())
+		if err != nil || v < 1 || v > 50 {
+			b.SendGroupMsg(msg.GroupID, "Invalid count, must be 1-50")
+			return
+		}
+		n = v
+	}
+
+	entries, err := db.GetPermAudit(n)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No permission changes recorded.")
+		return
+	}
+
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = fmt.Sprintf("%s %d %s %s: %q -> %q",
+			e.Time.Local().Format("01-02 15:04"), e.ActorID, e.Action, e.Target, e.OldValue, e.NewValue)
 	}
+	b.SendGroupMsg(msg.GroupID, strings.Join(lines, "\n"))
 }
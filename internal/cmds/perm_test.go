@@ -0,0 +1,53 @@
+package cmds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30m", 30 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1d", 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"0.5w", 84 * time.Hour, false},
+		{"d", 0, true},
+		{"xd", 0, true},
+		{"1y", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2026-10-19", time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)},
+		{"2026-10-19T08:30", time.Date(2026, 10, 19, 8, 30, 0, 0, time.Local)},
+		{"2026-10-19T08:30:15", time.Date(2026, 10, 19, 8, 30, 15, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.in)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := parseTime("19/10/2026"); err == nil {
+		t.Error("parseTime accepted 19/10/2026")
+	}
+}
@@ -0,0 +1,141 @@
+package cmds
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+	"gopkg.in/yaml.v3"
+)
+
+// maxDiffLines limits how much of an import diff is sent to a group
+const maxDiffLines = 30
+
+// ExportPermissions renders the permission state as YAML
+func ExportPermissions() ([]byte, error) {
+	p, err := db.ExportPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(p)
+}
+
+// LoadPermissionFile reads a policy file. Commands missing from its commands
+// section get their built-in defaults, so that applying it never leaves a
+// command without a rule.
+func LoadPermissionFile(path string) (*db.Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p db.Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if p.Commands != nil {
+		for name, cmd := range cmdMap {
+			if _, ok := p.Commands[name]; !ok {
+				p.Commands[name] = db.PolicyCommand{RequiredRole: string(cmd.Permission)}
+			}
+		}
+	}
+	if err := db.ValidatePolicy(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ImportPermissions compares the policy in path with the database and
+// returns the differences, applying them if apply is set.
+func ImportPermissions(path string, apply bool) ([]string, error) {
+	p, err := LoadPermissionFile(path)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := db.DiffPolicy(p)
+	if err != nil {
+		return nil, err
+	}
+	if apply && len(diff) > 0 {
+		if err := db.ApplyPolicy(p); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+func handlePermExport(b *qbot.Sender, msg *qbot.Message) {
+	// export [path]
+	data, err := ExportPermissions()
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to export: "+err.Error())
+		return
+	}
+
+	if len(msg.Array) > 2 && msg.Array[2].Type() == qbot.TextType {
+		path := msg.Array[2].Text()
+		if !userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster) {
+			b.SendGroupMsg(msg.GroupID, "Only the master can write files")
+			return
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to write: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, "Permissions exported to "+path)
+		return
+	}
+
+	name := fmt.Sprintf("permissions-%s.yaml", time.Now().Format("20060102-150405"))
+	file := "base64://" + base64.StdEncoding.EncodeToString(data)
+	if err := b.UploadGroupFile(msg.GroupID, file, name, ""); err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to upload: "+err.Error())
+	}
+}
+
+func handlePermImport(b *qbot.Sender, msg *qbot.Message) {
+	// import <path> [--apply]
+	if len(msg.Array) < 3 || msg.Array[2].Type() != qbot.TextType {
+		b.SendGroupMsg(msg.GroupID, "Usage: perm import <path> [--apply]")
+		return
+	}
+	if !userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster) {
+		b.SendGroupMsg(msg.GroupID, "Only the master can read files")
+		return
+	}
+	path := msg.Array[2].Text()
+	apply := len(msg.Array) > 3 && msg.Array[3].Type() == qbot.TextType && msg.Array[3].Text() == "--apply"
+
+	diff, err := ImportPermissions(path, apply)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, "Failed to import: "+err.Error())
+		return
+	}
+	if len(diff) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No changes.")
+		return
+	}
+
+	shown := diff
+	if len(shown) > maxDiffLines {
+		shown = shown[:maxDiffLines]
+	}
+	var sb strings.Builder
+	if apply {
+		fmt.Fprintf(&sb, "Applied %d changes from %s:", len(diff), path)
+		auditPerm(msg, "import", path, "", fmt.Sprintf("%d changes", len(diff)))
+	} else {
+		fmt.Fprintf(&sb, "Dry run, %d changes (add --apply to apply):", len(diff))
+	}
+	for _, line := range shown {
+		sb.WriteString("\n" + line)
+	}
+	if len(diff) > len(shown) {
+		fmt.Fprintf(&sb, "\n... %d more", len(diff)-len(shown))
+	}
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
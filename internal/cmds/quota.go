@@ -0,0 +1,320 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+const quotaHelpMsg string = `Show or manage daily command quotas.
+Usage:
+  /quota                                - Show your remaining quota in this group
+  /quota set <cmd> <user|group> <n>     - Set a daily limit, 0 removes it (master)
+  /quota cooldown <cmd> <seconds>       - Set a per-user cooldown (master)
+  /quota bonus <cmd> <@user|group> <n>  - Grant extra uses until the next reset (global admin)
+Quotas reset every day at the configured local time, the master is exempt.
+/draw, /crypto and /fx do not count failed requests or listings such as
+/draw --queue.
+Example: /quota set draw user 5`
+
+var quotaCommand *Command = &Command{
+	Name:       "quota",
+	HelpMsg:    quotaHelpMsg,
+	Permission: config.Guest,
+	NeedRawMsg: false,
+	MaxArgs:    5,
+	Exec:       execQuota,
+}
+
+var (
+	cooldownMu    sync.Mutex
+	cooldownUntil = make(map[string]time.Time) // "cmd:user" -> end of the cooldown
+	cooldownPrune time.Time
+)
+
+// quotaPeriod returns the key of the quota period now falls into and when
+// the next one starts.
+func quotaPeriod(now time.Time) (string, time.Time) {
+	t, _ := time.Parse("15:04", config.Cfg.Quota.ResetTime)
+	start := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// quotaCharge is one counted use of a command
+type quotaCharge struct {
+	quota   *db.DbQuotas
+	userID  uint64
+	groupID uint64
+	period  string
+}
+
+type chargeKey struct{}
+
+// chargedPeriod returns the quota period the command running with ctx was
+// counted in, or "" if it was not counted
+func chargedPeriod(ctx context.Context) string {
+	if c, ok := ctx.Value(chargeKey{}).(*quotaCharge); ok {
+		return c.period
+	}
+	return ""
+}
+
+// chargeQuota counts one use of the running command and runs billable with
+// the charge attached to its context. billable reports whether it delivered,
+// the use is given back if it did not. Nothing runs if the cooldown or the
+// daily limit refuses the call.
+func chargeQuota(ctx context.Context, b *qbot.Sender, msg *qbot.Message, billable func(ctx context.Context) bool) {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	charge, ok := checkQuota(b, msg, c.cmd)
+	if !ok {
+		return
+	}
+	if charge == nil {
+		billable(ctx)
+		return
+	}
+	if !billable(context.WithValue(ctx, chargeKey{}, charge)) {
+		if err := db.RefundQuota(charge.quota, charge.userID, charge.groupID, charge.period); err != nil {
+			log.Printf("failed to refund quota of %s: %v", c.cmd, err)
+		}
+	}
+}
+
+// refundDrawJob gives back the use counted for a draw job that failed or
+// was cancelled
+func refundDrawJob(job *db.DbDrawJobs) {
+	q := db.GetQuota("draw")
+	if q == nil || job.QuotaPeriod == "" {
+		return
+	}
+	if err := db.RefundQuota(q, job.UserID, job.GroupID, job.QuotaPeriod); err != nil {
+		log.Printf("failed to refund quota of draw job %d: %v", job.ID, err)
+	}
+}
+
+// checkQuota enforces the cooldown and daily limits of cmdName and counts
+// the use. It tells the group and returns false if the command may not run,
+// the charge is nil if nothing was counted.
+func checkQuota(b *qbot.Sender, msg *qbot.Message, cmdName string) (*quotaCharge, bool) {
+	q := db.GetQuota(cmdName)
+	if q == nil || userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster) {
+		return nil, true
+	}
+
+	now := time.Now()
+	key := fmt.Sprintf("%s:%d", cmdName, msg.UserID)
+	var prev time.Time
+	if q.Cooldown > 0 {
+		// claim the cooldown right away so that concurrent calls see it
+		cooldownMu.Lock()
+		prev = cooldownUntil[key]
+		if wait := prev.Sub(now); wait > 0 {
+			cooldownMu.Unlock()
+			b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%s: cooldown, try again in %s", cmdName, wait.Round(time.Second)))
+			return nil, false
+		}
+		cooldownUntil[key] = now.Add(time.Duration(q.Cooldown) * time.Second)
+		pruneCooldowns(now)
+		cooldownMu.Unlock()
+	}
+	releaseCooldown := func() {
+		if q.Cooldown > 0 {
+			cooldownMu.Lock()
+			cooldownUntil[key] = prev
+			cooldownMu.Unlock()
+		}
+	}
+
+	period, next := quotaPeriod(now)
+	err := db.ConsumeQuota(q, uint64(msg.UserID), uint64(msg.GroupID), period)
+	var exceeded *db.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		releaseCooldown()
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("%s: daily %s quota used up (%d/%d), resets at %s",
+			cmdName, exceeded.Scope, exceeded.Used, exceeded.Limit, next.Format("01-02 15:04")))
+		return nil, false
+	} else if err != nil {
+		releaseCooldown()
+		log.Printf("failed to count quota of %s: %v", cmdName, err)
+		b.SendGroupMsg(msg.GroupID, cmdName+": failed to check quota, try again later")
+		return nil, false
+	}
+	return &quotaCharge{quota: q, userID: uint64(msg.UserID), groupID: uint64(msg.GroupID), period: period}, true
+}
+
+// pruneCooldowns drops ended cooldowns at most once a minute, the caller
+// holds cooldownMu
+func pruneCooldowns(now time.Time) {
+	if now.Sub(cooldownPrune) < time.Minute {
+		return
+	}
+	cooldownPrune = now
+	for key, until := range cooldownUntil {
+		if !until.After(now) {
+			delete(cooldownUntil, key)
+		}
+	}
+}
+
+func execQuota(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
+	getText := func(i int) string {
+		if i < len(msg.Array) {
+			if msg.Array[i].Type() == qbot.TextType {
+				return msg.Array[i].Text()
+			}
+		}
+		return ""
+	}
+
+	if len(msg.Array) < 2 {
+		showQuota(b, msg)
+		return
+	}
+
+	sub := getText(1)
+	if sub != "set" && sub != "cooldown" && sub != "bonus" {
+		b.SendGroupMsg(msg.GroupID, quotaHelpMsg)
+		return
+	}
+	cmdName := strings.TrimPrefix(getText(2), "/")
+	if _, ok := cmdMap[cmdName]; !ok {
+		b.SendGroupMsg(msg.GroupID, "Unknown command: "+getText(2))
+		return
+	}
+
+	switch sub {
+	case "set", "cooldown":
+		if !userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster) {
+			b.SendGroupMsg(msg.GroupID, "quota: Permission denied")
+			return
+		}
+		q := db.DbQuotas{Command: cmdName}
+		if cur := db.GetQuota(cmdName); cur != nil {
+			q = *cur
+		}
+
+		valueArg := getText(4)
+		if sub == "cooldown" {
+			valueArg = getText(3)
+		}
+		n, err := strconv.Atoi(valueArg)
+		if err != nil || n < 0 {
+			b.SendGroupMsg(msg.GroupID, "Invalid number: "+valueArg)
+			return
+		}
+
+		if sub == "cooldown" {
+			q.Cooldown = n
+		} else {
+			switch getText(3) {
+			case db.TargetUser:
+				q.UserLimit = n
+			case db.TargetGroup:
+				q.GroupLimit = n
+			default:
+				b.SendGroupMsg(msg.GroupID, "Usage: quota set <cmd> <user|group> <n>")
+				return
+			}
+		}
+		if err := db.SaveQuota(&q); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, cmdName+": "+describeQuota(&q))
+
+	case "bonus":
+		// group admins may be mapped onto admin, they must not hand
+		// themselves free uses of paid commands
+		if !userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleAdmin) {
+			b.SendGroupMsg(msg.GroupID, "quota: Permission denied")
+			return
+		}
+		if len(msg.Array) < 5 {
+			b.SendGroupMsg(msg.GroupID, "Usage: quota bonus <cmd> <@user|group> <n>")
+			return
+		}
+		scope, targetID := db.TargetUser, uint64(parseUserTarget(msg.Array[3]))
+		if getText(3) == db.TargetGroup {
+			scope, targetID = db.TargetGroup, uint64(msg.GroupID)
+		} else if targetID == uint64(qbot.InvalidUser) {
+			b.SendGroupMsg(msg.GroupID, "Invalid target.")
+			return
+		}
+		n, err := strconv.Atoi(getText(4))
+		if err != nil || n < 1 {
+			b.SendGroupMsg(msg.GroupID, "Invalid number: "+getText(4))
+			return
+		}
+		period, _ := quotaPeriod(time.Now())
+		if err := db.AddQuotaBonus(cmdName, scope, targetID, period, n); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, fmt.Sprintf("Granted %d extra %s uses to %s %d", n, cmdName, scope, targetID))
+	}
+}
+
+func describeQuota(q *db.DbQuotas) string {
+	var parts []string
+	if q.UserLimit > 0 {
+		parts = append(parts, fmt.Sprintf("%d per user", q.UserLimit))
+	}
+	if q.GroupLimit > 0 {
+		parts = append(parts, fmt.Sprintf("%d per group", q.GroupLimit))
+	}
+	if q.Cooldown > 0 {
+		parts = append(parts, fmt.Sprintf("cooldown %ds", q.Cooldown))
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func showQuota(b *qbot.Sender, msg *qbot.Message) {
+	quotas, err := db.GetQuotas()
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(quotas) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No command has a quota.")
+		return
+	}
+
+	period, next := quotaPeriod(time.Now())
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Quotas until %s", next.Format("01-02 15:04"))
+	if userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster) {
+		sb.WriteString(" (you are exempt)")
+	}
+	sb.WriteString(":")
+	for _, q := range quotas {
+		var parts []string
+		if q.UserLimit > 0 {
+			used, bonus := db.GetQuotaUsage(q.Command, db.TargetUser, uint64(msg.UserID), period)
+			parts = append(parts, fmt.Sprintf("you %d/%d left", max(q.UserLimit+bonus-used, 0), q.UserLimit+bonus))
+		}
+		if q.GroupLimit > 0 {
+			used, bonus := db.GetQuotaUsage(q.Command, db.TargetGroup, uint64(msg.GroupID), period)
+			parts = append(parts, fmt.Sprintf("group %d/%d left", max(q.GroupLimit+bonus-used, 0), q.GroupLimit+bonus))
+		}
+		if q.Cooldown > 0 {
+			parts = append(parts, fmt.Sprintf("cooldown %ds", q.Cooldown))
+		}
+		fmt.Fprintf(&sb, "\n%s: %s", q.Command, strings.Join(parts, ", "))
+	}
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
@@ -0,0 +1,239 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+const recallHelpMsg string = `Reveal recalled messages.
+Usage:
+  /recall on|off       - Enable or disable recall notices in this group
+  /recall list [n]     - List the last n recalled messages (default 5, max 20)
+  [Reply to a recall notice] /recall - Show the original message
+Example: /recall list 10`
+
+var recallCommand *Command = &Command{
+	Name:       "recall",
+	HelpMsg:    recallHelpMsg,
+	Permission: getCmdPermLevel("recall"),
+	NeedRawMsg: false,
+	MaxArgs:    3,
+	Exec:       execRecall,
+}
+
+func execRecall(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
+	getText := func(i int) string {
+		if i < len(msg.Array) {
+			if msg.Array[i].Type() == qbot.TextType {
+				return msg.Array[i].Text()
+			}
+		}
+		return ""
+	}
+
+	if len(msg.Array) < 2 {
+		if msg.ReplyID == 0 {
+			b.SendGroupMsg(msg.GroupID, recallHelpMsg)
+			return
+		}
+		if !recallEnabled(b, msg) {
+			return
+		}
+		showRecallByNotice(b, msg)
+		return
+	}
+
+	switch getText(1) {
+	case "on", "off":
+		if err := db.SetRecallEnabled(uint64(msg.GroupID), getText(1) == "on"); err != nil {
+			b.SendGroupMsg(msg.GroupID, "Failed to save: "+err.Error())
+			return
+		}
+		b.SendGroupMsg(msg.GroupID, "recall: "+getText(1))
+	case "list":
+		if !recallEnabled(b, msg) {
+			return
+		}
+		n := 5
+		if s := getText(2); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 || v > 20 {
+				b.SendGroupMsg(msg.GroupID, "Invalid count, must be 1-20")
+				return
+			}
+			n = v
+		}
+		listRecalls(b, msg, n)
+	default:
+		b.SendGroupMsg(msg.GroupID, recallHelpMsg)
+	}
+}
+
+// recallEnabled tells the sender to opt in first when the group has not, so
+// recalled messages are never shown in a group that did not ask for it
+func recallEnabled(b *qbot.Sender, msg *qbot.Message) bool {
+	if db.GetGroupSettings(uint64(msg.GroupID)).RecallEnabled {
+		return true
+	}
+	b.SendGroupMsg(msg.GroupID, "Recall is off in this group, enable it with /recall on")
+	return false
+}
+
+func listRecalls(b *qbot.Sender, msg *qbot.Message, n int) {
+	recalls, err := db.GetRecalledMessages(uint64(msg.GroupID), n)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(recalls) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No recalled messages.")
+		return
+	}
+
+	var sb strings.Builder
+	for i, r := range recalls {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%s(%d) %s\n%s", r.Name, r.UserID, r.Time.Local().Format("01-02 15:04"), cqToText(r.Raw))
+	}
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
+
+func showRecallByNotice(b *qbot.Sender, msg *qbot.Message) {
+	r, err := db.GetRecallByNotice(uint64(msg.GroupID), uint64(msg.ReplyID))
+	if err != nil {
+		b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, "Not a recall notice")
+		return
+	}
+
+	content := []any{fmt.Sprintf("%s(%d) %s:\n", r.Name, r.UserID, r.Time.Local().Format("01-02 15:04"))}
+	content = append(content, cqToSegments(r.Raw)...)
+	b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, content...)
+}
+
+// HandleRecall records a recall notice and, if the group opted in, posts a
+// notice that admins can reply to with /recall.
+func HandleRecall(b *qbot.Sender, notice *qbot.RecallNotice) {
+	if notice.GroupID == qbot.InvalidGroup {
+		return
+	}
+
+	ev := &db.DbEvents{
+		Kind:       db.EventRecall,
+		GroupID:    uint64(notice.GroupID),
+		UserID:     uint64(notice.UserID),
+		OperatorID: uint64(notice.OperatorID),
+		MsgID:      uint64(notice.MessageID),
+		Time:       time.Unix(notice.Time, 0),
+	}
+
+	if db.GetGroupSettings(uint64(notice.GroupID)).RecallEnabled {
+		text := fmt.Sprintf("%d recalled a message", notice.UserID)
+		if notice.OperatorID != 0 && notice.OperatorID != notice.UserID {
+			text = fmt.Sprintf("%d recalled a message from %d", notice.OperatorID, notice.UserID)
+		}
+		noticeID, err := b.SendGroupMsg(notice.GroupID, text+", reply /recall to view it")
+		if err != nil {
+			log.Printf("failed to send recall notice: %v", err)
+		}
+		ev.NoticeID = noticeID
+	}
+
+	if err := db.SaveEvent(ev); err != nil {
+		log.Printf("failed to save recall of message %d: %v", notice.MessageID, err)
+	}
+}
+
+// cqSegment is a piece of a raw message, either plain text (typ == "") or a
+// CQ code such as [CQ:image,file=xxx,url=xxx].
+type cqSegment struct {
+	typ    string
+	text   string
+	params map[string]string
+}
+
+func parseCQ(raw string) []cqSegment {
+	var segs []cqSegment
+	for len(raw) > 0 {
+		start := strings.Index(raw, "[CQ:")
+		if start == -1 {
+			segs = append(segs, cqSegment{text: decodeSpecialChars(raw)})
+			break
+		}
+		if start > 0 {
+			segs = append(segs, cqSegment{text: decodeSpecialChars(raw[:start])})
+		}
+		end := strings.IndexByte(raw[start:], ']')
+		if end == -1 {
+			segs = append(segs, cqSegment{text: decodeSpecialChars(raw[start:])})
+			break
+		}
+		code := raw[start+4 : start+end]
+		raw = raw[start+end+1:]
+
+		parts := strings.Split(code, ",")
+		seg := cqSegment{typ: parts[0], params: make(map[string]string)}
+		for _, p := range parts[1:] {
+			if k, v, ok := strings.Cut(p, "="); ok {
+				seg.params[k] = decodeSpecialChars(strings.ReplaceAll(v, "&#44;", ","))
+			}
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// cqToText renders a raw message as plain text with placeholders for media.
+func cqToText(raw string) string {
+	var sb strings.Builder
+	for _, seg := range parseCQ(raw) {
+		switch seg.typ {
+		case "":
+			sb.WriteString(seg.text)
+		case "at":
+			sb.WriteString("@" + seg.params["qq"])
+		default:
+			sb.WriteString("[" + seg.typ + "]")
+		}
+	}
+	return sb.String()
+}
+
+// cqToSegments rebuilds a raw message for re-sending. Mentions are turned
+// into text so nobody gets pinged again.
+func cqToSegments(raw string) []any {
+	var res []any
+	for _, seg := range parseCQ(raw) {
+		switch seg.typ {
+		case "":
+			if seg.text != "" {
+				res = append(res, seg.text)
+			}
+		case "at":
+			res = append(res, "@"+seg.params["qq"])
+		case "face":
+			if id, err := strconv.ParseUint(seg.params["id"], 10, 16); err == nil {
+				res = append(res, qbot.Face(qbot.FaceID(id)))
+			}
+		case "image":
+			file := seg.params["url"]
+			if file == "" {
+				file = seg.params["file"]
+			}
+			if file != "" {
+				res = append(res, qbot.Image(file))
+			}
+		default:
+			res = append(res, "["+seg.typ+"]")
+		}
+	}
+	return res
+}
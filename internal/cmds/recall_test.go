@@ -0,0 +1,35 @@
+package cmds
+
+import "testing"
+
+func TestCQToText(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"hello", "hello"},
+		{"", ""},
+		{"[CQ:at,qq=123] hi", "@123 hi"},
+		{"look [CQ:image,file=a.jpg,url=https://x/a.jpg&amp;b=1]!", "look [image]!"},
+		{"a &#91;b&#93; &amp; c", "a [b] & c"},
+		{"broken [CQ:image,file=a", "broken [CQ:image,file=a"},
+	}
+	for _, tt := range tests {
+		if got := cqToText(tt.raw); got != tt.want {
+			t.Errorf("cqToText(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseCQParams(t *testing.T) {
+	segs := parseCQ("[CQ:image,file=a.jpg,url=https://x/?a=1&#44;2&amp;b=3]")
+	if len(segs) != 1 || segs[0].typ != "image" {
+		t.Fatalf("got %+v", segs)
+	}
+	if got := segs[0].params["url"]; got != "https://x/?a=1,2&b=3" {
+		t.Errorf("url = %q", got)
+	}
+	if got := segs[0].params["file"]; got != "a.jpg" {
+		t.Errorf("file = %q", got)
+	}
+}
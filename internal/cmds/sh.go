@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,7 +9,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
 	"github.com/awfufu/qbot"
 )
 
@@ -62,11 +63,12 @@ var shCommand *Command = &Command{
 	HelpMsg:    shHelpMsg,
 	Permission: getCmdPermLevel("sh"),
 	NeedRawMsg: true,
+	Slow:       true,
 	MinArgs:    2,
 	Exec:       execSh,
 }
 
-func execSh(b *qbot.Sender, msg *qbot.Message) {
+func execSh(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	// For NeedRawMsg, msg.Array[1] contains the raw arguments string.
 	// But let's verify if we need parsing for --reset
 	// The original code checked args[1] == "--reset".
@@ -84,7 +86,8 @@ func execSh(b *qbot.Sender, msg *qbot.Message) {
 		rawArgs = msg.Array[1].Text()
 	}
 
-	isMaster := GetUserPermission(msg.UserID) == config.Master
+	// only global roles grant the master shell
+	isMaster := userHasRole(b, msg.UserID, qbot.GroupID(db.GlobalGroup), db.RoleMaster)
 	if strings.TrimSpace(rawArgs) == "--reset" {
 		if isMaster {
 			masterWorkingDir = masterHome
@@ -101,11 +104,14 @@ func execSh(b *qbot.Sender, msg *qbot.Message) {
 	var shellCmd *exec.Cmd = nil
 	if isMaster {
 		fullCmd := fmt.Sprintf("cd %s && %s; echo '\n'; pwd", masterWorkingDir, rawcmd)
-		shellCmd = exec.Command("zsh", "-c", fullCmd)
+		shellCmd = exec.CommandContext(ctx, "zsh", "-c", fullCmd)
 	} else {
 		fullCmd := fmt.Sprintf("cd %s && %s; echo '\n'; pwd", workingDir, rawcmd)
-		shellCmd = exec.Command("ssh", user+"@127.0.0.1", "zsh", "-c", fullCmd)
+		shellCmd = exec.CommandContext(ctx, "ssh", user+"@127.0.0.1", "zsh", "-c", fullCmd)
 	}
+	// once the shell is killed, stop waiting for a background child that
+	// still holds the output pipe open
+	shellCmd.WaitDelay = 5 * time.Second
 
 	done := make(chan error, 1)
 	var output []byte
@@ -156,5 +162,9 @@ func execSh(b *qbot.Sender, msg *qbot.Message) {
 	case <-time.After(300 * time.Second):
 		shellCmd.Process.Kill()
 		b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, fmt.Sprintf("Timeout: %q", rawcmd))
+	case <-ctx.Done():
+		// CommandContext kills the process, wait for the output goroutine
+		<-done
+		b.SendGroupReplyMsg(msg.GroupID, msg.MsgID, fmt.Sprintf("Interrupted: %q", rawcmd))
 	}
 }
@@ -1,6 +1,7 @@
 package cmds
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -21,7 +22,7 @@ var specialtitleCommand *Command = &Command{
 	Exec:       execSpecialTitle,
 }
 
-func execSpecialTitle(b *qbot.Sender, msg *qbot.Message) {
+func execSpecialTitle(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	var targetUserID qbot.UserID
 	var title string
 
@@ -0,0 +1,91 @@
+package cmds
+
+import (
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+// suggestCooldown is the minimum time between two suggestions in a group
+const suggestCooldown = time.Minute
+
+var (
+	suggestMu   sync.Mutex
+	lastSuggest = make(map[qbot.GroupID]time.Time)
+)
+
+// suggestCommand replies with the closest command the user may run when
+// name is not a command. Words that do not look like a typo of a command are
+// ignored, and each group gets at most one suggestion per suggestCooldown.
+func suggestCommand(b *qbot.Sender, msg *qbot.Message, name string) {
+	if len(name) < 2 || len(name) > 16 || !isLowerWord(name) {
+		return
+	}
+	if db.GetGroupSettings(uint64(msg.GroupID)).SuggestDisabled {
+		return
+	}
+
+	// allow one edit for short names, two for longer ones
+	maxDist := 1
+	if len(name) > 4 {
+		maxDist = 2
+	}
+	best, bestDist := "", maxDist+1
+	for _, cand := range commandNames() {
+		d := editDistance(name, cand)
+		if d < bestDist && checkCmdPermission(b, cand, msg.UserID, msg.GroupID) {
+			best, bestDist = cand, d
+		}
+	}
+	if best == "" {
+		return
+	}
+
+	suggestMu.Lock()
+	now := time.Now()
+	if now.Sub(lastSuggest[msg.GroupID]) < suggestCooldown {
+		suggestMu.Unlock()
+		return
+	}
+	lastSuggest[msg.GroupID] = now
+	suggestMu.Unlock()
+
+	b.SendGroupMsg(msg.GroupID, "/"+name+": did you mean /"+best+"?")
+}
+
+func isLowerWord(s string) bool {
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// editDistance is the Damerau-Levenshtein distance (with adjacent swaps) of a
+// and b
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
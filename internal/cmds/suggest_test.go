@@ -0,0 +1,41 @@
+package cmds
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"draw", "draw", 0},
+		{"", "draw", 4},
+		{"draw", "", 4},
+		{"drw", "draw", 1},
+		{"drawx", "draw", 1},
+		{"drew", "draw", 1},
+		{"darw", "draw", 1}, // adjacent swap
+		{"rdaw", "draw", 1}, // swap at the start
+		{"drwa", "draw", 1}, // swap at the end
+		{"crpyto", "crypto", 1},
+		{"adrw", "draw", 2}, // two swaps are not one
+		{"echo", "calc", 4},
+		{"perm", "which", 5},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestIsLowerWord(t *testing.T) {
+	for s, want := range map[string]bool{"draw": true, "Draw": false, "dr4w": false, "": true, "草": false} {
+		if got := isLowerWord(s); got != want {
+			t.Errorf("isLowerWord(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
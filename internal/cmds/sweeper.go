@@ -0,0 +1,65 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+const grantSweepInterval = time.Minute
+
+// RunGrantSweeper removes expired time-limited grants every minute until ctx
+// is done, optionally telling the group the grant was made in.
+func RunGrantSweeper(ctx context.Context, b *qbot.Sender) {
+	ticker := time.NewTicker(grantSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		sweepGrants(b)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepGrants(b *qbot.Sender) {
+	expired, err := db.SweepExpiredGrants(time.Now())
+	if err != nil {
+		log.Printf("failed to sweep expired grants: %v", err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	log.Printf("removed %d expired grants", len(expired))
+
+	if !config.Cfg.Permissions.NotifyExpiredGrants {
+		return
+	}
+	for _, e := range expired {
+		if e.GroupID == 0 {
+			continue
+		}
+		cmdName := strings.TrimPrefix(e.Command, "cmd_")
+		var text string
+		switch e.Kind {
+		case db.GrantSpecialUser:
+			text = fmt.Sprintf("Special %s entry for user %d has expired", cmdName, e.TargetID)
+		case db.GrantSpecialGroup:
+			text = fmt.Sprintf("Special %s entry for this group has expired", cmdName)
+		case db.GrantRole:
+			text = fmt.Sprintf("Role %s of user %d has expired", e.Role, e.TargetID)
+		default:
+			continue
+		}
+		b.SendGroupMsg(qbot.GroupID(e.GroupID), text)
+	}
+}
@@ -0,0 +1,180 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/go-hurobot/internal/db"
+	"github.com/awfufu/qbot"
+)
+
+const usageHelpMsg string = `Show external API usage and estimated cost.
+Usage: /usage [today|month] [--by user|group|provider|command]
+Example: /usage month --by user`
+
+var usageCommand *Command = &Command{
+	Name:       "usage",
+	HelpMsg:    usageHelpMsg,
+	Permission: getCmdPermLevel("usage"),
+	NeedRawMsg: false,
+	MaxArgs:    4,
+	Exec:       execUsage,
+}
+
+type callerKey struct{}
+type unitsKey struct{}
+
+type caller struct {
+	cmd     string
+	userID  qbot.UserID
+	groupID qbot.GroupID
+}
+
+// withCaller attaches the running command to ctx so that API calls made
+// with it can be attributed.
+func withCaller(ctx context.Context, cmd string, userID qbot.UserID, groupID qbot.GroupID) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller{cmd, userID, groupID})
+}
+
+// withUsageUnits sets how many billable units, such as images, the requests
+// made with ctx produce. The default is one.
+func withUsageUnits(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, unitsKey{}, n)
+}
+
+// usageTransport records every request it sends in the api_usage table
+type usageTransport struct {
+	provider string
+	base     http.RoundTripper
+}
+
+func (t *usageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	recordUsage(req.Context(), t.provider, time.Since(start), status)
+	return resp, err
+}
+
+// apiClient returns an HTTP client for a paid or rate-limited provider that
+// records its calls. Requests should carry the context passed to Exec.
+func apiClient(provider string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &usageTransport{provider: provider, base: http.DefaultTransport},
+	}
+}
+
+// proxiedAPIClient is apiClient going through an HTTP proxy, an empty proxy
+// connects directly.
+func proxiedAPIClient(provider string, timeout time.Duration, proxy string) (*http.Client, error) {
+	if proxy == "" {
+		return apiClient(provider, timeout), nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(u)
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &usageTransport{provider: provider, base: t},
+	}, nil
+}
+
+func recordUsage(ctx context.Context, provider string, latency time.Duration, status int) {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	units, ok := ctx.Value(unitsKey{}).(int)
+	if !ok {
+		units = 1
+	}
+
+	var cost float64
+	if status >= 200 && status < 300 {
+		price := config.Cfg.Pricing[provider]
+		cost = price.PerCall + price.PerUnit*float64(units)
+	}
+
+	err := db.SaveApiUsage(&db.DbApiUsage{
+		Time:      time.Now(),
+		Command:   c.cmd,
+		UserID:    uint64(c.userID),
+		GroupID:   uint64(c.groupID),
+		Provider:  provider,
+		LatencyMs: latency.Milliseconds(),
+		Status:    status,
+		Cost:      cost,
+	})
+	if err != nil {
+		log.Printf("failed to record %s usage: %v", provider, err)
+	}
+}
+
+func execUsage(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
+	period := "today"
+	by := db.UsageByProvider
+	for i := 1; i < len(msg.Array); i++ {
+		if msg.Array[i].Type() != qbot.TextType {
+			continue
+		}
+		switch arg := msg.Array[i].Text(); arg {
+		case "today", "month":
+			period = arg
+		case "--by":
+			if i+1 >= len(msg.Array) {
+				b.SendGroupMsg(msg.GroupID, usageHelpMsg)
+				return
+			}
+			i++
+			by = msg.Array[i].Text()
+		default:
+			b.SendGroupMsg(msg.GroupID, usageHelpMsg)
+			return
+		}
+	}
+
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if period == "month" {
+		since = since.AddDate(0, 0, 1-now.Day())
+	}
+
+	rows, err := db.GetUsageReport(since, by, 15)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		b.SendGroupMsg(msg.GroupID, "No API calls since "+since.Format("2006-01-02"))
+		return
+	}
+
+	total, err := db.GetUsageTotal(since)
+	if err != nil {
+		b.SendGroupMsg(msg.GroupID, err.Error())
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "API usage since %s by %s:", since.Format("2006-01-02"), by)
+	for _, r := range rows {
+		key := r.Key
+		if key == "" {
+			key = "-"
+		}
+		fmt.Fprintf(&sb, "\n%s: %d calls, %d failed, avg %.0fms, cost %.4f", key, r.Calls, r.Errors, r.LatencyMs, r.Cost)
+	}
+	fmt.Fprintf(&sb, "\ntotal: %d calls, %d failed, cost %.4f", total.Calls, total.Errors, total.Cost)
+	b.SendGroupMsg(msg.GroupID, sb.String())
+}
@@ -2,6 +2,7 @@ package cmds
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -31,12 +32,13 @@ var whichCommand *Command = &Command{
 	HelpMsg:    whichHelpMsg,
 	Permission: getCmdPermLevel("which"),
 	NeedRawMsg: false,
+	Slow:       true,
 	MaxArgs:    2,
 	MinArgs:    2,
 	Exec:       execWhich,
 }
 
-func execWhich(b *qbot.Sender, msg *qbot.Message) {
+func execWhich(ctx context.Context, b *qbot.Sender, msg *qbot.Message) {
 	// Check for non-text type parameters
 	for i := 1; i < len(msg.Array); i++ {
 		str := ""
@@ -77,7 +79,7 @@ func execWhich(b *qbot.Sender, msg *qbot.Message) {
 		return
 	}
 
-	req, err := http.NewRequest("POST", "https://lab.magiconch.com/api/nbnhhsh/guess", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://lab.magiconch.com/api/nbnhhsh/guess", bytes.NewBuffer(jsonData))
 	if err != nil {
 		b.SendGroupMsg(msg.GroupID, err.Error())
 		return
@@ -85,9 +87,7 @@ func execWhich(b *qbot.Sender, msg *qbot.Message) {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	client := apiClient("nbnhhsh", 10*time.Second)
 
 	resp, err := client.Do(req)
 	if err != nil {
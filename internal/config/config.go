@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/awfufu/qbot"
 	"gopkg.in/yaml.v3"
@@ -16,6 +17,18 @@ type yamlConfig struct {
 	HttpRemote string `yaml:"http_remote"` // 正向 HTTP 地址
 	HttpListen string `yaml:"http_listen"` // 反向 HTTP 监听端口
 
+	// 退出时等待正在执行的命令的最长时间（秒）
+	ShutdownTimeout int `yaml:"shutdown_timeout,omitempty"`
+
+	// 消息处理线程池配置
+	Workers struct {
+		Fast PoolConfig `yaml:"fast"` // 普通命令
+		Slow PoolConfig `yaml:"slow"` // 调用外部服务的慢命令
+		// 队列满时接收循环等待的最长时间（毫秒），默认 0 即立即丢弃。
+		// 被丢弃的消息仍会写入数据库，慢命令会回复繁忙，普通消息不回复
+		SubmitTimeout int `yaml:"submit_timeout_ms,omitempty"`
+	} `yaml:"workers"`
+
 	// API Keys 配置
 	ApiKeys struct {
 		DrawUrlBase        string `yaml:"draw_url_base"`
@@ -26,33 +39,99 @@ type yamlConfig struct {
 
 	// SQLite 配置
 	SQLite struct {
-		Path string `yaml:"path"`
+		Path          string `yaml:"path"`
+		BatchSize     int    `yaml:"batch_size,omitempty"`        // 每批写入的最大消息数
+		FlushInterval int    `yaml:"flush_interval_ms,omitempty"` // 批量写入间隔（毫秒）
+		QueueSize     int    `yaml:"queue_size,omitempty"`        // 待写入队列长度，满时丢弃
 	} `yaml:"sqlite"`
 
 	// 权限配置
 	Permissions struct {
 		MasterID qbot.UserID `yaml:"master_id"`
 		BotID    qbot.UserID `yaml:"bot_id"`
+
+		// 将 QQ 群主/管理员自动映射为该群内的机器人角色
+		MapGroupRoles  bool   `yaml:"map_group_roles"`
+		GroupOwnerRole string `yaml:"group_owner_role,omitempty"` // 默认 admin，设为 guest 即不映射
+		GroupAdminRole string `yaml:"group_admin_role,omitempty"` // 默认 admin，设为 guest 即不映射
+
+		// 限时授权到期时在授权所在的群里发送通知
+		NotifyExpiredGrants bool `yaml:"notify_expired_grants"`
 	} `yaml:"permissions"`
 
+	// 绘图配置
+	Draw struct {
+		Provider     string `yaml:"provider,omitempty"`       // 默认图像生成后端，suppliers 中的名称
+		HistoryMaxMB int    `yaml:"history_max_mb,omitempty"` // 保存的历史图片总大小上限 (MB)，超出时删除最早的图片，默认 512
+	} `yaml:"draw"`
+
+	// 加密货币行情配置
+	Crypto struct {
+		// 按顺序尝试的行情来源: okx_mirror, okx, binance, coingecko
+		// 留空时为 okx_mirror (配置了 okx_mirror_api_key 时), okx, binance, coingecko
+		Sources      []string `yaml:"sources,omitempty"`
+		CacheTTL     int      `yaml:"cache_ttl,omitempty"`     // 行情缓存时间（秒），默认 10
+		Proxy        string   `yaml:"proxy,omitempty"`         // 访问 okx/binance/coingecko 使用的代理
+		CoinGeckoKey string   `yaml:"coingecko_key,omitempty"` // CoinGecko demo API key，可选
+
+		// 价格提醒
+		AlertInterval   int     `yaml:"alert_interval,omitempty"`   // 检查间隔（秒），默认 60
+		AlertHysteresis float64 `yaml:"alert_hysteresis,omitempty"` // 触发后价格需回撤的百分比才会再次触发，默认 0.5
+		AlertLimit      int     `yaml:"alert_limit,omitempty"`      // 每人每群最多提醒数，默认 10
+	} `yaml:"crypto"`
+
+	// 提示词审核，关键词/正则黑名单按群存储在数据库中
+	Moderation struct {
+		Supplier   string `yaml:"supplier,omitempty"`    // 使用该 supplier 的 /moderations 接口分类，留空则只用黑名单
+		Model      string `yaml:"model,omitempty"`       // 审核模型，留空使用接口默认值
+		FailClosed bool   `yaml:"fail_closed,omitempty"` // 审核接口出错时拒绝提示词，默认放行
+	} `yaml:"moderation"`
+
+	// 命令配额配置
+	Quota struct {
+		ResetTime string `yaml:"reset_time,omitempty"` // 每日配额重置的本地时间 (HH:MM)，默认 00:00
+	} `yaml:"quota"`
+
+	// 外部 API 计费，键为 provider 名称:
+	// siliconflow, exchangerate, frankfurter, okx_mirror, okx, binance, coingecko, nbnhhsh
+	Pricing map[string]PriceConfig `yaml:"pricing,omitempty"`
+
 	// 其他配置
 	ProxyURL  string                    `yaml:"proxy_url,omitempty"`
 	Suppliers map[string]SupplierConfig `yaml:"suppliers,omitempty"`
 }
 
+type PoolConfig struct {
+	Workers   int `yaml:"workers"`    // 并发数
+	QueueSize int `yaml:"queue_size"` // 每个 worker 的队列长度
+}
+
+type PriceConfig struct {
+	PerCall float64 `yaml:"per_call"` // 每次成功调用的费用
+	PerUnit float64 `yaml:"per_unit"` // 每单位（如每张图片）的额外费用
+}
+
 type SupplierConfig struct {
 	BaseURL      string `yaml:"base_url"`
 	APIKey       string `yaml:"api_key"`
 	DefaultModel string `yaml:"default_model"`
 	Proxy        string `yaml:"proxy,omitempty"`
+
+	// 图像生成后端类型: siliconflow, openai, sdwebui，留空则不用于 /draw
+	Type        string   `yaml:"type,omitempty"`
+	Models      []string `yaml:"models,omitempty"`      // 可用模型，留空使用后端默认值
+	EditModels  []string `yaml:"edit_models,omitempty"` // 支持图生图的模型，第一个为默认值
+	Sizes       []string `yaml:"sizes,omitempty"`       // 支持的尺寸，第一个为默认值
+	Concurrency int      `yaml:"concurrency,omitempty"` // 同时执行的绘图任务数，默认 1
 }
 
-type Permission int
+// Permission 是命令默认要求的角色名，自定义角色保存在数据库中
+type Permission string
 
 const (
-	Guest  Permission = 0 // 所有人都可以使用
-	Admin  Permission = 3 // 管理员及以上
-	Master Permission = 4 // 仅 Master
+	Guest  Permission = "guest"  // 所有人都可以使用
+	Admin  Permission = "admin"  // 管理员及以上
+	Master Permission = "master" // 仅 Master
 )
 
 var Cfg yamlConfig
@@ -75,6 +154,27 @@ func LoadConfig(configPath string) error {
 		Cfg.HttpListen = "0.0.0.0:3001"
 	}
 
+	if Cfg.ShutdownTimeout <= 0 {
+		Cfg.ShutdownTimeout = 30
+	}
+
+	// 线程池默认值
+	if Cfg.Workers.Fast.Workers <= 0 {
+		Cfg.Workers.Fast.Workers = 8
+	}
+	if Cfg.Workers.Fast.QueueSize <= 0 {
+		Cfg.Workers.Fast.QueueSize = 64
+	}
+	if Cfg.Workers.Slow.Workers <= 0 {
+		Cfg.Workers.Slow.Workers = 2
+	}
+	if Cfg.Workers.Slow.QueueSize <= 0 {
+		Cfg.Workers.Slow.QueueSize = 16
+	}
+	if Cfg.Workers.SubmitTimeout < 0 {
+		Cfg.Workers.SubmitTimeout = 0
+	}
+
 	// 权限默认值
 	if Cfg.Permissions.MasterID == 0 {
 		Cfg.Permissions.MasterID = 1006554341
@@ -82,11 +182,59 @@ func LoadConfig(configPath string) error {
 	if Cfg.Permissions.BotID == 0 {
 		Cfg.Permissions.BotID = 3552586437
 	}
+	if Cfg.Permissions.GroupOwnerRole == "" {
+		Cfg.Permissions.GroupOwnerRole = "admin"
+	}
+	if Cfg.Permissions.GroupAdminRole == "" {
+		Cfg.Permissions.GroupAdminRole = "admin"
+	}
+
+	// 配额默认值
+	if Cfg.Quota.ResetTime == "" {
+		Cfg.Quota.ResetTime = "00:00"
+	}
+	if _, err := time.Parse("15:04", Cfg.Quota.ResetTime); err != nil {
+		return fmt.Errorf("quota.reset_time 格式错误: %w", err)
+	}
+
+	if name := Cfg.Moderation.Supplier; name != "" {
+		if _, ok := Cfg.Suppliers[name]; !ok {
+			return fmt.Errorf("moderation.supplier: 未知的 supplier %s", name)
+		}
+	}
+
+	// 绘图默认值
+	if Cfg.Draw.HistoryMaxMB <= 0 {
+		Cfg.Draw.HistoryMaxMB = 512
+	}
+
+	// 行情默认值
+	if Cfg.Crypto.CacheTTL <= 0 {
+		Cfg.Crypto.CacheTTL = 10
+	}
+	if Cfg.Crypto.AlertInterval <= 0 {
+		Cfg.Crypto.AlertInterval = 60
+	}
+	if Cfg.Crypto.AlertHysteresis <= 0 {
+		Cfg.Crypto.AlertHysteresis = 0.5
+	}
+	if Cfg.Crypto.AlertLimit <= 0 {
+		Cfg.Crypto.AlertLimit = 10
+	}
 
 	// SQLite 默认值
 	if Cfg.SQLite.Path == "" {
 		Cfg.SQLite.Path = "db/bot.db"
 	}
+	if Cfg.SQLite.BatchSize <= 0 {
+		Cfg.SQLite.BatchSize = 100
+	}
+	if Cfg.SQLite.FlushInterval <= 0 {
+		Cfg.SQLite.FlushInterval = 500
+	}
+	if Cfg.SQLite.QueueSize <= 0 {
+		Cfg.SQLite.QueueSize = 4096
+	}
 
 	return nil
 }
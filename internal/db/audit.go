@@ -0,0 +1,35 @@
+package db
+
+import (
+	"time"
+)
+
+// DbPermAudit records one change made through /perm
+type DbPermAudit struct {
+	ID       uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	Time     time.Time `gorm:"not null;column:time;index"`
+	ActorID  uint64    `gorm:"not null;column:actor_id;index"`
+	GroupID  uint64    `gorm:"not null;column:group_id"` // group the command was sent in
+	Action   string    `gorm:"not null;column:action"`   // set, special, user, role
+	Target   string    `gorm:"not null;column:target"`
+	OldValue string    `gorm:"column:old_value"`
+	NewValue string    `gorm:"column:new_value"`
+}
+
+func (DbPermAudit) TableName() string {
+	return "perm_audit"
+}
+
+func SavePermAudit(entry *DbPermAudit) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	return PsqlDB.Create(entry).Error
+}
+
+// GetPermAudit returns the last n audit entries, newest first.
+func GetPermAudit(n int) ([]DbPermAudit, error) {
+	var entries []DbPermAudit
+	err := PsqlDB.Order("id DESC").Limit(n).Find(&entries).Error
+	return entries, err
+}
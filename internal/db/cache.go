@@ -0,0 +1,48 @@
+package db
+
+import "sync"
+
+// cache is a read-through cache of database rows. A load that raced with a
+// write must not store what it read before the write, so every invalidation
+// bumps a generation and store drops values loaded under an older one.
+type cache[K comparable, V any] struct {
+	mu  sync.RWMutex
+	gen uint64
+	m   map[K]V
+}
+
+func newCache[K comparable, V any]() *cache[K, V] {
+	return &cache[K, V]{m: make(map[K]V)}
+}
+
+// load returns the cached value of key, or the generation to pass to store
+// after reading it from the database
+func (c *cache[K, V]) load(key K) (v V, gen uint64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok = c.m[key]
+	return v, c.gen, ok
+}
+
+// store caches v unless the cache was invalidated since gen
+func (c *cache[K, V]) store(key K, v V, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.m[key] = v
+	}
+}
+
+func (c *cache[K, V]) invalidate(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.m, key)
+}
+
+func (c *cache[K, V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.m)
+}
@@ -0,0 +1,40 @@
+package db
+
+import "testing"
+
+func TestCache(t *testing.T) {
+	c := newCache[string, int]()
+
+	_, gen, ok := c.load("a")
+	if ok {
+		t.Fatal("empty cache hit")
+	}
+	c.store("a", 1, gen)
+	if v, _, ok := c.load("a"); !ok || v != 1 {
+		t.Errorf("load after store = %v, %v", v, ok)
+	}
+
+	// a load that raced with a write does not store the stale row
+	_, gen, _ = c.load("b")
+	c.invalidate("b")
+	c.store("b", 2, gen)
+	if _, _, ok := c.load("b"); ok {
+		t.Error("stale value stored after invalidate")
+	}
+
+	// invalidating one key keeps the others
+	c.invalidate("x")
+	if _, _, ok := c.load("a"); !ok {
+		t.Error("invalidate dropped another key")
+	}
+
+	_, gen, _ = c.load("c")
+	c.clear()
+	c.store("c", 3, gen)
+	if _, _, ok := c.load("a"); ok {
+		t.Error("clear kept a value")
+	}
+	if _, _, ok := c.load("c"); ok {
+		t.Error("stale value stored after clear")
+	}
+}
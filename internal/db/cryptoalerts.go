@@ -0,0 +1,71 @@
+package db
+
+import "time"
+
+// DbCryptoAlerts is a price threshold a user wants to be told about
+type DbCryptoAlerts struct {
+	ID        uint64  `gorm:"primaryKey;autoIncrement;column:id"`
+	GroupID   uint64  `gorm:"not null;column:group_id;index:idx_crypto_alerts_owner"`
+	UserID    uint64  `gorm:"not null;column:user_id;index:idx_crypto_alerts_owner"`
+	Coin      string  `gorm:"not null;column:coin"`
+	Quote     string  `gorm:"not null;column:quote"`
+	Spot      bool    `gorm:"not null;column:spot"`
+	Above     bool    `gorm:"not null;column:above"` // fire above Threshold, else below
+	Threshold float64 `gorm:"not null;column:threshold"`
+	Once      bool    `gorm:"not null;column:once"` // delete after firing
+	// Armed is cleared when the alert fires and set again once the price
+	// has moved back past the threshold by the hysteresis margin
+	Armed     bool       `gorm:"not null;column:armed"`
+	CreatedAt time.Time  `gorm:"not null;column:created_at"`
+	FiredAt   *time.Time `gorm:"column:fired_at"`
+}
+
+func (DbCryptoAlerts) TableName() string {
+	return "crypto_alerts"
+}
+
+func AddCryptoAlert(alert *DbCryptoAlerts) error {
+	alert.CreatedAt = time.Now()
+	return PsqlDB.Create(alert).Error
+}
+
+// GetCryptoAlerts lists the alerts of a user in a group
+func GetCryptoAlerts(userID uint64, groupID uint64) ([]DbCryptoAlerts, error) {
+	var alerts []DbCryptoAlerts
+	err := PsqlDB.Where("user_id = ? AND group_id = ?", userID, groupID).Order("id").Find(&alerts).Error
+	return alerts, err
+}
+
+func GetAllCryptoAlerts() ([]DbCryptoAlerts, error) {
+	var alerts []DbCryptoAlerts
+	err := PsqlDB.Order("id").Find(&alerts).Error
+	return alerts, err
+}
+
+// CountCryptoAlerts returns how many alerts a user has in a group
+func CountCryptoAlerts(userID uint64, groupID uint64) (int64, error) {
+	var n int64
+	err := PsqlDB.Model(&DbCryptoAlerts{}).Where("user_id = ? AND group_id = ?", userID, groupID).Count(&n).Error
+	return n, err
+}
+
+// RemoveCryptoAlert deletes an alert of a user in a group and reports
+// whether it existed
+func RemoveCryptoAlert(userID uint64, groupID uint64, id uint64) (bool, error) {
+	res := PsqlDB.Where("user_id = ? AND group_id = ? AND id = ?", userID, groupID, id).Delete(&DbCryptoAlerts{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func DeleteCryptoAlert(id uint64) error {
+	return PsqlDB.Delete(&DbCryptoAlerts{}, id).Error
+}
+
+// SetCryptoAlertArmed re-arms an alert or, with armed false, records that
+// it fired
+func SetCryptoAlertArmed(id uint64, armed bool) error {
+	updates := map[string]any{"armed": armed}
+	if !armed {
+		updates["fired_at"] = time.Now()
+	}
+	return PsqlDB.Model(&DbCryptoAlerts{}).Where("id = ?", id).Updates(updates).Error
+}
@@ -4,12 +4,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/awfufu/go-hurobot/internal/config"
-	"github.com/awfufu/qbot"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -22,93 +19,133 @@ var PsqlConnected bool = false
 type dbUsers struct {
 	UserID uint64 `gorm:"primaryKey;column:user_id"`
 	Name   string `gorm:"not null;column:name"`
-	Perm   int    `gorm:"not null;column:perm;default:0"` // 0:guest, 1:admin, 2:master
 }
 
 func (dbUsers) TableName() string {
 	return "users"
 }
 
-func GetUserPerm(userID uint64) int {
-	var user dbUsers
-	if err := PsqlDB.Where("user_id = ?", userID).First(&user).Error; err != nil {
-		return 0 // default guest
-	}
-	return user.Perm
-}
-
-func UpdateUserPerm(userID uint64, perm int) error {
-	// Updates perm for existing user, or creates user if not exists?
-	// If user doesn't exist, we probably shouldn't create them just for perm unless we have a name.
-	// But usually this is called for existing users.
-	// Safe way: Update using Model with where clause.
-	result := PsqlDB.Model(&dbUsers{}).Where("user_id = ?", userID).Update("perm", perm)
-	return result.Error
-}
-
 type dbMessages struct {
 	MsgID   uint64    `gorm:"primaryKey;column:msg_id"`
 	UserID  uint64    `gorm:"not null;column:user_id;index"`
 	GroupID uint64    `gorm:"not null;column:group_id;index"`
 	Raw     string    `gorm:"not null;column:raw"`
 	Time    time.Time `gorm:"not null;column:time;index"`
+
+	// Recalled messages are kept and flagged instead of being deleted
+	Recalled   bool       `gorm:"not null;column:recalled;default:false;index"`
+	RecalledBy uint64     `gorm:"column:recalled_by"`
+	RecalledAt *time.Time `gorm:"column:recalled_at"`
 }
 
 func (dbMessages) TableName() string {
 	return "messages"
 }
 
-type DbPermissions struct {
-	Command           string `gorm:"primaryKey;column:command"`
-	UserAllow         int    `gorm:"not null;column:user_allow;default:2"` // 0:guest, 1:admin, 2:master
-	SpecialUsers      string `gorm:"column:special_users"`                 // CSV string
-	IsWhitelistUsers  int    `gorm:"column:is_users_whitelist;default:0"`  // 0:blacklist, 1:whitelist
-	SpecialGroups     string `gorm:"column:special_groups"`                // CSV string. Note: db col "special_group"
-	IsWhitelistGroups int    `gorm:"column:is_groups_whitelist;default:0"` // 0:blacklist, 1:whitelist
+// Event kinds stored in DbEvents.Kind. qbot v0.2.2 only delivers recall,
+// poke and emoji reaction notices, so member join/leave is not recorded and
+// admin and ban events only cover actions taken through /group.
+const (
+	EventRecall     = "recall"
+	EventAdminSet   = "admin_set"
+	EventAdminUnset = "admin_unset"
+	EventBan        = "ban"
+)
+
+type DbEvents struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	Kind       string    `gorm:"not null;column:kind;index"`
+	GroupID    uint64    `gorm:"not null;column:group_id;index"`
+	UserID     uint64    `gorm:"not null;column:user_id;index"` // the member affected
+	OperatorID uint64    `gorm:"column:operator_id"`            // who did it, 0 if unknown
+	MsgID      uint64    `gorm:"column:msg_id;index"`           // recall only
+	Duration   int       `gorm:"column:duration"`               // ban only, in seconds
+	NoticeID   uint64    `gorm:"column:notice_id;index"`        // recall notice sent by the bot
+	Time       time.Time `gorm:"not null;column:time;index"`
+}
+
+func (DbEvents) TableName() string {
+	return "events"
 }
 
-func (DbPermissions) TableName() string {
-	return "permissions"
+// DbGroupSettings holds per-group feature switches
+type DbGroupSettings struct {
+	GroupID       uint64 `gorm:"primaryKey;column:group_id"`
+	RecallEnabled bool   `gorm:"not null;column:recall_enabled;default:false"`
+	// commands without a switch in group_commands are off
+	CommandsDisabled bool `gorm:"not null;column:commands_disabled;default:false"`
+	// no "did you mean" replies to unknown commands
+	SuggestDisabled bool `gorm:"not null;column:suggest_disabled;default:false"`
 }
 
-func (p *DbPermissions) ParseSpecialUsers() []uint64 {
-	return ParseIDList(p.SpecialUsers)
+func (DbGroupSettings) TableName() string {
+	return "group_settings"
 }
 
-func (p *DbPermissions) ParseSpecialGroups() []uint64 {
-	return ParseIDList(p.SpecialGroups)
+// GetGroupSettings returns the settings of a group, or the defaults if the
+// group has none stored.
+func GetGroupSettings(groupID uint64) *DbGroupSettings {
+	settings := DbGroupSettings{GroupID: groupID}
+	PsqlDB.Where("group_id = ?", groupID).Limit(1).Find(&settings)
+	return &settings
 }
 
-func ParseIDList(s string) []uint64 {
-	if s == "" {
-		return nil
-	}
-	// Simple split by comma
-	// Assuming valid string like "123,456"
-	// To be safe against empty parts like "123,,456", we can filter
-	// But user said "only digits and commas".
-	parts := strings.Split(s, ",")
-	res := make([]uint64, 0, len(parts))
-	for _, part := range parts {
-		if part == "" {
-			continue
-		}
-		if val, err := strconv.ParseUint(part, 10, 64); err == nil {
-			res = append(res, val)
-		}
-	}
-	return res
+func SetRecallEnabled(groupID uint64, enabled bool) error {
+	return setGroupSetting(PsqlDB, groupID, "recall_enabled", enabled)
 }
 
-func JoinIDList(ids []uint64) string {
-	if len(ids) == 0 {
-		return ""
-	}
-	strs := make([]string, len(ids))
-	for i, id := range ids {
-		strs[i] = strconv.FormatUint(id, 10)
+func SetSuggestDisabled(groupID uint64, disabled bool) error {
+	return setGroupSetting(PsqlDB, groupID, "suggest_disabled", disabled)
+}
+
+// setGroupSetting writes one column of a group's settings. Writing the whole
+// row would undo a concurrent change of another setting.
+func setGroupSetting(tx *gorm.DB, groupID uint64, column string, value bool) error {
+	return tx.Model(&DbGroupSettings{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{column}),
+	}).Create(map[string]any{"group_id": groupID, column: value}).Error
+}
+
+type RecalledMessage struct {
+	MsgID      uint64
+	UserID     uint64
+	Name       string
+	Raw        string
+	Time       time.Time
+	RecalledBy uint64
+	RecalledAt time.Time
+}
+
+func recalledMessageQuery(groupID uint64) *gorm.DB {
+	return PsqlDB.Table("messages").
+		Select("messages.msg_id, messages.user_id, users.name, messages.raw, messages.time, messages.recalled_by, messages.recalled_at").
+		Joins("LEFT JOIN users ON users.user_id = messages.user_id").
+		Where("messages.group_id = ? AND messages.recalled = ?", groupID, true)
+}
+
+// GetRecalledMessages returns the last n recalled messages of a group,
+// newest first.
+func GetRecalledMessages(groupID uint64, n int) ([]RecalledMessage, error) {
+	var res []RecalledMessage
+	err := recalledMessageQuery(groupID).
+		Order("messages.recalled_at DESC").
+		Limit(n).
+		Scan(&res).Error
+	return res, err
+}
+
+// GetRecallByNotice looks up the message whose recall notice has noticeID.
+func GetRecallByNotice(groupID uint64, noticeID uint64) (*RecalledMessage, error) {
+	var res RecalledMessage
+	err := recalledMessageQuery(groupID).
+		Joins("JOIN events ON events.msg_id = messages.msg_id AND events.kind = ?", EventRecall).
+		Where("events.notice_id = ?", noticeID).
+		Take(&res).Error
+	if err != nil {
+		return nil, err
 	}
-	return strings.Join(strs, ",")
+	return &res, nil
 }
 
 func InitDB() {
@@ -119,62 +156,37 @@ func InitDB() {
 		log.Fatalf("failed to create database directory: %v", err)
 	}
 
-	if PsqlDB, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{}); err != nil {
+	// WAL lets readers run alongside the writer goroutine, busy_timeout makes
+	// SQLite wait for the lock before returning SQLITE_BUSY
+	dsn := dbPath + "?_journal_mode=WAL&_busy_timeout=5000"
+	if PsqlDB, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{}); err != nil {
 		log.Fatalln(err)
 	}
 	PsqlConnected = true
-	PsqlDB.AutoMigrate(&dbUsers{}, &dbMessages{}, &DbPermissions{})
-}
-
-func SaveDatabase(msg *qbot.Message) error {
-	return PsqlDB.Transaction(func(tx *gorm.DB) error {
-		user := dbUsers{
-			UserID: uint64(msg.UserID),
-			Name:   msg.Name,
-		}
-
-		if err := tx.Clauses(clause.OnConflict{
-			Columns: []clause.Column{{Name: "user_id"}},
-			DoUpdates: clause.Assignments(
-				map[string]any{
-					"name": gorm.Expr("EXCLUDED.name"),
-				},
-			),
-		}).Where("users.name <> EXCLUDED.name").Create(&user).Error; err != nil {
-			return err
-		}
-		newMessage := dbMessages{
-			MsgID:   uint64(msg.MsgID),
-			UserID:  uint64(msg.UserID),
-			GroupID: uint64(msg.GroupID),
-			Raw:     msg.Raw,
-			Time:    time.Unix(int64(msg.Time), 0),
-		}
-		if err := tx.Create(&newMessage).Error; err != nil {
-			return err
-		}
+	PsqlDB.AutoMigrate(&dbUsers{}, &dbMessages{}, &DbPermissions{}, &DbEvents{}, &DbGroupSettings{}, &DbRoles{}, &DbUserRoles{}, &DbPermAudit{},
+		&DbPermissionUsers{}, &DbPermissionGroups{}, &DbGroupCommands{}, &DbQuotas{}, &DbQuotaUsage{}, &DbApiUsage{}, &DbDrawJobs{},
+		&DbDrawHistory{}, &DbDrawImages{}, &DbBlockRules{}, &DbBlockedPrompts{},
+		&DbCryptoAlerts{})
+	migrateRoles()
+	migrateSpecialLists()
+	startWriter()
+}
+
+// CloseDB flushes pending message writes and closes the underlying SQLite
+// handle.
+func CloseDB() error {
+	if !PsqlConnected {
 		return nil
-	})
-}
-
-func GetCommandPermission(cmd string) *DbPermissions {
-	var perm DbPermissions
-	// Prepend cmd_ prefix if not present (internal usage might pass raw name)
-	key := cmd
-	if !strings.HasPrefix(key, "cmd_") {
-		key = "cmd_" + key
 	}
-
-	if err := PsqlDB.Where("command = ?", key).First(&perm).Error; err != nil {
-		return nil
-	}
-	return &perm
-}
-
-func SaveCommandPermission(perm *DbPermissions) error {
-	// Ensure Command field has cmd_ prefix
-	if !strings.HasPrefix(perm.Command, "cmd_") {
-		perm.Command = "cmd_" + perm.Command
+	stopWriter()
+	st := GetWriterStats()
+	log.Printf("database writer: %d written, %d dropped, %d failed, %d retried",
+		st.Written, st.Dropped, st.Failed, st.Retried)
+
+	sqlDB, err := PsqlDB.DB()
+	if err != nil {
+		return err
 	}
-	return PsqlDB.Save(perm).Error
+	PsqlConnected = false
+	return sqlDB.Close()
 }
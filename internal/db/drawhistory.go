@@ -0,0 +1,149 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DbDrawHistory is a finished /draw generation. The images are stored in
+// draw_images because provider URLs expire.
+type DbDrawHistory struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	JobID     uint64    `gorm:"not null;column:job_id"`
+	GroupID   uint64    `gorm:"not null;column:group_id;index:idx_draw_history_group"`
+	UserID    uint64    `gorm:"not null;column:user_id"`
+	MsgID     uint64    `gorm:"not null;column:msg_id"`   // the request
+	ReplyID   uint64    `gorm:"not null;column:reply_id"` // the bot message with the images
+	Provider  string    `gorm:"not null;column:provider"`
+	Model     string    `gorm:"not null;column:model"`
+	Prompt    string    `gorm:"not null;column:prompt"`
+	Params    string    `gorm:"not null;column:params"` // JSON encoded imagegen.Request without the image
+	Seed      int64     `gorm:"not null;column:seed"`   // 0 if unknown
+	Edit      bool      `gorm:"not null;column:edit"`
+	Images    int       `gorm:"not null;column:images"` // number of stored images
+	CreatedAt time.Time `gorm:"not null;column:created_at;index:idx_draw_history_group"`
+}
+
+func (DbDrawHistory) TableName() string {
+	return "draw_history"
+}
+
+type DbDrawImages struct {
+	HistoryID uint64 `gorm:"primaryKey;column:history_id"`
+	Index     int    `gorm:"primaryKey;column:idx"`
+	Data      []byte `gorm:"not null;column:data"`
+}
+
+func (DbDrawImages) TableName() string {
+	return "draw_images"
+}
+
+// SaveDrawHistory stores a generation together with its images
+func SaveDrawHistory(h *DbDrawHistory, images [][]byte) error {
+	h.CreatedAt = time.Now()
+	h.Images = len(images)
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(h).Error; err != nil {
+			return err
+		}
+		for i, data := range images {
+			if err := tx.Create(&DbDrawImages{HistoryID: h.ID, Index: i, Data: data}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func SetDrawHistoryReply(id uint64, replyID uint64) error {
+	return PsqlDB.Model(&DbDrawHistory{}).Where("id = ?", id).Update("reply_id", replyID).Error
+}
+
+// GetDrawHistory returns a generation of groupID, or nil if there is none
+func GetDrawHistory(groupID uint64, id uint64) (*DbDrawHistory, error) {
+	var h DbDrawHistory
+	err := PsqlDB.Where("group_id = ? AND id = ?", groupID, id).Limit(1).Find(&h).Error
+	if err != nil || h.ID == 0 {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetDrawHistoryByMsg finds the generation that msgID, either the bot reply
+// or the request, belongs to
+func GetDrawHistoryByMsg(groupID uint64, msgID uint64) (*DbDrawHistory, error) {
+	var h DbDrawHistory
+	err := PsqlDB.Where("group_id = ? AND (reply_id = ? OR msg_id = ?)", groupID, msgID, msgID).
+		Order("id DESC").Limit(1).Find(&h).Error
+	if err != nil || h.ID == 0 {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetRecentDrawHistory lists the latest generations in a group, only those
+// of userID unless it is 0
+func GetRecentDrawHistory(groupID uint64, userID uint64, limit int) ([]DbDrawHistory, error) {
+	var res []DbDrawHistory
+	q := PsqlDB.Where("group_id = ?", groupID)
+	if userID != 0 {
+		q = q.Where("user_id = ?", userID)
+	}
+	err := q.Order("id DESC").Limit(limit).Find(&res).Error
+	return res, err
+}
+
+// PruneDrawImages deletes the images of the oldest generations until the
+// stored images take at most maxBytes, the generations themselves are
+// kept. It returns how many generations lost their images.
+func PruneDrawImages(maxBytes int64) (int, error) {
+	var total int64
+	if err := PsqlDB.Model(&DbDrawImages{}).Select("COALESCE(SUM(LENGTH(data)), 0)").Scan(&total).Error; err != nil {
+		return 0, err
+	}
+	if total <= maxBytes {
+		return 0, nil
+	}
+
+	var sizes []struct {
+		HistoryID uint64
+		Size      int64
+	}
+	err := PsqlDB.Model(&DbDrawImages{}).Select("history_id, SUM(LENGTH(data)) AS size").
+		Group("history_id").Order("history_id").Scan(&sizes).Error
+	if err != nil {
+		return 0, err
+	}
+	var ids []uint64
+	for _, s := range sizes {
+		if total <= maxBytes {
+			break
+		}
+		ids = append(ids, s.HistoryID)
+		total -= s.Size
+	}
+
+	err = PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("history_id IN ?", ids).Delete(&DbDrawImages{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&DbDrawHistory{}).Where("id IN ?", ids).Update("images", 0).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func GetDrawImages(historyID uint64) ([][]byte, error) {
+	var rows []DbDrawImages
+	if err := PsqlDB.Where("history_id = ?", historyID).Order("idx").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	images := make([][]byte, len(rows))
+	for i, row := range rows {
+		images[i] = row.Data
+	}
+	return images, nil
+}
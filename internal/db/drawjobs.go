@@ -0,0 +1,144 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Draw job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// DbDrawJobs is a /draw request waiting for or going through an image
+// provider. Jobs are kept after they finish.
+type DbDrawJobs struct {
+	ID          uint64     `gorm:"primaryKey;autoIncrement;column:id"`
+	GroupID     uint64     `gorm:"not null;column:group_id;index:idx_draw_jobs_owner"`
+	UserID      uint64     `gorm:"not null;column:user_id;index:idx_draw_jobs_owner"`
+	MsgID       uint64     `gorm:"not null;column:msg_id"` // the request, results quote it
+	Provider    string     `gorm:"not null;column:provider;index:idx_draw_jobs_queue"`
+	Status      string     `gorm:"not null;column:status;index:idx_draw_jobs_queue"`
+	Edit        bool       `gorm:"not null;column:edit"`
+	Params      string     `gorm:"not null;column:params"` // JSON encoded imagegen.Request without the image
+	Source      []byte     `gorm:"column:source"`          // --edit source image
+	Error       string     `gorm:"column:error"`
+	QuotaPeriod string     `gorm:"column:quota_period"` // quota period the job was counted in, empty if it was not
+	CreatedAt   time.Time  `gorm:"not null;column:created_at"`
+	StartedAt   *time.Time `gorm:"column:started_at"`
+	FinishedAt  *time.Time `gorm:"column:finished_at"`
+}
+
+func (DbDrawJobs) TableName() string {
+	return "draw_jobs"
+}
+
+func CreateDrawJob(job *DbDrawJobs) error {
+	job.Status = JobQueued
+	job.CreatedAt = time.Now()
+	return PsqlDB.Create(job).Error
+}
+
+// ClaimDrawJob marks the oldest queued job of provider as running and
+// returns it, or nil if there is none. The job is picked and claimed in one
+// statement so that concurrent workers and cancels cannot both take it.
+func ClaimDrawJob(provider string) (*DbDrawJobs, error) {
+	next := PsqlDB.Model(&DbDrawJobs{}).Select("id").
+		Where("provider = ? AND status = ?", provider, JobQueued).Order("id").Limit(1)
+	return updateQueuedDrawJob(next, map[string]any{"status": JobRunning, "started_at": time.Now()})
+}
+
+// updateQueuedDrawJob applies updates to the job selected by the id
+// subquery if it is still queued, and returns the updated job or nil
+func updateQueuedDrawJob(subquery *gorm.DB, updates map[string]any) (*DbDrawJobs, error) {
+	var jobs []DbDrawJobs
+	res := PsqlDB.Model(&jobs).Clauses(clause.Returning{}).
+		Where("id = (?) AND status = ?", subquery, JobQueued).
+		Updates(updates)
+	if res.Error != nil || res.RowsAffected == 0 || len(jobs) == 0 {
+		return nil, res.Error
+	}
+	return &jobs[0], nil
+}
+
+// FinishDrawJob records the outcome of a running job. The source image is
+// dropped.
+func FinishDrawJob(id uint64, status string, errMsg string) error {
+	return PsqlDB.Model(&DbDrawJobs{}).Where("id = ?", id).Updates(map[string]any{
+		"status":      status,
+		"error":       errMsg,
+		"finished_at": time.Now(),
+		"source":      nil,
+	}).Error
+}
+
+// RequeueDrawJob puts an interrupted job back at its place in the queue
+func RequeueDrawJob(id uint64) error {
+	return PsqlDB.Model(&DbDrawJobs{}).Where("id = ?", id).
+		Updates(map[string]any{"status": JobQueued, "started_at": nil}).Error
+}
+
+// RequeueRunningDrawJobs requeues the jobs a previous run left running
+func RequeueRunningDrawJobs() (int64, error) {
+	res := PsqlDB.Model(&DbDrawJobs{}).Where("status = ?", JobRunning).
+		Updates(map[string]any{"status": JobQueued, "started_at": nil})
+	return res.RowsAffected, res.Error
+}
+
+// FailOrphanDrawJobs fails the queued jobs of providers not in providers
+func FailOrphanDrawJobs(providers []string) ([]DbDrawJobs, error) {
+	var jobs []DbDrawJobs
+	q := PsqlDB.Where("status = ?", JobQueued)
+	if len(providers) > 0 {
+		q = q.Where("provider NOT IN ?", providers)
+	}
+	if err := q.Omit("source").Find(&jobs).Error; err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if err := FinishDrawJob(job.ID, JobFailed, "provider "+job.Provider+" is no longer configured"); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// CancelDrawJob cancels a queued job of the user in groupID, the newest one
+// if id is 0. It returns nil if there was nothing to cancel.
+func CancelDrawJob(userID uint64, groupID uint64, id uint64) (*DbDrawJobs, error) {
+	q := PsqlDB.Model(&DbDrawJobs{}).Select("id").
+		Where("user_id = ? AND group_id = ? AND status = ?", userID, groupID, JobQueued)
+	if id != 0 {
+		q = q.Where("id = ?", id)
+	}
+	return updateQueuedDrawJob(q.Order("id DESC").Limit(1), map[string]any{
+		"status":      JobCancelled,
+		"finished_at": time.Now(),
+		"source":      nil,
+	})
+}
+
+// GetPendingDrawJobs lists the queued and running jobs of a user in a group
+func GetPendingDrawJobs(userID uint64, groupID uint64) ([]DbDrawJobs, error) {
+	var jobs []DbDrawJobs
+	err := PsqlDB.Omit("source").
+		Where("user_id = ? AND group_id = ? AND status IN ?", userID, groupID, []string{JobQueued, JobRunning}).
+		Order("id").Find(&jobs).Error
+	return jobs, err
+}
+
+// DrawQueuePosition returns the place of a queued job in the queue of its
+// provider, starting at 1.
+func DrawQueuePosition(job *DbDrawJobs) int64 {
+	var n int64
+	PsqlDB.Model(&DbDrawJobs{}).
+		Where("provider = ? AND status = ? AND id <= ?", job.Provider, JobQueued, job.ID).
+		Count(&n)
+	return n
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+)
+
+// openTestDB opens a fresh database in a temporary directory
+func openTestDB(t *testing.T) {
+	t.Helper()
+	config.Cfg.SQLite.Path = filepath.Join(t.TempDir(), "bot.db")
+	config.Cfg.SQLite.BatchSize = 100
+	config.Cfg.SQLite.FlushInterval = 10
+	config.Cfg.SQLite.QueueSize = 64
+	InitDB()
+	t.Cleanup(func() {
+		if err := CloseDB(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func createTestJobs(t *testing.T, provider string, userID uint64, n int) []uint64 {
+	t.Helper()
+	ids := make([]uint64, n)
+	for i := range ids {
+		job := &DbDrawJobs{GroupID: 1, UserID: userID, Provider: provider, Params: "{}"}
+		if err := CreateDrawJob(job); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = job.ID
+	}
+	return ids
+}
+
+func TestClaimDrawJob(t *testing.T) {
+	openTestDB(t)
+	a := createTestJobs(t, "a", 10, 2)
+	b := createTestJobs(t, "b", 10, 1)
+
+	for _, want := range a {
+		job, err := ClaimDrawJob("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil || job.ID != want || job.Status != JobRunning || job.StartedAt == nil {
+			t.Fatalf("claimed %+v, want running job %d", job, want)
+		}
+	}
+	if job, err := ClaimDrawJob("a"); job != nil || err != nil {
+		t.Errorf("claim from an empty queue = %+v, %v", job, err)
+	}
+
+	// a requeued job is claimed again before newer ones
+	if err := RequeueDrawJob(a[0]); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := ClaimDrawJob("a"); job == nil || job.ID != a[0] {
+		t.Errorf("requeued job not claimed, got %+v", job)
+	}
+	if job, _ := ClaimDrawJob("b"); job == nil || job.ID != b[0] {
+		t.Errorf("claim from b = %+v", job)
+	}
+}
+
+func TestClaimDrawJobConcurrent(t *testing.T) {
+	openTestDB(t)
+	const jobs, workers = 60, 8
+	createTestJobs(t, "p", 10, jobs)
+
+	var mu sync.Mutex
+	claimed := make(map[uint64]int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for {
+				job, err := ClaimDrawJob("p")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(claimed) != jobs {
+		t.Errorf("%d jobs claimed, want %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %d claimed %d times", id, n)
+		}
+	}
+}
+
+func TestCancelDrawJob(t *testing.T) {
+	openTestDB(t)
+	ids := createTestJobs(t, "p", 10, 3)
+	other := createTestJobs(t, "p", 20, 1)
+
+	// the newest job by default
+	job, err := CancelDrawJob(10, 1, 0)
+	if err != nil || job == nil || job.ID != ids[2] || job.Status != JobCancelled {
+		t.Fatalf("cancel newest = %+v, %v", job, err)
+	}
+	if job, _ := CancelDrawJob(10, 1, ids[0]); job == nil || job.ID != ids[0] {
+		t.Errorf("cancel by id = %+v", job)
+	}
+	if job, _ := CancelDrawJob(10, 1, other[0]); job != nil {
+		t.Errorf("cancelled a job of another user: %+v", job)
+	}
+	if job, _ := CancelDrawJob(10, 2, 0); job != nil {
+		t.Errorf("cancelled a job from another group: %+v", job)
+	}
+
+	// a running job cannot be cancelled
+	if job, _ := ClaimDrawJob("p"); job == nil || job.ID != ids[1] {
+		t.Fatalf("claim = %+v", job)
+	}
+	if job, _ := CancelDrawJob(10, 1, ids[1]); job != nil {
+		t.Errorf("cancelled a running job: %+v", job)
+	}
+}
+
+func TestClaimCancelRace(t *testing.T) {
+	openTestDB(t)
+	const jobs = 40
+	ids := createTestJobs(t, "p", 10, jobs)
+
+	var mu sync.Mutex
+	won := make(map[uint64]string)
+	record := func(id uint64, by string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if prev, ok := won[id]; ok {
+			t.Errorf("job %d taken by both %s and %s", id, prev, by)
+		}
+		won[id] = by
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for {
+				job, err := ClaimDrawJob("p")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				record(job.ID, "claim")
+			}
+		})
+	}
+	wg.Go(func() {
+		for _, id := range ids {
+			job, err := CancelDrawJob(10, 1, id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if job != nil {
+				record(job.ID, "cancel")
+			}
+		}
+	})
+	wg.Wait()
+
+	if len(won) != jobs {
+		t.Errorf("%d jobs taken, want %d", len(won), jobs)
+	}
+	var n int64
+	PsqlDB.Model(&DbDrawJobs{}).Where("status = ?", JobQueued).Count(&n)
+	if n != 0 {
+		t.Errorf("%d jobs still queued", n)
+	}
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of ExpiredGrant
+const (
+	GrantSpecialUser  = "special_user"
+	GrantSpecialGroup = "special_group"
+	GrantRole         = "role"
+)
+
+// ExpiredGrant describes a time-limited grant removed by SweepExpiredGrants
+type ExpiredGrant struct {
+	Kind     string
+	Command  string // special lists only
+	Role     string // roles only
+	TargetID uint64 // user or group
+	GroupID  uint64 // group to notify, 0 if unknown
+}
+
+// SweepExpiredGrants deletes every special list entry and role assignment
+// that expired before now and returns what was removed.
+func SweepExpiredGrants(now time.Time) ([]ExpiredGrant, error) {
+	// expiry times are stored in UTC so that they compare as strings
+	now = now.UTC()
+	var expired []ExpiredGrant
+	err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+		var users []DbPermissionUsers
+		if err := tx.Where("expires_at <= ?", now).Find(&users).Error; err != nil {
+			return err
+		}
+		for _, u := range users {
+			expired = append(expired, ExpiredGrant{Kind: GrantSpecialUser, Command: u.Command, TargetID: u.UserID, GroupID: u.GrantedIn})
+		}
+
+		var groups []DbPermissionGroups
+		if err := tx.Where("expires_at <= ?", now).Find(&groups).Error; err != nil {
+			return err
+		}
+		for _, g := range groups {
+			expired = append(expired, ExpiredGrant{Kind: GrantSpecialGroup, Command: g.Command, TargetID: g.GroupID, GroupID: g.GroupID})
+		}
+
+		var roles []DbUserRoles
+		if err := tx.Where("expires_at <= ?", now).Find(&roles).Error; err != nil {
+			return err
+		}
+		for _, r := range roles {
+			notify := r.GroupID
+			if notify == GlobalGroup {
+				notify = r.GrantedIn
+			}
+			expired = append(expired, ExpiredGrant{Kind: GrantRole, Role: r.Role, TargetID: r.UserID, GroupID: notify})
+		}
+
+		for _, model := range []any{&DbPermissionUsers{}, &DbPermissionGroups{}, &DbUserRoles{}} {
+			if err := tx.Where("expires_at <= ?", now).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range expired {
+		if e.Command != "" {
+			invalidatePermission(e.Command)
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DbGroupCommands is a per-group on/off switch for a command, commands
+// without a row follow DbGroupSettings.CommandsDisabled
+type DbGroupCommands struct {
+	GroupID uint64 `gorm:"primaryKey;column:group_id"`
+	Command string `gorm:"primaryKey;column:command"`
+	Enabled bool   `gorm:"not null;column:enabled"`
+}
+
+func (DbGroupCommands) TableName() string {
+	return "group_commands"
+}
+
+// GroupCommandPolicy is the effective command switch set of a group
+type GroupCommandPolicy struct {
+	DefaultEnabled bool
+	Overrides      map[string]bool
+}
+
+// Enabled reports whether cmd is switched on in the group
+func (p *GroupCommandPolicy) Enabled(cmd string) bool {
+	if on, ok := p.Overrides[cmd]; ok {
+		return on
+	}
+	return p.DefaultEnabled
+}
+
+var groupCmdCache = newCache[uint64, *GroupCommandPolicy]()
+
+func invalidateGroupCommands(groupID uint64) {
+	groupCmdCache.invalidate(groupID)
+}
+
+// GetGroupCommandPolicy returns the command switches of a group. The result
+// is cached and must not be modified.
+func GetGroupCommandPolicy(groupID uint64) *GroupCommandPolicy {
+	p, gen, ok := groupCmdCache.load(groupID)
+	if ok {
+		return p
+	}
+
+	p = &GroupCommandPolicy{
+		DefaultEnabled: !GetGroupSettings(groupID).CommandsDisabled,
+		Overrides:      make(map[string]bool),
+	}
+	var rows []DbGroupCommands
+	PsqlDB.Where("group_id = ?", groupID).Find(&rows)
+	for _, row := range rows {
+		p.Overrides[row.Command] = row.Enabled
+	}
+
+	groupCmdCache.store(groupID, p, gen)
+	return p
+}
+
+// SetGroupCommands switches the given commands on or off in a group
+func SetGroupCommands(groupID uint64, cmds []string, enabled bool) error {
+	defer invalidateGroupCommands(groupID)
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		for _, cmd := range cmds {
+			row := DbGroupCommands{GroupID: groupID, Command: cmd, Enabled: enabled}
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetGroupOnlyCommands disables every command of a group except cmds,
+// including commands added later
+func SetGroupOnlyCommands(groupID uint64, cmds []string) error {
+	defer invalidateGroupCommands(groupID)
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", groupID).Delete(&DbGroupCommands{}).Error; err != nil {
+			return err
+		}
+		if err := setCommandsDisabled(tx, groupID, true); err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if err := tx.Create(&DbGroupCommands{GroupID: groupID, Command: cmd, Enabled: true}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetGroupCommandDefault sets whether commands without a switch, such as
+// newly added ones, are enabled in a group
+func SetGroupCommandDefault(groupID uint64, enabled bool) error {
+	defer invalidateGroupCommands(groupID)
+	return setCommandsDisabled(PsqlDB, groupID, !enabled)
+}
+
+// ResetGroupCommands removes the switches of cmds, or of every command if
+// cmds is empty, so that they follow the group default again
+func ResetGroupCommands(groupID uint64, cmds []string) error {
+	defer invalidateGroupCommands(groupID)
+	q := PsqlDB.Where("group_id = ?", groupID)
+	if len(cmds) > 0 {
+		q = q.Where("command IN ?", cmds)
+	}
+	return q.Delete(&DbGroupCommands{}).Error
+}
+
+func setCommandsDisabled(tx *gorm.DB, groupID uint64, disabled bool) error {
+	return setGroupSetting(tx, groupID, "commands_disabled", disabled)
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"time"
+)
+
+// Block rule kinds
+const (
+	BlockKeyword = "keyword"
+	BlockRegex   = "regex"
+)
+
+// DbBlockRules is a prompt blocklist entry of a group
+type DbBlockRules struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	GroupID   uint64    `gorm:"not null;column:group_id;index"`
+	Kind      string    `gorm:"not null;column:kind"`
+	Pattern   string    `gorm:"not null;column:pattern"`
+	CreatedBy uint64    `gorm:"not null;column:created_by"`
+	CreatedAt time.Time `gorm:"not null;column:created_at"`
+}
+
+func (DbBlockRules) TableName() string {
+	return "block_rules"
+}
+
+// DbBlockedPrompts logs the prompts that were refused
+type DbBlockedPrompts struct {
+	ID      uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	Time    time.Time `gorm:"not null;column:time"`
+	GroupID uint64    `gorm:"not null;column:group_id;index"`
+	UserID  uint64    `gorm:"not null;column:user_id"`
+	Command string    `gorm:"not null;column:command"`
+	Prompt  string    `gorm:"not null;column:prompt"`
+	Reason  string    `gorm:"not null;column:reason"`
+}
+
+func (DbBlockedPrompts) TableName() string {
+	return "blocked_prompts"
+}
+
+var blockRuleCache = newCache[uint64, []DbBlockRules]()
+
+func GetBlockRules(groupID uint64) ([]DbBlockRules, error) {
+	rules, gen, ok := blockRuleCache.load(groupID)
+	if ok {
+		return rules, nil
+	}
+	if err := PsqlDB.Where("group_id = ?", groupID).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	blockRuleCache.store(groupID, rules, gen)
+	return rules, nil
+}
+
+func AddBlockRule(rule *DbBlockRules) error {
+	rule.CreatedAt = time.Now()
+	if err := PsqlDB.Create(rule).Error; err != nil {
+		return err
+	}
+	blockRuleCache.invalidate(rule.GroupID)
+	return nil
+}
+
+// RemoveBlockRule deletes a rule of groupID and reports whether it existed
+func RemoveBlockRule(groupID uint64, id uint64) (bool, error) {
+	res := PsqlDB.Where("group_id = ? AND id = ?", groupID, id).Delete(&DbBlockRules{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	blockRuleCache.invalidate(groupID)
+	return res.RowsAffected > 0, nil
+}
+
+func LogBlockedPrompt(entry *DbBlockedPrompts) error {
+	entry.Time = time.Now()
+	return PsqlDB.Create(entry).Error
+}
+
+// GetBlockedPrompts returns the latest refused prompts of a group
+func GetBlockedPrompts(groupID uint64, limit int) ([]DbBlockedPrompts, error) {
+	var res []DbBlockedPrompts
+	err := PsqlDB.Where("group_id = ?", groupID).Order("id DESC").Limit(limit).Find(&res).Error
+	return res, err
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DbPermissions struct {
+	Command           string `gorm:"primaryKey;column:command"`
+	RequiredRole      string `gorm:"not null;column:required_role;default:master"`
+	IsWhitelistUsers  int    `gorm:"column:is_users_whitelist;default:0"`  // 0:blacklist, 1:whitelist
+	IsWhitelistGroups int    `gorm:"column:is_groups_whitelist;default:0"` // 0:blacklist, 1:whitelist
+
+	// Loaded from permission_users and permission_groups
+	SpecialUsers  []uint64 `gorm:"-"`
+	SpecialGroups []uint64 `gorm:"-"`
+}
+
+func (DbPermissions) TableName() string {
+	return "permissions"
+}
+
+type DbPermissionUsers struct {
+	Command   string     `gorm:"primaryKey;column:command"`
+	UserID    uint64     `gorm:"primaryKey;column:user_id"`
+	ExpiresAt *time.Time `gorm:"column:expires_at;index"` // nil never expires
+	GrantedIn uint64     `gorm:"column:granted_in"`       // group the grant was made in
+}
+
+func (DbPermissionUsers) TableName() string {
+	return "permission_users"
+}
+
+type DbPermissionGroups struct {
+	Command   string     `gorm:"primaryKey;column:command"`
+	GroupID   uint64     `gorm:"primaryKey;column:group_id"`
+	ExpiresAt *time.Time `gorm:"column:expires_at;index"` // nil never expires
+}
+
+func (DbPermissionGroups) TableName() string {
+	return "permission_groups"
+}
+
+// Special list target types
+const (
+	TargetUser  = "user"
+	TargetGroup = "group"
+)
+
+// permCache holds permission rows by command key. A nil perm means the
+// command has no row. Every write goes through this file and invalidates the
+// entry, entries also go stale when their first special list item expires.
+type cachedPermission struct {
+	perm  *DbPermissions
+	until time.Time // zero if nothing expires
+}
+
+var permCache = newCache[string, cachedPermission]()
+
+func invalidatePermission(key string) {
+	permCache.invalidate(key)
+}
+
+// permKey prepends the cmd_ prefix if not present (internal usage might pass
+// the raw name)
+func permKey(cmd string) string {
+	if !strings.HasPrefix(cmd, "cmd_") {
+		return "cmd_" + cmd
+	}
+	return cmd
+}
+
+func ParseIDList(s string) []uint64 {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	res := make([]uint64, 0, len(parts))
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if val, err := strconv.ParseUint(part, 10, 64); err == nil {
+			res = append(res, val)
+		}
+	}
+	return res
+}
+
+func JoinIDList(ids []uint64) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatUint(id, 10)
+	}
+	return strings.Join(strs, ",")
+}
+
+// migrateSpecialLists moves the old CSV columns special_users and
+// special_groups into their own tables.
+func migrateSpecialLists() {
+	m := PsqlDB.Migrator()
+	if !m.HasColumn(&DbPermissions{}, "special_users") {
+		return
+	}
+
+	var rows []struct {
+		Command       string
+		SpecialUsers  string
+		SpecialGroups string
+	}
+	err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("permissions").Select("command, special_users, special_groups").Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			for _, id := range ParseIDList(row.SpecialUsers) {
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+					Create(&DbPermissionUsers{Command: row.Command, UserID: id}).Error; err != nil {
+					return err
+				}
+			}
+			for _, id := range ParseIDList(row.SpecialGroups) {
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+					Create(&DbPermissionGroups{Command: row.Command, GroupID: id}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Exec("ALTER TABLE permissions DROP COLUMN special_users").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE permissions DROP COLUMN special_groups").Error
+	})
+	if err != nil {
+		log.Printf("failed to migrate permission special lists: %v", err)
+		return
+	}
+	log.Printf("migrated special lists of %d commands", len(rows))
+}
+
+// GetCommandPermission returns a copy of the cached permission row of cmd,
+// or nil if it has none.
+func GetCommandPermission(cmd string) *DbPermissions {
+	key := permKey(cmd)
+
+	cached, gen, ok := permCache.load(key)
+	if !ok || (!cached.until.IsZero() && time.Now().After(cached.until)) {
+		cached = loadCommandPermission(key)
+		permCache.store(key, cached, gen)
+	}
+
+	perm := cached.perm
+	if perm == nil {
+		return nil
+	}
+	res := *perm
+	res.SpecialUsers = slices.Clone(perm.SpecialUsers)
+	res.SpecialGroups = slices.Clone(perm.SpecialGroups)
+	return &res
+}
+
+func loadCommandPermission(key string) cachedPermission {
+	var perm DbPermissions
+	if err := PsqlDB.Where("command = ?", key).Limit(1).Find(&perm).Error; err != nil || perm.Command == "" {
+		return cachedPermission{}
+	}
+
+	now := time.Now().UTC()
+	res := cachedPermission{perm: &perm}
+	track := func(expires *time.Time) {
+		if expires != nil && (res.until.IsZero() || expires.Before(res.until)) {
+			res.until = *expires
+		}
+	}
+
+	var users []DbPermissionUsers
+	PsqlDB.Where("command = ? AND (expires_at IS NULL OR expires_at > ?)", key, now).Order("user_id").Find(&users)
+	for _, u := range users {
+		perm.SpecialUsers = append(perm.SpecialUsers, u.UserID)
+		track(u.ExpiresAt)
+	}
+	var groups []DbPermissionGroups
+	PsqlDB.Where("command = ? AND (expires_at IS NULL OR expires_at > ?)", key, now).Order("group_id").Find(&groups)
+	for _, g := range groups {
+		perm.SpecialGroups = append(perm.SpecialGroups, g.GroupID)
+		track(g.ExpiresAt)
+	}
+	return res
+}
+
+// SpecialTarget is one item of a special list
+type SpecialTarget struct {
+	ID        uint64
+	ExpiresAt *time.Time
+}
+
+// GetSpecialTargets lists the unexpired items of a special list with their
+// expiry, bypassing the cache.
+func GetSpecialTargets(cmd string, targetType string) ([]SpecialTarget, error) {
+	key := permKey(cmd)
+	now := time.Now().UTC()
+	var res []SpecialTarget
+	var err error
+	switch targetType {
+	case TargetUser:
+		err = PsqlDB.Model(&DbPermissionUsers{}).Select("user_id AS id, expires_at").
+			Where("command = ? AND (expires_at IS NULL OR expires_at > ?)", key, now).
+			Order("user_id").Scan(&res).Error
+	case TargetGroup:
+		err = PsqlDB.Model(&DbPermissionGroups{}).Select("group_id AS id, expires_at").
+			Where("command = ? AND (expires_at IS NULL OR expires_at > ?)", key, now).
+			Order("group_id").Scan(&res).Error
+	default:
+		err = fmt.Errorf("invalid target type: %s", targetType)
+	}
+	return res, err
+}
+
+// SaveCommandPermission saves the scalar fields of perm. Special lists are
+// changed through AddSpecialTargets and RemoveSpecialTargets.
+func SaveCommandPermission(perm *DbPermissions) error {
+	perm.Command = permKey(perm.Command)
+	defer invalidatePermission(perm.Command)
+	return PsqlDB.Save(perm).Error
+}
+
+// AddSpecialTargets adds ids to the user or group special list of cmd in one
+// transaction and returns how many rows were added or had their expiry
+// replaced. expires may be nil for a permanent entry. The command row is
+// created with defaults if missing.
+func AddSpecialTargets(cmd string, targetType string, ids []uint64, expires *time.Time, grantedIn uint64) (int64, error) {
+	if expires != nil {
+		utc := expires.UTC()
+		expires = &utc
+	}
+	key := permKey(cmd)
+	defer invalidatePermission(key)
+
+	var added int64
+	err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&DbPermissions{Command: key, RequiredRole: RoleMaster}).Error; err != nil {
+			return err
+		}
+
+		var res *gorm.DB
+		switch targetType {
+		case TargetUser:
+			rows := make([]DbPermissionUsers, len(ids))
+			for i, id := range ids {
+				rows[i] = DbPermissionUsers{Command: key, UserID: id, ExpiresAt: expires, GrantedIn: grantedIn}
+			}
+			res = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "command"}, {Name: "user_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"expires_at", "granted_in"}),
+			}).Create(&rows)
+		case TargetGroup:
+			rows := make([]DbPermissionGroups, len(ids))
+			for i, id := range ids {
+				rows[i] = DbPermissionGroups{Command: key, GroupID: id, ExpiresAt: expires}
+			}
+			res = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "command"}, {Name: "group_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+			}).Create(&rows)
+		default:
+			return fmt.Errorf("invalid target type: %s", targetType)
+		}
+		added = res.RowsAffected
+		return res.Error
+	})
+	return added, err
+}
+
+// RemoveSpecialTargets removes ids from the user or group special list of
+// cmd and returns how many were removed.
+func RemoveSpecialTargets(cmd string, targetType string, ids []uint64) (int64, error) {
+	key := permKey(cmd)
+	defer invalidatePermission(key)
+
+	var res *gorm.DB
+	switch targetType {
+	case TargetUser:
+		res = PsqlDB.Where("command = ? AND user_id IN ?", key, ids).Delete(&DbPermissionUsers{})
+	case TargetGroup:
+		res = PsqlDB.Where("command = ? AND group_id IN ?", key, ids).Delete(&DbPermissionGroups{})
+	default:
+		return 0, fmt.Errorf("invalid target type: %s", targetType)
+	}
+	return res.RowsAffected, res.Error
+}
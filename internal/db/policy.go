@@ -0,0 +1,402 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Policy is the permission state as a YAML document. Every section that is
+// present replaces the stored state of that section when applied, sections
+// left out are not touched.
+type Policy struct {
+	Roles     []PolicyRole             `yaml:"roles,omitempty"`
+	Commands  map[string]PolicyCommand `yaml:"commands,omitempty"`
+	UserRoles []PolicyUserRole         `yaml:"user_roles,omitempty"`
+	Groups    map[uint64]PolicyGroup   `yaml:"groups,omitempty"`
+}
+
+type PolicyRole struct {
+	Name     string `yaml:"name"`
+	Rank     int    `yaml:"rank"`
+	Inherits string `yaml:"inherits,omitempty"`
+}
+
+type PolicyCommand struct {
+	RequiredRole    string        `yaml:"required_role"`
+	WhitelistUsers  bool          `yaml:"whitelist_users,omitempty"`
+	WhitelistGroups bool          `yaml:"whitelist_groups,omitempty"`
+	Users           []PolicyEntry `yaml:"users,omitempty"`
+	Groups          []PolicyEntry `yaml:"groups,omitempty"`
+}
+
+// PolicyEntry is one special list item
+type PolicyEntry struct {
+	ID      uint64     `yaml:"id"`
+	Expires *time.Time `yaml:"expires,omitempty"`
+}
+
+type PolicyUserRole struct {
+	User    uint64     `yaml:"user"`
+	Group   uint64     `yaml:"group,omitempty"` // GlobalGroup if omitted
+	Role    string     `yaml:"role"`
+	Expires *time.Time `yaml:"expires,omitempty"`
+}
+
+// PolicyGroup holds the command switches of a group
+type PolicyGroup struct {
+	DisableByDefault bool            `yaml:"disable_by_default,omitempty"`
+	Commands         map[string]bool `yaml:"commands,omitempty"`
+}
+
+// ExportPolicy reads the whole permission state. Expired grants are left
+// out.
+func ExportPolicy() (*Policy, error) {
+	now := time.Now().UTC()
+	p := &Policy{
+		Commands: make(map[string]PolicyCommand),
+		Groups:   make(map[uint64]PolicyGroup),
+	}
+
+	roles, err := GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		p.Roles = append(p.Roles, PolicyRole{Name: r.Name, Rank: r.Rank, Inherits: r.Inherits})
+	}
+
+	var perms []DbPermissions
+	if err := PsqlDB.Order("command").Find(&perms).Error; err != nil {
+		return nil, err
+	}
+	for _, perm := range perms {
+		p.Commands[strings.TrimPrefix(perm.Command, "cmd_")] = PolicyCommand{
+			RequiredRole:    perm.RequiredRole,
+			WhitelistUsers:  perm.IsWhitelistUsers == 1,
+			WhitelistGroups: perm.IsWhitelistGroups == 1,
+		}
+	}
+	var users []DbPermissionUsers
+	if err := PsqlDB.Where("expires_at IS NULL OR expires_at > ?", now).Order("command, user_id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		name := strings.TrimPrefix(u.Command, "cmd_")
+		c := p.Commands[name]
+		c.Users = append(c.Users, PolicyEntry{ID: u.UserID, Expires: u.ExpiresAt})
+		p.Commands[name] = c
+	}
+	var groups []DbPermissionGroups
+	if err := PsqlDB.Where("expires_at IS NULL OR expires_at > ?", now).Order("command, group_id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		name := strings.TrimPrefix(g.Command, "cmd_")
+		c := p.Commands[name]
+		c.Groups = append(c.Groups, PolicyEntry{ID: g.GroupID, Expires: g.ExpiresAt})
+		p.Commands[name] = c
+	}
+
+	var userRoles []DbUserRoles
+	if err := PsqlDB.Where("expires_at IS NULL OR expires_at > ?", now).Order("user_id, group_id, role").Find(&userRoles).Error; err != nil {
+		return nil, err
+	}
+	for _, ur := range userRoles {
+		p.UserRoles = append(p.UserRoles, PolicyUserRole{User: ur.UserID, Group: ur.GroupID, Role: ur.Role, Expires: ur.ExpiresAt})
+	}
+
+	var settings []DbGroupSettings
+	if err := PsqlDB.Where("commands_disabled = ?", true).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		p.Groups[s.GroupID] = PolicyGroup{DisableByDefault: true}
+	}
+	var switches []DbGroupCommands
+	if err := PsqlDB.Order("group_id, command").Find(&switches).Error; err != nil {
+		return nil, err
+	}
+	for _, sw := range switches {
+		g := p.Groups[sw.GroupID]
+		if g.Commands == nil {
+			g.Commands = make(map[string]bool)
+		}
+		g.Commands[sw.Command] = sw.Enabled
+		p.Groups[sw.GroupID] = g
+	}
+	return p, nil
+}
+
+// ValidatePolicy checks that every role referenced by p, or by the stored
+// commands and grants that p leaves in place, exists after p is applied, and
+// that role inheritance has no cycles.
+func ValidatePolicy(p *Policy) error {
+	roles, err := roleMap()
+	if err != nil {
+		return err
+	}
+	if p.Roles != nil {
+		for name := range roles {
+			if !IsBuiltinRole(name) {
+				delete(roles, name)
+			}
+		}
+		for _, r := range p.Roles {
+			if r.Name == "" {
+				return fmt.Errorf("role without a name")
+			}
+			roles[r.Name] = DbRoles{Name: r.Name, Rank: r.Rank, Inherits: r.Inherits}
+		}
+	}
+	for name, r := range roles {
+		seen := map[string]bool{}
+		for cur := name; cur != ""; cur = roles[cur].Inherits {
+			if _, ok := roles[cur]; !ok {
+				return fmt.Errorf("role %s inherits unknown role %s", r.Name, cur)
+			}
+			if seen[cur] {
+				return fmt.Errorf("inheritance cycle at role %s", cur)
+			}
+			seen[cur] = true
+		}
+	}
+
+	// sections left out keep their stored rows, which must not refer to a
+	// role the policy removes
+	commands, userRoles := p.Commands, p.UserRoles
+	if commands == nil {
+		var perms []DbPermissions
+		if err := PsqlDB.Find(&perms).Error; err != nil {
+			return err
+		}
+		commands = make(map[string]PolicyCommand, len(perms))
+		for _, perm := range perms {
+			commands[strings.TrimPrefix(perm.Command, "cmd_")] = PolicyCommand{RequiredRole: perm.RequiredRole}
+		}
+	}
+	if userRoles == nil {
+		var rows []DbUserRoles
+		if err := PsqlDB.Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC()).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, ur := range rows {
+			userRoles = append(userRoles, PolicyUserRole{User: ur.UserID, Group: ur.GroupID, Role: ur.Role})
+		}
+	}
+
+	for name, c := range commands {
+		if _, ok := roles[c.RequiredRole]; !ok {
+			return fmt.Errorf("command %s requires unknown role %s", name, c.RequiredRole)
+		}
+	}
+	for _, ur := range userRoles {
+		if _, ok := roles[ur.Role]; !ok {
+			return fmt.Errorf("user %d has unknown role %s", ur.User, ur.Role)
+		}
+	}
+	return nil
+}
+
+// DiffPolicy lists the changes ApplyPolicy would make, one per line, with a
+// leading +, - or ~ for added, removed and changed entries.
+func DiffPolicy(p *Policy) ([]string, error) {
+	cur, err := ExportPolicy()
+	if err != nil {
+		return nil, err
+	}
+	// only compare the sections p replaces
+	if p.Roles == nil {
+		cur.Roles = nil
+	}
+	if p.Commands == nil {
+		cur.Commands = nil
+	}
+	if p.UserRoles == nil {
+		cur.UserRoles = nil
+	}
+	if p.Groups == nil {
+		cur.Groups = nil
+	}
+	// built-in roles are never removed
+	want := *p
+	want.Roles = slices.Clone(p.Roles)
+	for _, r := range cur.Roles {
+		if IsBuiltinRole(r.Name) && !slices.ContainsFunc(want.Roles, func(pr PolicyRole) bool { return pr.Name == r.Name }) {
+			want.Roles = append(want.Roles, r)
+		}
+	}
+
+	oldEntries, newEntries := flattenPolicy(cur), flattenPolicy(&want)
+	var lines []string
+	for key, oldValue := range oldEntries {
+		newValue, ok := newEntries[key]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("- %s: %s", key, oldValue))
+		} else if newValue != oldValue {
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", key, oldValue, newValue))
+		}
+	}
+	for key, newValue := range newEntries {
+		if _, ok := oldEntries[key]; !ok {
+			lines = append(lines, fmt.Sprintf("+ %s: %s", key, newValue))
+		}
+	}
+	slices.SortFunc(lines, func(a, b string) int { return strings.Compare(a[2:], b[2:]) })
+	return lines, nil
+}
+
+func describeEntryExpiry(expires *time.Time) string {
+	if expires == nil {
+		return "permanent"
+	}
+	return "until " + expires.UTC().Format(time.RFC3339)
+}
+
+func flattenPolicy(p *Policy) map[string]string {
+	res := make(map[string]string)
+	for _, r := range p.Roles {
+		v := "rank " + strconv.Itoa(r.Rank)
+		if r.Inherits != "" {
+			v += ", inherits " + r.Inherits
+		}
+		res["role "+r.Name] = v
+	}
+	for name, c := range p.Commands {
+		res["command "+name+" required_role"] = c.RequiredRole
+		res["command "+name+" whitelist_users"] = strconv.FormatBool(c.WhitelistUsers)
+		res["command "+name+" whitelist_groups"] = strconv.FormatBool(c.WhitelistGroups)
+		for _, u := range c.Users {
+			res[fmt.Sprintf("command %s user %d", name, u.ID)] = describeEntryExpiry(u.Expires)
+		}
+		for _, g := range c.Groups {
+			res[fmt.Sprintf("command %s group %d", name, g.ID)] = describeEntryExpiry(g.Expires)
+		}
+	}
+	for _, ur := range p.UserRoles {
+		res[fmt.Sprintf("user %d group %d role %s", ur.User, ur.Group, ur.Role)] = describeEntryExpiry(ur.Expires)
+	}
+	for id, g := range p.Groups {
+		if g.DisableByDefault {
+			res[fmt.Sprintf("group %d default", id)] = "disable"
+		}
+		for cmd, on := range g.Commands {
+			res[fmt.Sprintf("group %d command %s", id, cmd)] = strconv.FormatBool(on)
+		}
+	}
+	return res
+}
+
+func utcPtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// ApplyPolicy replaces the sections present in p in one transaction.
+func ApplyPolicy(p *Policy) error {
+	if err := ValidatePolicy(p); err != nil {
+		return err
+	}
+
+	err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if p.Roles != nil {
+			var names []string
+			for _, r := range p.Roles {
+				names = append(names, r.Name)
+				if err := tx.Save(&DbRoles{Name: r.Name, Rank: r.Rank, Inherits: r.Inherits}).Error; err != nil {
+					return err
+				}
+			}
+			var removed []string
+			if err := tx.Model(&DbRoles{}).Where("name NOT IN ?", append(names, RoleGuest, RoleAdmin, RoleMaster)).
+				Pluck("name", &removed).Error; err != nil {
+				return err
+			}
+			if len(removed) > 0 {
+				if err := tx.Where("role IN ?", removed).Delete(&DbUserRoles{}).Error; err != nil {
+					return err
+				}
+				if err := tx.Where("name IN ?", removed).Delete(&DbRoles{}).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if p.Commands != nil {
+			for _, table := range []any{&DbPermissionUsers{}, &DbPermissionGroups{}, &DbPermissions{}} {
+				if err := tx.Where("1 = 1").Delete(table).Error; err != nil {
+					return err
+				}
+			}
+			for name, c := range p.Commands {
+				key := permKey(name)
+				perm := DbPermissions{Command: key, RequiredRole: c.RequiredRole}
+				if c.WhitelistUsers {
+					perm.IsWhitelistUsers = 1
+				}
+				if c.WhitelistGroups {
+					perm.IsWhitelistGroups = 1
+				}
+				if err := tx.Create(&perm).Error; err != nil {
+					return err
+				}
+				for _, u := range c.Users {
+					if err := tx.Save(&DbPermissionUsers{Command: key, UserID: u.ID, ExpiresAt: utcPtr(u.Expires)}).Error; err != nil {
+						return err
+					}
+				}
+				for _, g := range c.Groups {
+					if err := tx.Save(&DbPermissionGroups{Command: key, GroupID: g.ID, ExpiresAt: utcPtr(g.Expires)}).Error; err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if p.UserRoles != nil {
+			if err := tx.Where("1 = 1").Delete(&DbUserRoles{}).Error; err != nil {
+				return err
+			}
+			for _, ur := range p.UserRoles {
+				row := DbUserRoles{UserID: ur.User, GroupID: ur.Group, Role: ur.Role, ExpiresAt: utcPtr(ur.Expires)}
+				if err := tx.Save(&row).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if p.Groups != nil {
+			if err := tx.Where("1 = 1").Delete(&DbGroupCommands{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&DbGroupSettings{}).Where("commands_disabled = ?", true).
+				Update("commands_disabled", false).Error; err != nil {
+				return err
+			}
+			for id, g := range p.Groups {
+				if g.DisableByDefault {
+					if err := setCommandsDisabled(tx, id, true); err != nil {
+						return err
+					}
+				}
+				for cmd, on := range g.Commands {
+					if err := tx.Create(&DbGroupCommands{GroupID: id, Command: cmd, Enabled: on}).Error; err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	permCache.clear()
+	groupCmdCache.clear()
+	return err
+}
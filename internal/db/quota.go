@@ -0,0 +1,162 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DbQuotas holds the daily limits of a command. A limit of 0 is unlimited.
+type DbQuotas struct {
+	Command    string `gorm:"primaryKey;column:command"`
+	UserLimit  int    `gorm:"not null;column:user_limit;default:0"`  // per user per day
+	GroupLimit int    `gorm:"not null;column:group_limit;default:0"` // per group per day
+	Cooldown   int    `gorm:"not null;column:cooldown;default:0"`    // seconds between uses per user
+}
+
+func (DbQuotas) TableName() string {
+	return "quotas"
+}
+
+// DbQuotaUsage counts the uses of a command by a user or group in one
+// period, Bonus is extra quota granted for that period
+type DbQuotaUsage struct {
+	Command  string `gorm:"primaryKey;column:command"`
+	Scope    string `gorm:"primaryKey;column:scope"` // TargetUser or TargetGroup
+	TargetID uint64 `gorm:"primaryKey;column:target_id"`
+	Period   string `gorm:"primaryKey;column:period"` // local date the period started
+	Used     int    `gorm:"not null;column:used;default:0"`
+	Bonus    int    `gorm:"not null;column:bonus;default:0"`
+}
+
+func (DbQuotaUsage) TableName() string {
+	return "quota_usage"
+}
+
+var quotaCache = newCache[string, *DbQuotas]()
+
+// GetQuota returns the limits of cmd, or nil if it has none. The result is
+// cached and must not be modified.
+func GetQuota(cmd string) *DbQuotas {
+	q, gen, ok := quotaCache.load(cmd)
+	if ok {
+		return q
+	}
+
+	var row DbQuotas
+	if err := PsqlDB.Where("command = ?", cmd).Limit(1).Find(&row).Error; err == nil && row.Command != "" {
+		q = &row
+	}
+	quotaCache.store(cmd, q, gen)
+	return q
+}
+
+// GetQuotas lists the limits of every command that has any
+func GetQuotas() ([]DbQuotas, error) {
+	var res []DbQuotas
+	err := PsqlDB.Order("command").Find(&res).Error
+	return res, err
+}
+
+func SaveQuota(q *DbQuotas) error {
+	defer quotaCache.invalidate(q.Command)
+	if q.UserLimit == 0 && q.GroupLimit == 0 && q.Cooldown == 0 {
+		return PsqlDB.Where("command = ?", q.Command).Delete(&DbQuotas{}).Error
+	}
+	return PsqlDB.Save(q).Error
+}
+
+// QuotaExceededError reports which limit ConsumeQuota hit
+type QuotaExceededError struct {
+	Scope string
+	Used  int
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota used up (%d/%d)", e.Scope, e.Used, e.Limit)
+}
+
+// ConsumeQuota counts one use of cmd by userID in groupID for period. If the
+// user or group limit of q is reached nothing is counted and a
+// *QuotaExceededError is returned.
+func ConsumeQuota(q *DbQuotas, userID uint64, groupID uint64, period string) error {
+	type target struct {
+		scope string
+		id    uint64
+		limit int
+	}
+	var targets []target
+	if q.UserLimit > 0 {
+		targets = append(targets, target{TargetUser, userID, q.UserLimit})
+	}
+	if q.GroupLimit > 0 {
+		targets = append(targets, target{TargetGroup, groupID, q.GroupLimit})
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		rows := make([]DbQuotaUsage, len(targets))
+		for i, t := range targets {
+			rows[i] = DbQuotaUsage{Command: q.Command, Scope: t.scope, TargetID: t.id, Period: period}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows[i]).Error; err != nil {
+				return err
+			}
+			if err := tx.Where(&rows[i]).First(&rows[i]).Error; err != nil {
+				return err
+			}
+			if rows[i].Used >= t.limit+rows[i].Bonus {
+				return &QuotaExceededError{Scope: t.scope, Used: rows[i].Used, Limit: t.limit + rows[i].Bonus}
+			}
+		}
+		for i := range rows {
+			if err := tx.Model(&rows[i]).Update("used", gorm.Expr("used + 1")).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RefundQuota takes back one use of cmd counted by ConsumeQuota with the
+// same arguments
+func RefundQuota(q *DbQuotas, userID uint64, groupID uint64, period string) error {
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if q.UserLimit > 0 {
+			if err := refundUsage(tx, q.Command, TargetUser, userID, period); err != nil {
+				return err
+			}
+		}
+		if q.GroupLimit > 0 {
+			return refundUsage(tx, q.Command, TargetGroup, groupID, period)
+		}
+		return nil
+	})
+}
+
+func refundUsage(tx *gorm.DB, cmd string, scope string, targetID uint64, period string) error {
+	return tx.Model(&DbQuotaUsage{}).
+		Where("command = ? AND scope = ? AND target_id = ? AND period = ? AND used > 0", cmd, scope, targetID, period).
+		Update("used", gorm.Expr("used - 1")).Error
+}
+
+// GetQuotaUsage returns how often cmd was used by a user or group in period
+// and the bonus granted for it.
+func GetQuotaUsage(cmd string, scope string, targetID uint64, period string) (used int, bonus int) {
+	var row DbQuotaUsage
+	PsqlDB.Where("command = ? AND scope = ? AND target_id = ? AND period = ?", cmd, scope, targetID, period).
+		Limit(1).Find(&row)
+	return row.Used, row.Bonus
+}
+
+// AddQuotaBonus grants n extra uses of cmd to a user or group for period
+func AddQuotaBonus(cmd string, scope string, targetID uint64, period string, n int) error {
+	row := DbQuotaUsage{Command: cmd, Scope: scope, TargetID: targetID, Period: period, Bonus: n}
+	return PsqlDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "command"}, {Name: "scope"}, {Name: "target_id"}, {Name: "period"}},
+		DoUpdates: clause.Assignments(map[string]any{"bonus": gorm.Expr("quota_usage.bonus + ?", n)}),
+	}).Create(&row).Error
+}
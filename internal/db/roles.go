@@ -0,0 +1,285 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Built-in roles, they always exist and cannot be removed
+const (
+	RoleGuest  = "guest"
+	RoleAdmin  = "admin"
+	RoleMaster = "master"
+)
+
+// GlobalGroup is the group id of role assignments that apply everywhere
+const GlobalGroup uint64 = 0
+
+// DbRoles defines a named role. A role satisfies another role if its rank is
+// at least as high, or if it inherits from it directly or transitively.
+type DbRoles struct {
+	Name     string `gorm:"primaryKey;column:name"`
+	Rank     int    `gorm:"not null;column:rank;default:0"`
+	Inherits string `gorm:"column:inherits"` // parent role name, empty for none
+}
+
+func (DbRoles) TableName() string {
+	return "roles"
+}
+
+type DbUserRoles struct {
+	UserID    uint64     `gorm:"primaryKey;column:user_id"`
+	GroupID   uint64     `gorm:"primaryKey;column:group_id"` // GlobalGroup for global roles
+	Role      string     `gorm:"primaryKey;column:role"`
+	ExpiresAt *time.Time `gorm:"column:expires_at;index"` // nil never expires
+	GrantedIn uint64     `gorm:"column:granted_in"`       // group the grant was made in
+}
+
+func (DbUserRoles) TableName() string {
+	return "user_roles"
+}
+
+var builtinRoles = []DbRoles{
+	{Name: RoleGuest, Rank: 0},
+	{Name: RoleAdmin, Rank: 100},
+	{Name: RoleMaster, Rank: 1000},
+}
+
+func IsBuiltinRole(name string) bool {
+	for _, r := range builtinRoles {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateRoles creates the built-in roles and moves the old integer levels
+// in users.perm and permissions.user_allow over to role names.
+func migrateRoles() {
+	if err := PsqlDB.Clauses(clause.OnConflict{DoNothing: true}).Create(&builtinRoles).Error; err != nil {
+		log.Printf("failed to create built-in roles: %v", err)
+	}
+
+	m := PsqlDB.Migrator()
+	if m.HasColumn(&dbUsers{}, "perm") {
+		err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(`INSERT OR IGNORE INTO user_roles (user_id, group_id, role)
+				SELECT user_id, ?, CASE perm WHEN 1 THEN ? ELSE ? END FROM users WHERE perm IN (1, 2)`,
+				GlobalGroup, RoleAdmin, RoleMaster).Error; err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE users DROP COLUMN perm").Error
+		})
+		if err != nil {
+			log.Printf("failed to migrate users.perm: %v", err)
+		} else {
+			log.Println("migrated users.perm to user_roles")
+		}
+	}
+	if m.HasColumn(&DbPermissions{}, "user_allow") {
+		err := PsqlDB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(`UPDATE permissions SET required_role =
+				CASE user_allow WHEN 0 THEN ? WHEN 1 THEN ? ELSE ? END`,
+				RoleGuest, RoleAdmin, RoleMaster).Error; err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE permissions DROP COLUMN user_allow").Error
+		})
+		if err != nil {
+			log.Printf("failed to migrate permissions.user_allow: %v", err)
+		} else {
+			log.Println("migrated permissions.user_allow to required_role")
+		}
+	}
+}
+
+func GetRoles() ([]DbRoles, error) {
+	var roles []DbRoles
+	err := PsqlDB.Order("rank, name").Find(&roles).Error
+	return roles, err
+}
+
+func GetRole(name string) *DbRoles {
+	var role DbRoles
+	if err := PsqlDB.Where("name = ?", name).Limit(1).Find(&role).Error; err != nil || role.Name == "" {
+		return nil
+	}
+	return &role
+}
+
+// SaveRole creates or updates a role. Inheritance cycles are rejected.
+func SaveRole(role *DbRoles) error {
+	if role.Inherits != "" {
+		roles, err := roleMap()
+		if err != nil {
+			return err
+		}
+		if _, ok := roles[role.Inherits]; !ok {
+			return fmt.Errorf("unknown role: %s", role.Inherits)
+		}
+		roles[role.Name] = *role
+		seen := map[string]bool{}
+		for name := role.Name; name != ""; name = roles[name].Inherits {
+			if seen[name] {
+				return fmt.Errorf("inheritance cycle at role %s", name)
+			}
+			seen[name] = true
+		}
+	}
+	return PsqlDB.Save(role).Error
+}
+
+// DeleteRole removes a custom role and every assignment of it. A role that
+// commands still require is refused, those commands would silently become
+// master only.
+func DeleteRole(name string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("cannot remove built-in role %s", name)
+	}
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		var cmds []string
+		if err := tx.Model(&DbPermissions{}).Where("required_role = ?", name).Order("command").Pluck("command", &cmds).Error; err != nil {
+			return err
+		}
+		if len(cmds) > 0 {
+			return fmt.Errorf("role %s is still required by %s", name, strings.Join(cmds, ", "))
+		}
+		if err := tx.Where("role = ?", name).Delete(&DbUserRoles{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&DbRoles{}).Where("inherits = ?", name).Update("inherits", "").Error; err != nil {
+			return err
+		}
+		return tx.Where("name = ?", name).Delete(&DbRoles{}).Error
+	})
+}
+
+func roleMap() (map[string]DbRoles, error) {
+	roles, err := GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]DbRoles, len(roles))
+	for _, r := range roles {
+		res[r.Name] = r
+	}
+	return res, nil
+}
+
+// GetUserRoles returns the unexpired role names a user holds in groupID.
+// Pass GlobalGroup to get the global roles.
+func GetUserRoles(userID uint64, groupID uint64) []string {
+	var roles []string
+	PsqlDB.Model(&DbUserRoles{}).
+		Where("user_id = ? AND group_id = ? AND (expires_at IS NULL OR expires_at > ?)", userID, groupID, time.Now().UTC()).
+		Order("role").
+		Pluck("role", &roles)
+	return roles
+}
+
+// GetUserRoleGrants is like GetUserRoles but returns the full rows.
+func GetUserRoleGrants(userID uint64, groupID uint64) []DbUserRoles {
+	var grants []DbUserRoles
+	PsqlDB.Where("user_id = ? AND group_id = ? AND (expires_at IS NULL OR expires_at > ?)", userID, groupID, time.Now().UTC()).
+		Order("role").
+		Find(&grants)
+	return grants
+}
+
+// AddUserRole grants role to a user, replacing the expiry of an existing
+// grant. expires may be nil for a permanent grant.
+func AddUserRole(userID uint64, groupID uint64, role string, expires *time.Time, grantedIn uint64) error {
+	if expires != nil {
+		utc := expires.UTC()
+		expires = &utc
+	}
+	if GetRole(role) == nil {
+		return fmt.Errorf("unknown role: %s", role)
+	}
+	return PsqlDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "group_id"}, {Name: "role"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at", "granted_in"}),
+	}).Create(&DbUserRoles{
+		UserID:    userID,
+		GroupID:   groupID,
+		Role:      role,
+		ExpiresAt: expires,
+		GrantedIn: grantedIn,
+	}).Error
+}
+
+func RemoveUserRole(userID uint64, groupID uint64, role string) error {
+	return PsqlDB.Where("user_id = ? AND group_id = ? AND role = ?", userID, groupID, role).
+		Delete(&DbUserRoles{}).Error
+}
+
+// ClearUserRoles removes every role a user holds in groupID.
+func ClearUserRoles(userID uint64, groupID uint64) error {
+	return PsqlDB.Where("user_id = ? AND group_id = ?", userID, groupID).
+		Delete(&DbUserRoles{}).Error
+}
+
+// RoleRank returns the highest rank role reaches through its inheritance
+// chain, -1 for an unknown role
+func RoleRank(role string) int {
+	roles, err := roleMap()
+	if err != nil {
+		return -1
+	}
+	return roleRank(roles, role)
+}
+
+// HighestRank returns the highest RoleRank among held, 0 (guest) if none
+func HighestRank(held []string) int {
+	roles, err := roleMap()
+	if err != nil {
+		return 0
+	}
+	best := 0
+	for _, name := range held {
+		best = max(best, roleRank(roles, name))
+	}
+	return best
+}
+
+func roleRank(roles map[string]DbRoles, role string) int {
+	rank := -1
+	seen := map[string]bool{}
+	for r, ok := roles[role]; ok && !seen[r.Name]; r, ok = roles[r.Inherits] {
+		seen[r.Name] = true
+		rank = max(rank, r.Rank)
+	}
+	return rank
+}
+
+// RolesSatisfy reports whether any of the held roles satisfies required.
+// Everyone implicitly holds the guest role.
+func RolesSatisfy(held []string, required string) bool {
+	if required == "" || required == RoleGuest {
+		return true
+	}
+	roles, err := roleMap()
+	if err != nil {
+		return false
+	}
+	req, ok := roles[required]
+	if !ok {
+		return false
+	}
+	for _, name := range held {
+		seen := map[string]bool{}
+		for r, ok := roles[name]; ok && !seen[r.Name]; r, ok = roles[r.Inherits] {
+			seen[r.Name] = true
+			if r.Rank >= req.Rank {
+				return true
+			}
+		}
+	}
+	return false
+}
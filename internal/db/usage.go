@@ -0,0 +1,85 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// DbApiUsage records one outbound call to an external API
+type DbApiUsage struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	Time      time.Time `gorm:"not null;column:time;index"`
+	Command   string    `gorm:"column:command"`
+	UserID    uint64    `gorm:"column:user_id"`
+	GroupID   uint64    `gorm:"column:group_id"`
+	Provider  string    `gorm:"not null;column:provider"`
+	LatencyMs int64     `gorm:"column:latency_ms"`
+	Status    int       `gorm:"column:status"` // HTTP status, 0 if the request failed
+	Cost      float64   `gorm:"column:cost"`
+}
+
+func (DbApiUsage) TableName() string {
+	return "api_usage"
+}
+
+func SaveApiUsage(u *DbApiUsage) error {
+	return PsqlDB.Create(u).Error
+}
+
+// Keys GetUsageReport can group by
+const (
+	UsageByUser     = "user"
+	UsageByGroup    = "group"
+	UsageByProvider = "provider"
+	UsageByCommand  = "command"
+)
+
+type UsageRow struct {
+	Key       string
+	Calls     int64
+	Errors    int64
+	Cost      float64
+	LatencyMs float64 // average
+}
+
+// GetUsageReport sums up the API calls made since the given time, grouped
+// by one of the UsageBy keys and ordered by cost.
+func GetUsageReport(since time.Time, by string, limit int) ([]UsageRow, error) {
+	var column string
+	switch by {
+	case UsageByUser:
+		column = "CAST(user_id AS TEXT)"
+	case UsageByGroup:
+		column = "CAST(group_id AS TEXT)"
+	case UsageByProvider:
+		column = "provider"
+	case UsageByCommand:
+		column = "command"
+	default:
+		return nil, fmt.Errorf("unknown grouping: %s", by)
+	}
+
+	var rows []UsageRow
+	err := PsqlDB.Model(&DbApiUsage{}).
+		Select(column+" AS key, COUNT(*) AS calls, "+
+			"SUM(CASE WHEN status BETWEEN 200 AND 299 THEN 0 ELSE 1 END) AS errors, "+
+			"SUM(cost) AS cost, AVG(latency_ms) AS latency_ms").
+		Where("time >= ?", since).
+		Group("key").
+		Order("cost DESC, calls DESC").
+		Limit(limit).
+		Scan(&rows).Error
+	return rows, err
+}
+
+// GetUsageTotal sums up every API call made since the given time
+func GetUsageTotal(since time.Time) (UsageRow, error) {
+	var row UsageRow
+	err := PsqlDB.Model(&DbApiUsage{}).
+		Select("COUNT(*) AS calls, "+
+			"COALESCE(SUM(CASE WHEN status BETWEEN 200 AND 299 THEN 0 ELSE 1 END), 0) AS errors, "+
+			"COALESCE(SUM(cost), 0) AS cost, COALESCE(AVG(latency_ms), 0) AS latency_ms").
+		Where("time >= ?", since).
+		Scan(&row).Error
+	return row, err
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+	"github.com/awfufu/qbot"
+	"github.com/mattn/go-sqlite3"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrWriterQueueFull = errors.New("database writer queue is full")
+var ErrWriterClosed = errors.New("database writer is closed")
+
+// msgWriter persists messages and events from a single goroutine, batching
+// them into one transaction every flush interval or batch size rows. A
+// recall may be queued before the message it refers to, which is only saved
+// once its command finished. The recall event then stays as a pending mark
+// and is applied when the message row is inserted.
+type msgWriter struct {
+	queue chan writeItem
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	retried atomic.Uint64
+}
+
+// writeItem holds exactly one of msg or event.
+type writeItem struct {
+	msg   *qbot.Message
+	event *DbEvents
+}
+
+type WriterStats struct {
+	Written uint64 // rows committed
+	Dropped uint64 // rows rejected because the queue was full
+	Failed  uint64 // rows lost after all retries failed
+	Retried uint64 // transactions retried because the database was busy
+}
+
+var writer *msgWriter
+
+const maxWriteRetries = 5
+
+func startWriter() {
+	writer = &msgWriter{
+		queue: make(chan writeItem, config.Cfg.SQLite.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go writer.run(config.Cfg.SQLite.BatchSize, time.Duration(config.Cfg.SQLite.FlushInterval)*time.Millisecond)
+}
+
+// stopWriter flushes pending messages and waits for the writer to exit.
+func stopWriter() {
+	if writer == nil {
+		return
+	}
+	writer.mu.Lock()
+	if !writer.closed {
+		writer.closed = true
+		close(writer.queue)
+	}
+	writer.mu.Unlock()
+	<-writer.done
+}
+
+func GetWriterStats() WriterStats {
+	if writer == nil {
+		return WriterStats{}
+	}
+	return WriterStats{
+		Written: writer.written.Load(),
+		Dropped: writer.dropped.Load(),
+		Failed:  writer.failed.Load(),
+		Retried: writer.retried.Load(),
+	}
+}
+
+// SaveDatabase queues msg for the writer goroutine. It never blocks, if the
+// queue is full the message is dropped and counted.
+func SaveDatabase(msg *qbot.Message) error {
+	return enqueue(writeItem{msg: msg})
+}
+
+// SaveEvent queues a group event for the writer goroutine. A recall event
+// also flags the recalled message.
+func SaveEvent(ev *DbEvents) error {
+	return enqueue(writeItem{event: ev})
+}
+
+func enqueue(item writeItem) error {
+	if writer == nil {
+		return ErrWriterClosed
+	}
+	writer.mu.RLock()
+	defer writer.mu.RUnlock()
+	if writer.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case writer.queue <- item:
+		return nil
+	default:
+		writer.dropped.Add(1)
+		return ErrWriterQueueFull
+	}
+}
+
+func (w *msgWriter) run(batchSize int, interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]writeItem, 0, batchSize)
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (w *msgWriter) flush(batch []writeItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	backoff := 50 * time.Millisecond
+	for attempt := 0; attempt <= maxWriteRetries; attempt++ {
+		if err = saveBatch(batch); err == nil || !isBusy(err) {
+			break
+		}
+		w.retried.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if err != nil {
+		w.failed.Add(uint64(len(batch)))
+		log.Printf("failed to save %d rows: %v", len(batch), err)
+		return
+	}
+	w.written.Add(uint64(len(batch)))
+}
+
+func saveBatch(batch []writeItem) error {
+	// last name wins if a user appears more than once in the batch
+	userIdx := make(map[uint64]int, len(batch))
+	users := make([]dbUsers, 0, len(batch))
+	messages := make([]dbMessages, 0, len(batch))
+	var events []*DbEvents
+	for _, item := range batch {
+		if item.event != nil {
+			events = append(events, item.event)
+			continue
+		}
+		msg := item.msg
+		uid := uint64(msg.UserID)
+		if i, ok := userIdx[uid]; ok {
+			users[i].Name = msg.Name
+		} else {
+			userIdx[uid] = len(users)
+			users = append(users, dbUsers{UserID: uid, Name: msg.Name})
+		}
+		messages = append(messages, dbMessages{
+			MsgID:   uint64(msg.MsgID),
+			UserID:  uid,
+			GroupID: uint64(msg.GroupID),
+			Raw:     msg.Raw,
+			Time:    time.Unix(int64(msg.Time), 0),
+		})
+	}
+
+	return PsqlDB.Transaction(func(tx *gorm.DB) error {
+		if len(messages) > 0 {
+			if err := saveMessages(tx, users, messages); err != nil {
+				return err
+			}
+		}
+		for _, ev := range events {
+			if err := saveEvent(tx, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func saveMessages(tx *gorm.DB, users []dbUsers, messages []dbMessages) error {
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(
+			map[string]any{
+				"name": gorm.Expr("EXCLUDED.name"),
+			},
+		),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "users.name <> EXCLUDED.name"},
+		}},
+	}).Create(&users).Error; err != nil {
+		return err
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&messages).Error; err != nil {
+		return err
+	}
+
+	// flag messages whose recall was saved before them
+	ids := make([]uint64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.MsgID
+	}
+	recall := func(column string) clause.Expr {
+		return gorm.Expr("(SELECT "+column+" FROM events WHERE events.kind = ? AND events.msg_id = messages.msg_id"+
+			" AND events.group_id = messages.group_id ORDER BY events.id DESC LIMIT 1)", EventRecall)
+	}
+	return tx.Model(&dbMessages{}).
+		Where("msg_id IN ? AND recalled = ?", ids, false).
+		Where("EXISTS (SELECT 1 FROM events WHERE events.kind = ? AND events.msg_id = messages.msg_id AND events.group_id = messages.group_id)", EventRecall).
+		Updates(map[string]any{
+			"recalled":    true,
+			"recalled_by": recall("operator_id"),
+			"recalled_at": recall("time"),
+		}).Error
+}
+
+// saveEvent stores ev. A recall also flags its message if that was already
+// written, otherwise saveMessages does it later.
+func saveEvent(tx *gorm.DB, ev *DbEvents) error {
+	if err := tx.Create(ev).Error; err != nil {
+		return err
+	}
+	if ev.Kind != EventRecall {
+		return nil
+	}
+	return tx.Model(&dbMessages{}).
+		Where("msg_id = ? AND group_id = ?", ev.MsgID, ev.GroupID).
+		Updates(map[string]any{
+			"recalled":    true,
+			"recalled_by": ev.OperatorID,
+			"recalled_at": ev.Time,
+		}).Error
+}
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
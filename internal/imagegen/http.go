@@ -0,0 +1,84 @@
+package imagegen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// maxErrorBody limits how much of an error response ends up in the error
+const maxErrorBody = 512
+
+// postJSON sends body as JSON and decodes a 200 response into out
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body any, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return post(ctx, client, url, header, "application/json", data, out)
+}
+
+// postMultipart sends fields and one file as multipart/form-data and
+// decodes a 200 response into out
+func postMultipart(ctx context.Context, client *http.Client, url string, header http.Header,
+	fields map[string]string, fileField string, file []byte, out any) error {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	fw, err := w.CreateFormFile(fileField, "image.png")
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(file); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return post(ctx, client, url, header, w.FormDataContentType(), buf.Bytes(), out)
+}
+
+func post(ctx context.Context, client *http.Client, url string, header http.Header, contentType string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(respBody) > maxErrorBody {
+			respBody = respBody[:maxErrorBody]
+		}
+		return fmt.Errorf("%d\n%s", resp.StatusCode, respBody)
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+func bearer(apiKey string) http.Header {
+	h := http.Header{}
+	if apiKey != "" {
+		h.Set("Authorization", "Bearer "+apiKey)
+	}
+	return h
+}
@@ -0,0 +1,86 @@
+package imagegen
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// openAI talks to an OpenAI compatible images API
+type openAI struct {
+	baseProvider
+}
+
+type openAIRequest struct {
+	Model  string `json:"model,omitempty"`
+	Prompt string `json:"prompt"`
+	N      int    `json:"n"`
+	Size   string `json:"size"`
+}
+
+type openAIResponse struct {
+	Data []struct {
+		URL     string `json:"url"`
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+}
+
+func (p *openAI) Generate(ctx context.Context, req *Request) (*Result, error) {
+	if req.NegativePrompt != "" || req.Seed != nil || req.Steps != 0 || req.GuidanceScale != 0 {
+		return nil, fmt.Errorf("%s does not support negative prompts, seeds, steps or guidance", p.name)
+	}
+	body := openAIRequest{
+		Model:  req.Model,
+		Prompt: req.Prompt,
+		N:      req.count(),
+		Size:   req.Size,
+	}
+	var resp openAIResponse
+	if err := postJSON(ctx, p.client, imagesEndpoint(p.baseURL), bearer(p.apiKey), body, &resp); err != nil {
+		return nil, err
+	}
+	return p.result(&resp)
+}
+
+func (p *openAI) Edit(ctx context.Context, req *Request) (*Result, error) {
+	if req.NegativePrompt != "" || req.Seed != nil || req.Steps != 0 || req.GuidanceScale != 0 || req.Strength != 0 {
+		return nil, fmt.Errorf("%s does not support negative prompts, seeds, steps, guidance or strength", p.name)
+	}
+	fields := map[string]string{
+		"prompt": req.Prompt,
+		"n":      strconv.Itoa(req.count()),
+		"size":   req.Size,
+	}
+	if req.Model != "" {
+		fields["model"] = req.Model
+	}
+	endpoint := strings.TrimSuffix(imagesEndpoint(p.baseURL), "/generations") + "/edits"
+
+	var resp openAIResponse
+	if err := postMultipart(ctx, p.client, endpoint, bearer(p.apiKey), fields, "image", req.Image, &resp); err != nil {
+		return nil, err
+	}
+	return p.result(&resp)
+}
+
+func (p *openAI) result(resp *openAIResponse) (*Result, error) {
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("no images generated")
+	}
+
+	res := &Result{}
+	for _, d := range resp.Data {
+		if d.URL != "" {
+			res.Images = append(res.Images, Image{URL: d.URL})
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(d.B64JSON)
+		if err != nil {
+			return nil, fmt.Errorf("decode image: %w", err)
+		}
+		res.Images = append(res.Images, Image{Data: data})
+	}
+	return res, nil
+}
@@ -0,0 +1,207 @@
+package imagegen
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+)
+
+// Provider is an image generation backend
+type Provider interface {
+	Name() string
+	// Models lists the models the provider accepts, the first is the default
+	Models() []string
+	// Sizes lists the supported WIDTHxHEIGHT sizes, the first is the default
+	Sizes() []string
+	Generate(ctx context.Context, req *Request) (*Result, error)
+}
+
+type Request struct {
+	Model          string
+	Prompt         string
+	NegativePrompt string
+	Size           string
+	Seed           *int64  // nil for a random seed
+	Steps          int     // 0 for the provider default
+	GuidanceScale  float64 // 0 for DefaultGuidanceScale
+	N              int     // number of images, 0 means 1
+
+	// Edit only
+	Image    []byte  // encoded source image
+	Strength float64 // how far to move away from Image, 0 for the provider default
+}
+
+// DefaultGuidanceScale is used when a request does not set one
+const DefaultGuidanceScale = 7.5
+
+func (r *Request) guidance() float64 {
+	if r.GuidanceScale > 0 {
+		return r.GuidanceScale
+	}
+	return DefaultGuidanceScale
+}
+
+func (r *Request) count() int {
+	return max(r.N, 1)
+}
+
+// Editor is implemented by providers that can transform a source image
+type Editor interface {
+	// EditModels lists the models that accept a source image, the first is
+	// the default
+	EditModels() []string
+	Edit(ctx context.Context, req *Request) (*Result, error)
+}
+
+type Result struct {
+	Images    []Image
+	Seed      int64         // 0 if the provider does not report it
+	Inference time.Duration // as reported by the provider, 0 if unknown
+}
+
+// Image holds either a URL or the encoded image itself
+type Image struct {
+	URL  string
+	Data []byte
+}
+
+// File returns the image in a form qbot.Image accepts
+func (img Image) File() string {
+	if img.URL != "" {
+		return img.URL
+	}
+	return "base64://" + base64.StdEncoding.EncodeToString(img.Data)
+}
+
+// Provider types in config.SupplierConfig.Type
+const (
+	TypeSiliconFlow = "siliconflow"
+	TypeOpenAI      = "openai"
+	TypeSDWebUI     = "sdwebui"
+)
+
+// New creates a provider from a supplier entry. client is used for every
+// request, callers pass one that records usage.
+func New(name string, cfg config.SupplierConfig, client *http.Client) (Provider, error) {
+	if cfg.BaseURL == "" {
+		return nil, fmt.Errorf("supplier %s: base_url is empty", name)
+	}
+	base := baseProvider{
+		name:    name,
+		baseURL: strings.TrimSuffix(cfg.BaseURL, "/"),
+		apiKey:  cfg.APIKey,
+		client:  client,
+	}
+
+	var models, editModels, sizes []string
+	switch cfg.Type {
+	case TypeSiliconFlow:
+		models = []string{"Qwen/Qwen-Image"}
+		editModels = []string{"Qwen/Qwen-Image-Edit"}
+		sizes = []string{"1328x1328", "1584x1056", "1140x1472", "1664x928", "928x1664"}
+	case TypeOpenAI:
+		models = []string{"dall-e-3"}
+		editModels = []string{"dall-e-2"}
+		sizes = []string{"1024x1024", "1792x1024", "1024x1792"}
+	case TypeSDWebUI:
+		models = []string{""} // the checkpoint loaded in the WebUI
+		sizes = []string{"1024x1024", "1216x832", "832x1216", "768x768", "512x512"}
+	default:
+		return nil, fmt.Errorf("supplier %s: unknown image type %q", name, cfg.Type)
+	}
+	if len(cfg.Models) > 0 {
+		models = slices.Clone(cfg.Models)
+	}
+	if cfg.DefaultModel != "" {
+		models = slices.DeleteFunc(models, func(m string) bool { return m == cfg.DefaultModel || m == "" })
+		models = slices.Insert(models, 0, cfg.DefaultModel)
+	}
+	if len(cfg.Sizes) > 0 {
+		sizes = slices.Clone(cfg.Sizes)
+	}
+	if len(cfg.EditModels) > 0 {
+		editModels = slices.Clone(cfg.EditModels)
+	}
+	if editModels == nil {
+		// img2img runs on the same checkpoints
+		editModels = models
+	}
+	base.models, base.editModels, base.sizes = models, editModels, sizes
+
+	switch cfg.Type {
+	case TypeSiliconFlow:
+		return &siliconFlow{base}, nil
+	case TypeOpenAI:
+		return &openAI{base}, nil
+	default:
+		return &sdWebUI{base}, nil
+	}
+}
+
+type baseProvider struct {
+	name       string
+	baseURL    string
+	apiKey     string
+	client     *http.Client
+	models     []string
+	editModels []string
+	sizes      []string
+}
+
+func (p *baseProvider) Name() string         { return p.name }
+func (p *baseProvider) Models() []string     { return p.models }
+func (p *baseProvider) EditModels() []string { return p.editModels }
+func (p *baseProvider) Sizes() []string      { return p.sizes }
+
+var (
+	mu        sync.RWMutex
+	providers = make(map[string]Provider)
+)
+
+// Register adds p to the providers /draw can use, replacing one of the same
+// name
+func Register(p Provider) {
+	mu.Lock()
+	providers[p.Name()] = p
+	mu.Unlock()
+}
+
+func Get(name string) (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// Names lists the registered providers in alphabetical order
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// dataURL encodes an image as a data: URL
+func dataURL(data []byte) string {
+	return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// parseSize splits a WIDTHxHEIGHT size
+func parseSize(size string) (int, int, error) {
+	var w, h int
+	if _, err := fmt.Sscanf(size, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return w, h, nil
+}
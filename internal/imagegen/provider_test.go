@@ -0,0 +1,306 @@
+package imagegen
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awfufu/go-hurobot/internal/config"
+)
+
+// pngHeader is enough of a PNG for http.DetectContentType
+var pngHeader = []byte("\x89PNG\r\n\x1a\n0000")
+
+// newTestProvider starts a server that hands every request to handler and
+// returns a provider of type typ pointed at it
+func newTestProvider(t *testing.T, typ string, apiKey string, handler http.HandlerFunc) Provider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	p, err := New("test", config.SupplierConfig{Type: typ, BaseURL: srv.URL + "/v1/", APIKey: apiKey}, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func decodeBody(t *testing.T, r *http.Request, v any) {
+	t.Helper()
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		t.Fatalf("decode request: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("x", config.SupplierConfig{Type: TypeOpenAI}, nil); err == nil {
+		t.Error("empty base_url accepted")
+	}
+	if _, err := New("x", config.SupplierConfig{Type: "midjourney", BaseURL: "http://x"}, nil); err == nil {
+		t.Error("unknown type accepted")
+	}
+
+	p, err := New("x", config.SupplierConfig{Type: TypeOpenAI, BaseURL: "http://x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Models(); !slices.Equal(got, []string{"dall-e-3"}) {
+		t.Errorf("default models = %v", got)
+	}
+	if got := p.(Editor).EditModels(); !slices.Equal(got, []string{"dall-e-2"}) {
+		t.Errorf("default edit models = %v", got)
+	}
+
+	p, err = New("x", config.SupplierConfig{
+		Type:         TypeSDWebUI,
+		BaseURL:      "http://x",
+		DefaultModel: "b",
+		Models:       []string{"a", "b"},
+		Sizes:        []string{"640x480"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Models(); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("models = %v, want the default model first", got)
+	}
+	if got := p.(Editor).EditModels(); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("sdwebui edit models = %v, want the generation models", got)
+	}
+	if got := p.Sizes(); !slices.Equal(got, []string{"640x480"}) {
+		t.Errorf("sizes = %v", got)
+	}
+}
+
+func TestSiliconFlowGenerate(t *testing.T) {
+	seed := int64(42)
+	p := newTestProvider(t, TypeSiliconFlow, "key", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/images/generations" {
+			t.Errorf("request = %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var body siliconFlowRequest
+		decodeBody(t, r, &body)
+		want := siliconFlowRequest{
+			Model:             "Qwen/Qwen-Image",
+			Prompt:            "a cat",
+			NegativePrompt:    "dogs",
+			ImageSize:         "1328x1328",
+			BatchSize:         2,
+			Seed:              &seed,
+			NumInferenceSteps: 20,
+			GuidanceScale:     DefaultGuidanceScale,
+		}
+		if body.Seed == nil || *body.Seed != seed {
+			t.Errorf("seed = %v, want %d", body.Seed, seed)
+		}
+		body.Seed = want.Seed
+		if body != want {
+			t.Errorf("body = %+v\nwant %+v", body, want)
+		}
+		io.WriteString(w, `{"images":[{"url":"https://img/1"},{"url":"https://img/2"}],"timings":{"inference":1.5},"seed":42}`)
+	})
+
+	res, err := p.Generate(context.Background(), &Request{
+		Model:          "Qwen/Qwen-Image",
+		Prompt:         "a cat",
+		NegativePrompt: "dogs",
+		Size:           "1328x1328",
+		Seed:           &seed,
+		Steps:          20,
+		N:              2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 2 || res.Images[0].URL != "https://img/1" || res.Images[1].URL != "https://img/2" {
+		t.Errorf("images = %+v", res.Images)
+	}
+	if res.Seed != 42 || res.Inference != 1500*time.Millisecond {
+		t.Errorf("seed = %d, inference = %v", res.Seed, res.Inference)
+	}
+}
+
+func TestSiliconFlowEdit(t *testing.T) {
+	p := newTestProvider(t, TypeSiliconFlow, "", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "" {
+			t.Errorf("Authorization = %q without an api_key", got)
+		}
+		var body siliconFlowRequest
+		decodeBody(t, r, &body)
+		if want := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngHeader); body.Image != want {
+			t.Errorf("image = %q, want %q", body.Image, want)
+		}
+		io.WriteString(w, `{"images":[{"url":"https://img/1"}]}`)
+	})
+
+	editor := p.(Editor)
+	if _, err := editor.Edit(context.Background(), &Request{Prompt: "x", Image: pngHeader}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := editor.Edit(context.Background(), &Request{Prompt: "x", Image: pngHeader, Strength: 0.5}); err == nil {
+		t.Error("--strength accepted")
+	}
+}
+
+func TestOpenAIGenerate(t *testing.T) {
+	p := newTestProvider(t, TypeOpenAI, "key", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/images/generations" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		var body openAIRequest
+		decodeBody(t, r, &body)
+		if want := (openAIRequest{Model: "dall-e-3", Prompt: "a cat", N: 1, Size: "1024x1792"}); body != want {
+			t.Errorf("body = %+v\nwant %+v", body, want)
+		}
+		io.WriteString(w, `{"data":[{"url":"https://img/1"},{"b64_json":"`+base64.StdEncoding.EncodeToString(pngHeader)+`"}]}`)
+	})
+
+	res, err := p.Generate(context.Background(), &Request{Model: "dall-e-3", Prompt: "a cat", Size: "1024x1792"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 2 || res.Images[0].URL != "https://img/1" || string(res.Images[1].Data) != string(pngHeader) {
+		t.Errorf("images = %+v", res.Images)
+	}
+
+	seed := int64(1)
+	for _, req := range []*Request{
+		{Prompt: "x", NegativePrompt: "y"},
+		{Prompt: "x", Seed: &seed},
+		{Prompt: "x", Steps: 10},
+		{Prompt: "x", GuidanceScale: 3},
+	} {
+		if _, err := p.Generate(context.Background(), req); err == nil {
+			t.Errorf("unsupported option accepted: %+v", req)
+		}
+	}
+}
+
+func TestOpenAIEdit(t *testing.T) {
+	p := newTestProvider(t, TypeOpenAI, "key", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/images/edits" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("parse multipart: %v", err)
+		}
+		for k, want := range map[string]string{"prompt": "a hat", "n": "1", "size": "1024x1024", "model": "dall-e-2"} {
+			if got := r.FormValue(k); got != want {
+				t.Errorf("%s = %q, want %q", k, got, want)
+			}
+		}
+		f, _, err := r.FormFile("image")
+		if err != nil {
+			t.Fatalf("image: %v", err)
+		}
+		if data, _ := io.ReadAll(f); string(data) != string(pngHeader) {
+			t.Errorf("image = %q", data)
+		}
+		io.WriteString(w, `{"data":[{"url":"https://img/1"}]}`)
+	})
+
+	res, err := p.(Editor).Edit(context.Background(), &Request{Model: "dall-e-2", Prompt: "a hat", Size: "1024x1024", Image: pngHeader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 1 {
+		t.Errorf("images = %+v", res.Images)
+	}
+}
+
+func TestSDWebUI(t *testing.T) {
+	var paths []string
+	p := newTestProvider(t, TypeSDWebUI, "user:pass", func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			t.Errorf("basic auth = %q %q %v", user, pass, ok)
+		}
+		var body sdRequest
+		decodeBody(t, r, &body)
+		if body.Width != 832 || body.Height != 1216 || body.CfgScale != 5 || body.Seed != -1 || body.BatchSize != 1 {
+			t.Errorf("body = %+v", body)
+		}
+		if got := body.OverrideSettings["sd_model_checkpoint"]; got != "anime.safetensors" {
+			t.Errorf("checkpoint = %v", got)
+		}
+		if strings.HasSuffix(r.URL.Path, "/img2img") {
+			if len(body.InitImages) != 1 || body.InitImages[0] != base64.StdEncoding.EncodeToString(pngHeader) || body.DenoisingStrength != 0.6 {
+				t.Errorf("img2img body = %+v", body)
+			}
+		} else if body.InitImages != nil {
+			t.Errorf("txt2img sent init_images")
+		}
+		io.WriteString(w, `{"images":["`+base64.StdEncoding.EncodeToString(pngHeader)+`"],"info":"{\"seed\": 1234}"}`)
+	})
+
+	req := &Request{Model: "anime.safetensors", Prompt: "a cat", Size: "832x1216", GuidanceScale: 5}
+	res, err := p.Generate(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 1 || string(res.Images[0].Data) != string(pngHeader) || res.Seed != 1234 {
+		t.Errorf("result = %+v", res)
+	}
+
+	req.Image, req.Strength = pngHeader, 0.6
+	if _, err := p.(Editor).Edit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/v1/sdapi/v1/txt2img", "/v1/sdapi/v1/img2img"}; !slices.Equal(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+
+	if _, err := p.Generate(context.Background(), &Request{Prompt: "x", Size: "big"}); err == nil {
+		t.Error("invalid size accepted")
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	long := strings.Repeat("e", 2*maxErrorBody)
+	for _, typ := range []string{TypeSiliconFlow, TypeOpenAI, TypeSDWebUI} {
+		t.Run(typ, func(t *testing.T) {
+			p := newTestProvider(t, typ, "", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"message":"bad prompt"}`+long)
+			})
+			_, err := p.Generate(context.Background(), &Request{Prompt: "x", Size: "512x512"})
+			if err == nil {
+				t.Fatal("no error for a 400 response")
+			}
+			msg := err.Error()
+			if !strings.HasPrefix(msg, "400\n") || !strings.Contains(msg, "bad prompt") {
+				t.Errorf("error = %.80q", msg)
+			}
+			if len(msg) > len("400\n")+maxErrorBody {
+				t.Errorf("error body not truncated, %d bytes", len(msg))
+			}
+		})
+	}
+}
+
+func TestEmptyResult(t *testing.T) {
+	for typ, body := range map[string]string{
+		TypeSiliconFlow: `{"images":[]}`,
+		TypeOpenAI:      `{"data":[]}`,
+		TypeSDWebUI:     `{"images":[]}`,
+	} {
+		p := newTestProvider(t, typ, "", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		})
+		if _, err := p.Generate(context.Background(), &Request{Prompt: "x", Size: "512x512"}); err == nil {
+			t.Errorf("%s: no error without images", typ)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package imagegen
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// siliconFlow talks to the SiliconFlow images API
+type siliconFlow struct {
+	baseProvider
+}
+
+type siliconFlowRequest struct {
+	Model             string  `json:"model"`
+	Prompt            string  `json:"prompt"`
+	NegativePrompt    string  `json:"negative_prompt,omitempty"`
+	ImageSize         string  `json:"image_size"`
+	BatchSize         int     `json:"batch_size"`
+	Seed              *int64  `json:"seed,omitempty"`
+	NumInferenceSteps int     `json:"num_inference_steps,omitempty"`
+	GuidanceScale     float64 `json:"guidance_scale"`
+	Image             string  `json:"image,omitempty"` // data URL of the source image
+}
+
+type siliconFlowResponse struct {
+	Images []struct {
+		URL string `json:"url"`
+	} `json:"images"`
+	Timings struct {
+		Inference float64 `json:"inference"`
+	} `json:"timings"`
+	Seed int64 `json:"seed"`
+}
+
+// imagesEndpoint accepts both the API root and the full endpoint as base_url
+func imagesEndpoint(baseURL string) string {
+	if strings.HasSuffix(baseURL, "/images/generations") {
+		return baseURL
+	}
+	return baseURL + "/images/generations"
+}
+
+func (p *siliconFlow) Edit(ctx context.Context, req *Request) (*Result, error) {
+	if req.Strength != 0 {
+		return nil, fmt.Errorf("%s does not support --strength", p.name)
+	}
+	return p.Generate(ctx, req)
+}
+
+func (p *siliconFlow) Generate(ctx context.Context, req *Request) (*Result, error) {
+	body := siliconFlowRequest{
+		Model:             req.Model,
+		Prompt:            req.Prompt,
+		NegativePrompt:    req.NegativePrompt,
+		ImageSize:         req.Size,
+		BatchSize:         req.count(),
+		Seed:              req.Seed,
+		NumInferenceSteps: req.Steps,
+		GuidanceScale:     req.guidance(),
+	}
+	if req.Image != nil {
+		body.Image = dataURL(req.Image)
+	}
+	var resp siliconFlowResponse
+	if err := postJSON(ctx, p.client, imagesEndpoint(p.baseURL), bearer(p.apiKey), body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Images) == 0 {
+		return nil, fmt.Errorf("no images generated")
+	}
+
+	res := &Result{
+		Seed:      resp.Seed,
+		Inference: time.Duration(resp.Timings.Inference * float64(time.Second)),
+	}
+	for _, img := range resp.Images {
+		res.Images = append(res.Images, Image{URL: img.URL})
+	}
+	return res, nil
+}
@@ -0,0 +1,117 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// binance quotes spot pairs and USDⓈ-M perpetuals, which only exist
+// against stablecoins
+type binance struct {
+	client *http.Client
+}
+
+type binanceTicker struct {
+	Symbol    string `json:"symbol"`
+	LastPrice string `json:"lastPrice"`
+	OpenPrice string `json:"openPrice"`
+	HighPrice string `json:"highPrice"`
+	LowPrice  string `json:"lowPrice"`
+	Volume    string `json:"volume"` // base currency
+}
+
+func (s *binance) Name() string { return SourceBinance }
+
+// binanceIntervals maps candle intervals to kline intervals
+var binanceIntervals = map[time.Duration]string{
+	Interval15m: "15m",
+	Interval1h:  "1h",
+	Interval4h:  "4h",
+	Interval1d:  "1d",
+}
+
+// endpoint returns the URL of a spot or futures API path, path is given for
+// spot, e.g. ticker/24hr
+func (s *binance) endpoint(inst Instrument, path string) (string, error) {
+	switch inst.Quote {
+	case "USDT", "USDC":
+	default:
+		return "", ErrUnsupported
+	}
+	if inst.Spot {
+		return "https://api.binance.com/api/v3/" + path, nil
+	}
+	return "https://fapi.binance.com/fapi/v1/" + path, nil
+}
+
+func (s *binance) Ticker(ctx context.Context, inst Instrument) (*Ticker, error) {
+	u, err := s.endpoint(inst, "ticker/24hr")
+	if err != nil {
+		return nil, err
+	}
+	var resp binanceTicker
+	if err := getJSON(ctx, s.client, u+"?symbol="+url.QueryEscape(inst.Base+inst.Quote), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	last, err := strconv.ParseFloat(resp.LastPrice, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid price %q", resp.LastPrice)
+	}
+	return &Ticker{
+		Instrument: inst,
+		Last:       last,
+		Open24h:    parseOptional(resp.OpenPrice),
+		High24h:    parseOptional(resp.HighPrice),
+		Low24h:     parseOptional(resp.LowPrice),
+		Vol24h:     parseOptional(resp.Volume),
+	}, nil
+}
+
+func (s *binance) Candles(ctx context.Context, inst Instrument, interval time.Duration, limit int) ([]Candle, error) {
+	iv, ok := binanceIntervals[interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval %s", interval)
+	}
+	u, err := s.endpoint(inst, "klines")
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("symbol", inst.Base+inst.Quote)
+	q.Set("interval", iv)
+	q.Set("limit", strconv.Itoa(limit))
+
+	// open time, open, high, low, close, volume, ... oldest first
+	var rows [][]any
+	if err := getJSON(ctx, s.client, u+"?"+q.Encode(), nil, &rows); err != nil {
+		return nil, err
+	}
+	candles := make([]Candle, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 6 {
+			continue
+		}
+		ms, ok := row[0].(float64)
+		if !ok {
+			continue
+		}
+		field := func(i int) float64 {
+			v, _ := row[i].(string)
+			return parseOptional(v)
+		}
+		candles = append(candles, Candle{
+			Time:   time.UnixMilli(int64(ms)),
+			Open:   field(1),
+			High:   field(2),
+			Low:    field(3),
+			Close:  field(4),
+			Volume: field(5),
+		})
+	}
+	return candles, nil
+}
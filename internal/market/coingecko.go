@@ -0,0 +1,74 @@
+package market
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// coinGecko quotes the aggregated spot price of a coin. It has no
+// derivatives, swap requests are answered with the spot price so that it
+// can serve as the last resort. The optional API key is a demo key.
+type coinGecko struct {
+	apiKey string
+	client *http.Client
+}
+
+type coinGeckoMarket struct {
+	Symbol         string   `json:"symbol"`
+	CurrentPrice   float64  `json:"current_price"`
+	High24h        float64  `json:"high_24h"`
+	Low24h         float64  `json:"low_24h"`
+	PriceChange24h *float64 `json:"price_change_24h"`
+	TotalVolume    float64  `json:"total_volume"` // in the quote currency
+}
+
+func (s *coinGecko) Name() string { return SourceCoinGecko }
+
+// coinGeckoStandIns maps the stablecoins CoinGecko does not accept as
+// vs_currency to the currency they track
+var coinGeckoStandIns = map[string]string{
+	"USDT": "USD",
+	"USDC": "USD",
+}
+
+func (s *coinGecko) Ticker(ctx context.Context, inst Instrument) (*Ticker, error) {
+	approx := false
+	if quote, ok := coinGeckoStandIns[inst.Quote]; ok {
+		inst.Quote, approx = quote, true
+	}
+	q := url.Values{}
+	q.Set("vs_currency", strings.ToLower(inst.Quote))
+	q.Set("symbols", strings.ToLower(inst.Base))
+	var header http.Header
+	if s.apiKey != "" {
+		header = http.Header{}
+		header.Set("x-cg-demo-api-key", s.apiKey)
+	}
+
+	// several coins may share a symbol, the result is sorted by market cap
+	var resp []coinGeckoMarket
+	if err := getJSON(ctx, s.client, "https://api.coingecko.com/api/v3/coins/markets?"+q.Encode(), header, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 || resp[0].CurrentPrice == 0 {
+		return nil, ErrUnsupported
+	}
+
+	m := resp[0]
+	inst.Spot = true
+	t := &Ticker{
+		Instrument: inst,
+		Last:       m.CurrentPrice,
+		High24h:    m.High24h,
+		Low24h:     m.Low24h,
+		Vol24h:     m.TotalVolume / m.CurrentPrice,
+
+		Approximate: approx,
+	}
+	if m.PriceChange24h != nil {
+		t.Open24h = m.CurrentPrice - *m.PriceChange24h
+	}
+	return t, nil
+}
@@ -0,0 +1,43 @@
+package market
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxErrorBody limits how much of an error response ends up in the error
+const maxErrorBody = 256
+
+// getJSON decodes the response to a GET request into out, non-200
+// responses are returned as errors
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseOptional parses a number that a source may leave empty, 0 if it did
+func parseOptional(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
@@ -0,0 +1,202 @@
+// Package market fetches crypto prices from a list of exchanges and price
+// aggregators, falling back to the next one when a source fails.
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instrument is a trading pair, a perpetual swap unless Spot is set
+type Instrument struct {
+	Base  string
+	Quote string
+	Spot  bool
+}
+
+// String returns the OKX style instrument id, e.g. BTC-USDT-SWAP
+func (i Instrument) String() string {
+	if i.Spot {
+		return i.Base + "-" + i.Quote
+	}
+	return i.Base + "-" + i.Quote + "-SWAP"
+}
+
+type Ticker struct {
+	Instrument        // what the source actually quoted
+	Source     string // name of the source
+	Last       float64
+	Open24h    float64 // price 24 hours ago, 0 if unknown
+	High24h    float64
+	Low24h     float64
+	Vol24h     float64   // in units of the base currency
+	Time       time.Time // when it was fetched
+
+	// Approximate is set when the source quoted a stand-in for the requested
+	// quote currency, such as USD for USDT
+	Approximate bool
+}
+
+// Change24h returns the change over the last 24 hours, absolute and in
+// percent. ok is false if the source did not report the opening price.
+func (t *Ticker) Change24h() (abs float64, pct float64, ok bool) {
+	if t.Open24h <= 0 {
+		return 0, 0, false
+	}
+	abs = t.Last - t.Open24h
+	return abs, abs / t.Open24h * 100, true
+}
+
+// Source is an exchange or aggregator that quotes prices
+type Source interface {
+	Name() string
+	Ticker(ctx context.Context, inst Instrument) (*Ticker, error)
+}
+
+type Candle struct {
+	Time   time.Time // start of the interval
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64 // in units of the base currency
+}
+
+// CandleSource is implemented by sources with price history
+type CandleSource interface {
+	// Candles returns the last limit candles of interval, oldest first.
+	// interval is one of the Interval constants.
+	Candles(ctx context.Context, inst Instrument, interval time.Duration, limit int) ([]Candle, error)
+}
+
+// Candle intervals every CandleSource supports
+const (
+	Interval15m = 15 * time.Minute
+	Interval1h  = time.Hour
+	Interval4h  = 4 * time.Hour
+	Interval1d  = 24 * time.Hour
+)
+
+// ErrUnsupported is returned by sources that do not list an instrument
+var ErrUnsupported = errors.New("instrument not supported")
+
+// Source names in config.Cfg.Crypto.Sources
+const (
+	SourceOKX       = "okx"
+	SourceOKXMirror = "okx_mirror"
+	SourceBinance   = "binance"
+	SourceCoinGecko = "coingecko"
+)
+
+// New creates a source. client is used for every request, callers pass one
+// that records usage.
+func New(name string, apiKey string, client *http.Client) (Source, error) {
+	switch name {
+	case SourceOKX:
+		return &okx{name: name, baseURL: "https://www.okx.com", client: client}, nil
+	case SourceOKXMirror:
+		if apiKey == "" {
+			return nil, fmt.Errorf("%s: api key is empty", name)
+		}
+		return &okx{name: name, baseURL: "https://bot-forward.lavacreeper.net", apiKey: apiKey, client: client}, nil
+	case SourceBinance:
+		return &binance{client: client}, nil
+	case SourceCoinGecko:
+		return &coinGecko{apiKey: apiKey, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown price source %q", name)
+	}
+}
+
+// Chain asks its sources in order and caches the results for a short time,
+// so that groups asking for the same coin share one request.
+type Chain struct {
+	sources []Source
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[Instrument]*Ticker
+}
+
+func NewChain(ttl time.Duration, sources ...Source) *Chain {
+	return &Chain{
+		sources: sources,
+		ttl:     ttl,
+		cache:   make(map[Instrument]*Ticker),
+	}
+}
+
+// Sources lists the names of the sources in the order they are tried
+func (c *Chain) Sources() []string {
+	names := make([]string, len(c.sources))
+	for i, s := range c.sources {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Ticker returns the latest price of inst from the first source that has it
+func (c *Chain) Ticker(ctx context.Context, inst Instrument) (*Ticker, error) {
+	inst.Base, inst.Quote = strings.ToUpper(inst.Base), strings.ToUpper(inst.Quote)
+
+	c.mu.Lock()
+	t, ok := c.cache[inst]
+	c.mu.Unlock()
+	if ok && time.Since(t.Time) < c.ttl {
+		return t, nil
+	}
+
+	if len(c.sources) == 0 {
+		return nil, errors.New("no price source configured")
+	}
+	var errs []string
+	for _, s := range c.sources {
+		t, err := s.Ticker(ctx, inst)
+		if err == nil {
+			t.Source, t.Time = s.Name(), time.Now()
+			c.mu.Lock()
+			c.cache[inst] = t
+			c.mu.Unlock()
+			return t, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, s.Name()+": "+err.Error())
+	}
+	return nil, fmt.Errorf("%s: %s", inst, strings.Join(errs, "; "))
+}
+
+// Candles returns the price history of inst from the first source that has
+// it. History is not cached.
+func (c *Chain) Candles(ctx context.Context, inst Instrument, interval time.Duration, limit int) ([]Candle, string, error) {
+	inst.Base, inst.Quote = strings.ToUpper(inst.Base), strings.ToUpper(inst.Quote)
+
+	var errs []string
+	for _, s := range c.sources {
+		cs, ok := s.(CandleSource)
+		if !ok {
+			continue
+		}
+		candles, err := cs.Candles(ctx, inst, interval, limit)
+		if err == nil && len(candles) > 0 {
+			return candles, s.Name(), nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		if err == nil {
+			err = ErrUnsupported
+		}
+		errs = append(errs, s.Name()+": "+err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, "", errors.New("no price source with history configured")
+	}
+	return nil, "", fmt.Errorf("%s: %s", inst, strings.Join(errs, "; "))
+}
@@ -0,0 +1,151 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSource answers from fixed values and counts the requests it gets
+type fakeSource struct {
+	name    string
+	last    float64
+	err     error
+	candles []Candle
+	calls   int
+}
+
+func (s *fakeSource) Name() string { return s.name }
+
+func (s *fakeSource) Ticker(ctx context.Context, inst Instrument) (*Ticker, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &Ticker{Instrument: inst, Last: s.last}, nil
+}
+
+// fakeCandleSource also has price history
+type fakeCandleSource struct{ fakeSource }
+
+func (s *fakeCandleSource) Candles(ctx context.Context, inst Instrument, interval time.Duration, limit int) ([]Candle, error) {
+	s.calls++
+	return s.candles, s.err
+}
+
+func TestChainFallback(t *testing.T) {
+	first := &fakeSource{name: "first", err: errors.New("HTTP 500")}
+	second := &fakeSource{name: "second", last: 42}
+	third := &fakeSource{name: "third", last: 43}
+	c := NewChain(0, first, second, third)
+
+	got, err := c.Ticker(context.Background(), Instrument{Base: "btc", Quote: "usdt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != "second" || got.Last != 42 || got.Time.IsZero() {
+		t.Errorf("ticker = %+v, want 42 from second", *got)
+	}
+	if got.Base != "BTC" || got.Quote != "USDT" {
+		t.Errorf("instrument not upper cased: %s", got.Instrument)
+	}
+	if first.calls != 1 || third.calls != 0 {
+		t.Errorf("calls = %d, %d, want the first source once and the third never", first.calls, third.calls)
+	}
+	if names := c.Sources(); strings.Join(names, ",") != "first,second,third" {
+		t.Errorf("sources = %v", names)
+	}
+}
+
+func TestChainAllFail(t *testing.T) {
+	c := NewChain(0,
+		&fakeSource{name: "okx", err: ErrUnsupported},
+		&fakeSource{name: "binance", err: errors.New("HTTP 451")})
+	_, err := c.Ticker(context.Background(), Instrument{Base: "NOPE", Quote: "USDT"})
+	if err == nil {
+		t.Fatal("no error when every source failed")
+	}
+	for _, s := range []string{"NOPE-USDT-SWAP", "okx: instrument not supported", "binance: HTTP 451"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not mention %q", err, s)
+		}
+	}
+
+	if _, err := NewChain(0).Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT"}); err == nil {
+		t.Error("no error without sources")
+	}
+}
+
+func TestChainStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	first := &fakeSource{name: "first", err: context.Canceled}
+	second := &fakeSource{name: "second", last: 1}
+	if _, err := NewChain(0, first, second).Ticker(ctx, Instrument{Base: "BTC", Quote: "USDT"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if second.calls != 0 {
+		t.Error("next source asked after the context was cancelled")
+	}
+}
+
+func TestChainCache(t *testing.T) {
+	s := &fakeSource{name: "s", last: 1}
+	c := NewChain(50*time.Millisecond, s)
+	btc := Instrument{Base: "BTC", Quote: "USDT"}
+
+	a, _ := c.Ticker(context.Background(), btc)
+	s.last = 2
+	b, _ := c.Ticker(context.Background(), Instrument{Base: "btc", Quote: "usdt"})
+	if s.calls != 1 || b.Last != 1 || a != b {
+		t.Errorf("second request within the TTL: %d calls, price %v", s.calls, b.Last)
+	}
+
+	// spot and swap are cached apart
+	if _, err := c.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT", Spot: true}); err != nil || s.calls != 2 {
+		t.Errorf("spot request: %v, %d calls", err, s.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got, _ := c.Ticker(context.Background(), btc); s.calls != 3 || got.Last != 2 {
+		t.Errorf("request after the TTL: %d calls, price %v", s.calls, got.Last)
+	}
+
+	// failures are not cached
+	s.err = errors.New("down")
+	c = NewChain(time.Minute, s)
+	c.Ticker(context.Background(), btc)
+	s.err = nil
+	if got, err := c.Ticker(context.Background(), btc); err != nil || got.Last != 2 {
+		t.Errorf("request after a failure = %v, %v", got, err)
+	}
+}
+
+func TestChainCandles(t *testing.T) {
+	candles := []Candle{{Time: time.Unix(0, 0), Close: 1}, {Time: time.Unix(3600, 0), Close: 2}}
+	tickerOnly := &fakeSource{name: "coingecko", last: 1}
+	empty := &fakeCandleSource{fakeSource{name: "okx"}}
+	full := &fakeCandleSource{fakeSource{name: "binance", candles: candles}}
+	c := NewChain(0, tickerOnly, empty, full)
+
+	got, source, err := c.Candles(context.Background(), Instrument{Base: "btc", Quote: "usdt"}, Interval1h, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "binance" || len(got) != 2 {
+		t.Errorf("candles from %s: %v", source, got)
+	}
+	if tickerOnly.calls != 0 || empty.calls != 1 {
+		t.Errorf("calls = %d, %d", tickerOnly.calls, empty.calls)
+	}
+
+	_, _, err = NewChain(0, tickerOnly, empty).Candles(context.Background(), Instrument{Base: "BTC", Quote: "USDT"}, Interval1h, 2)
+	if err == nil || !strings.Contains(err.Error(), "okx: instrument not supported") {
+		t.Errorf("error = %v, want the empty answer reported as unsupported", err)
+	}
+	if _, _, err := NewChain(0, tickerOnly).Candles(context.Background(), Instrument{Base: "BTC", Quote: "USDT"}, Interval1h, 2); err == nil {
+		t.Error("no error without a source with history")
+	}
+}
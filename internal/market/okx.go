@@ -0,0 +1,139 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// okx queries the OKX v5 API directly or through the bot-forward mirror,
+// which wants an API key
+type okx struct {
+	name    string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+type okxTickerResp struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+	Data []struct {
+		InstId    string `json:"instId"`
+		Last      string `json:"last"`
+		Open24h   string `json:"open24h"`
+		High24h   string `json:"high24h"`
+		Low24h    string `json:"low24h"`
+		Vol24h    string `json:"vol24h"`    // contracts for swaps, base currency for spot
+		VolCcy24h string `json:"volCcy24h"` // base currency for swaps, quote currency for spot
+	} `json:"data"`
+}
+
+type okxCandlesResp struct {
+	Code string     `json:"code"`
+	Msg  string     `json:"msg"`
+	Data [][]string `json:"data"` // ts, o, h, l, c, vol, volCcy, ... newest first
+}
+
+// okxBars maps candle intervals to OKX bar sizes
+var okxBars = map[time.Duration]string{
+	Interval15m: "15m",
+	Interval1h:  "1H",
+	Interval4h:  "4H",
+	Interval1d:  "1Dutc",
+}
+
+func (s *okx) Name() string { return s.name }
+
+func (s *okx) header() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		header.Set("User-Agent", "Okx-Python-Client")
+		header.Set("X-API-Key", s.apiKey)
+	}
+	return header
+}
+
+func (s *okx) Ticker(ctx context.Context, inst Instrument) (*Ticker, error) {
+	var resp okxTickerResp
+	u := s.baseURL + "/api/v5/market/ticker?instId=" + url.QueryEscape(inst.String())
+	if err := getJSON(ctx, s.client, u, s.header(), &resp); err != nil {
+		return nil, err
+	}
+	if resp.Code == "51001" {
+		// Instrument ID does not exist
+		return nil, ErrUnsupported
+	}
+	if resp.Code != "0" || len(resp.Data) == 0 {
+		return nil, fmt.Errorf("API returned error: %s", resp.Msg)
+	}
+
+	d := resp.Data[0]
+	last, err := strconv.ParseFloat(d.Last, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid price %q", d.Last)
+	}
+	vol := d.VolCcy24h
+	if inst.Spot {
+		vol = d.Vol24h
+	}
+	return &Ticker{
+		Instrument: inst,
+		Last:       last,
+		Open24h:    parseOptional(d.Open24h),
+		High24h:    parseOptional(d.High24h),
+		Low24h:     parseOptional(d.Low24h),
+		Vol24h:     parseOptional(vol),
+	}, nil
+}
+
+func (s *okx) Candles(ctx context.Context, inst Instrument, interval time.Duration, limit int) ([]Candle, error) {
+	bar, ok := okxBars[interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval %s", interval)
+	}
+	q := url.Values{}
+	q.Set("instId", inst.String())
+	q.Set("bar", bar)
+	q.Set("limit", strconv.Itoa(limit))
+
+	var resp okxCandlesResp
+	if err := getJSON(ctx, s.client, s.baseURL+"/api/v5/market/candles?"+q.Encode(), s.header(), &resp); err != nil {
+		return nil, err
+	}
+	if resp.Code == "51001" {
+		return nil, ErrUnsupported
+	}
+	if resp.Code != "0" {
+		return nil, fmt.Errorf("API returned error: %s", resp.Msg)
+	}
+
+	candles := make([]Candle, 0, len(resp.Data))
+	for _, row := range slices.Backward(resp.Data) {
+		if len(row) < 7 {
+			continue
+		}
+		ms, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		vol := row[6]
+		if inst.Spot {
+			vol = row[5]
+		}
+		candles = append(candles, Candle{
+			Time:   time.UnixMilli(ms),
+			Open:   parseOptional(row[1]),
+			High:   parseOptional(row[2]),
+			Low:    parseOptional(row[3]),
+			Close:  parseOptional(row[4]),
+			Volume: parseOptional(vol),
+		})
+	}
+	return candles, nil
+}
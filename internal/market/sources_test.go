@@ -0,0 +1,259 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// fixtureTransport answers every request with a file from testdata and
+// remembers the request
+type fixtureTransport struct {
+	file string
+	req  *http.Request
+}
+
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.req = req
+	f, err := os.Open("testdata/" + t.file)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       f,
+		Request:    req,
+	}, nil
+}
+
+func newFixtureSource(t *testing.T, name string, apiKey string, file string) (Source, *fixtureTransport) {
+	t.Helper()
+	tr := &fixtureTransport{file: file}
+	s, err := New(name, apiKey, &http.Client{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tr
+}
+
+func TestOKXTicker(t *testing.T) {
+	tests := []struct {
+		file string
+		inst Instrument
+		want Ticker
+	}{
+		{
+			file: "okx_ticker_swap.json",
+			inst: Instrument{Base: "BTC", Quote: "USDT"},
+			want: Ticker{Last: 67012.3, Open24h: 66001.1, High24h: 67500, Low24h: 65800.5, Vol24h: 123456.78},
+		},
+		{
+			file: "okx_ticker_spot.json",
+			inst: Instrument{Base: "BTC", Quote: "USDT", Spot: true},
+			want: Ticker{Last: 67010, Open24h: 66000, High24h: 67499.9, Low24h: 65800, Vol24h: 12345.67},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			s, tr := newFixtureSource(t, SourceOKX, "", tt.file)
+			got, err := s.Ticker(context.Background(), tt.inst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u := tr.req.URL; u.Host != "www.okx.com" || u.Path != "/api/v5/market/ticker" || u.Query().Get("instId") != tt.inst.String() {
+				t.Errorf("request = %s", u)
+			}
+			tt.want.Instrument = tt.inst
+			if *got != tt.want {
+				t.Errorf("ticker = %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOKXMirrorHeaders(t *testing.T) {
+	s, tr := newFixtureSource(t, SourceOKXMirror, "secret", "okx_ticker_swap.json")
+	if _, err := s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.req.URL.Host != "bot-forward.lavacreeper.net" || tr.req.Header.Get("X-API-Key") != "secret" {
+		t.Errorf("request = %s %v", tr.req.URL, tr.req.Header)
+	}
+	if _, err := New(SourceOKXMirror, "", nil); err == nil {
+		t.Error("okx_mirror without api key accepted")
+	}
+}
+
+func TestOKXUnknownInstrument(t *testing.T) {
+	s, _ := newFixtureSource(t, SourceOKX, "", "okx_unknown.json")
+	if _, err := s.Ticker(context.Background(), Instrument{Base: "NOPE", Quote: "USDT"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("ticker error = %v, want ErrUnsupported", err)
+	}
+	if _, err := s.(CandleSource).Candles(context.Background(), Instrument{Base: "NOPE", Quote: "USDT"}, Interval1h, 24); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("candles error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestOKXCandles(t *testing.T) {
+	s, tr := newFixtureSource(t, SourceOKX, "", "okx_candles.json")
+	inst := Instrument{Base: "BTC", Quote: "USDT"}
+	got, err := s.(CandleSource).Candles(context.Background(), inst, Interval1h, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := tr.req.URL.Query(); q.Get("instId") != "BTC-USDT-SWAP" || q.Get("bar") != "1H" || q.Get("limit") != "3" {
+		t.Errorf("query = %v", q)
+	}
+	want := []Candle{
+		{Time: time.UnixMilli(1760601600000), Open: 66900, High: 66990, Low: 66650, Close: 66800, Volume: 480.1},
+		{Time: time.UnixMilli(1760605200000), Open: 66800, High: 67150, Low: 66700, Close: 67100, Volume: 610.2},
+		{Time: time.UnixMilli(1760608800000), Open: 67100, High: 67300, Low: 66950, Close: 67012.3, Volume: 540.5},
+	}
+	checkCandles(t, got, want)
+}
+
+func TestBinanceTicker(t *testing.T) {
+	s, tr := newFixtureSource(t, SourceBinance, "", "binance_ticker.json")
+	inst := Instrument{Base: "BTC", Quote: "USDT", Spot: true}
+	got, err := s.Ticker(context.Background(), inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := tr.req.URL; u.Host != "api.binance.com" || u.Path != "/api/v3/ticker/24hr" || u.Query().Get("symbol") != "BTCUSDT" {
+		t.Errorf("request = %s", u)
+	}
+	want := Ticker{Instrument: inst, Last: 67010, Open24h: 66000, High24h: 67500, Low24h: 65800, Vol24h: 12345.678}
+	if *got != want {
+		t.Errorf("ticker = %+v\nwant %+v", *got, want)
+	}
+
+	// perpetuals come from the futures API
+	if _, err := s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT"}); err != nil {
+		t.Fatal(err)
+	}
+	if u := tr.req.URL; u.Host != "fapi.binance.com" || u.Path != "/fapi/v1/ticker/24hr" {
+		t.Errorf("swap request = %s", u)
+	}
+
+	tr.req = nil
+	if _, err := s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "EUR"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("EUR quote error = %v, want ErrUnsupported", err)
+	}
+	if tr.req != nil {
+		t.Error("unsupported quote was requested")
+	}
+}
+
+func TestBinanceCandles(t *testing.T) {
+	s, tr := newFixtureSource(t, SourceBinance, "", "binance_klines.json")
+	got, err := s.(CandleSource).Candles(context.Background(), Instrument{Base: "ETH", Quote: "USDC"}, Interval4h, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := tr.req.URL.Query(); tr.req.URL.Path != "/fapi/v1/klines" || q.Get("symbol") != "ETHUSDC" || q.Get("interval") != "4h" || q.Get("limit") != "2" {
+		t.Errorf("request = %s", tr.req.URL)
+	}
+	want := []Candle{
+		{Time: time.UnixMilli(1760601600000), Open: 66900, High: 66990, Low: 66650, Close: 66800, Volume: 480.1},
+		{Time: time.UnixMilli(1760605200000), Open: 66800, High: 67150, Low: 66700, Close: 67100, Volume: 610.2},
+	}
+	checkCandles(t, got, want)
+}
+
+func TestCoinGeckoTicker(t *testing.T) {
+	s, tr := newFixtureSource(t, SourceCoinGecko, "demo", "coingecko_markets.json")
+	got, err := s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := tr.req.URL.Query()
+	if tr.req.URL.Path != "/api/v3/coins/markets" || q.Get("vs_currency") != "usd" || q.Get("symbols") != "btc" {
+		t.Errorf("request = %s", tr.req.URL)
+	}
+	if tr.req.Header.Get("x-cg-demo-api-key") != "demo" {
+		t.Errorf("api key header missing: %v", tr.req.Header)
+	}
+	// USDT is quoted as USD and marked, the coin with the largest market cap
+	// wins, swaps are answered with the spot price
+	want := Ticker{
+		Instrument:  Instrument{Base: "BTC", Quote: "USD", Spot: true},
+		Last:        67000,
+		Open24h:     66000,
+		High24h:     67500,
+		Low24h:      65800,
+		Vol24h:      100000,
+		Approximate: true,
+	}
+	if *got != want {
+		t.Errorf("ticker = %+v\nwant %+v", *got, want)
+	}
+
+	got, err = s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "EUR", Spot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.req.URL.Query().Get("vs_currency") != "eur" || got.Quote != "EUR" || got.Approximate {
+		t.Errorf("EUR ticker = %+v from %s", *got, tr.req.URL)
+	}
+
+	s, _ = newFixtureSource(t, SourceCoinGecko, "", "coingecko_empty.json")
+	if _, err := s.Ticker(context.Background(), Instrument{Base: "NOPE", Quote: "USDT"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("unknown coin error = %v, want ErrUnsupported", err)
+	}
+	if _, ok := s.(CandleSource); ok {
+		t.Error("coingecko claims to have candles")
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Body:       io.NopCloser(&repeatReader{b: 'x'}),
+			Request:    req,
+		}, nil
+	})}
+	s, err := New(SourceBinance, "", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Ticker(context.Background(), Instrument{Base: "BTC", Quote: "USDT"})
+	if err == nil {
+		t.Fatal("no error for a 429 response")
+	}
+	if len(err.Error()) > len("HTTP 429: ")+maxErrorBody {
+		t.Errorf("error body not truncated, %d bytes", len(err.Error()))
+	}
+}
+
+func checkCandles(t *testing.T, got, want []Candle) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d candles, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Open != want[i].Open || got[i].High != want[i].High ||
+			got[i].Low != want[i].Low || got[i].Close != want[i].Close || got[i].Volume != want[i].Volume {
+			t.Errorf("candle %d = %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// repeatReader is an endless stream of one byte
+type repeatReader struct{ b byte }
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	return len(p), nil
+}
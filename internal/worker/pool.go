@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awfufu/qbot"
+)
+
+// Pool runs a handler over incoming messages with a fixed number of workers.
+// An ordered pool gives every worker its own bounded queue and shards
+// messages by group, so messages from the same group are handled in order.
+// An unordered pool shares one queue, so a long running message only holds
+// up its own worker. Ordering only holds within one pool: once a group's
+// messages are split across pools they may be handled in any order.
+type Pool struct {
+	name    string
+	shards  []chan *qbot.Message
+	handler func(*qbot.Message)
+	wait    time.Duration // how long Submit waits for queue space, 0 drops at once
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	submitted atomic.Uint64
+	dropped   atomic.Uint64
+	handled   atomic.Uint64
+}
+
+type Stats struct {
+	Submitted uint64
+	Dropped   uint64
+	Handled   uint64
+	Queued    int
+}
+
+// NewPool starts the workers of a pool. queueSize is per worker, wait is
+// how long Submit may wait for space in a full queue.
+func NewPool(name string, workers, queueSize int, ordered bool, wait time.Duration, handler func(*qbot.Message)) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	p := &Pool{
+		name:    name,
+		handler: handler,
+		wait:    wait,
+	}
+	if ordered {
+		p.shards = make([]chan *qbot.Message, workers)
+		for i := range p.shards {
+			p.shards[i] = make(chan *qbot.Message, queueSize)
+		}
+	} else {
+		p.shards = []chan *qbot.Message{make(chan *qbot.Message, workers*queueSize)}
+	}
+	for i := range workers {
+		ch := p.shards[i%len(p.shards)]
+		p.wg.Go(func() {
+			for msg := range ch {
+				p.handler(msg)
+				p.handled.Add(1)
+			}
+		})
+	}
+	return p
+}
+
+// Submit queues msg for handling. It returns false if the pool is closed or
+// the queue stayed full for the configured wait. It never blocks longer, so
+// a busy pool cannot stall the caller's receive loop.
+func (p *Pool) Submit(msg *qbot.Message) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+
+	ch := p.shards[uint64(msg.GroupID)%uint64(len(p.shards))]
+	select {
+	case ch <- msg:
+		p.submitted.Add(1)
+		return true
+	default:
+	}
+
+	if p.wait > 0 {
+		timer := time.NewTimer(p.wait)
+		defer timer.Stop()
+		select {
+		case ch <- msg:
+			p.submitted.Add(1)
+			return true
+		case <-timer.C:
+		}
+	}
+
+	if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+		log.Printf("worker pool %s is full, %d messages dropped so far", p.name, n)
+	}
+	return false
+}
+
+// Close stops accepting messages. Messages already queued are still handled.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, ch := range p.shards {
+		close(ch)
+	}
+}
+
+// Wait blocks until every worker has exited or timeout elapses, and reports
+// whether all workers finished.
+func (p *Pool) Wait(timeout time.Duration) bool {
+	return WaitTimeout(&p.wg, timeout)
+}
+
+// WaitTimeout waits for wg and reports whether it finished before timeout.
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	queued := 0
+	for _, ch := range p.shards {
+		queued += len(ch)
+	}
+	return Stats{
+		Submitted: p.submitted.Load(),
+		Dropped:   p.dropped.Load(),
+		Handled:   p.handled.Load(),
+		Queued:    queued,
+	}
+}
+
+func (p *Pool) Name() string {
+	return p.name
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awfufu/qbot"
+)
+
+func TestPoolPerGroupOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[qbot.GroupID][]qbot.MsgID)
+	p := NewPool("test", 4, 256, true, 0, func(msg *qbot.Message) {
+		mu.Lock()
+		seen[msg.GroupID] = append(seen[msg.GroupID], msg.MsgID)
+		mu.Unlock()
+	})
+
+	const groups, perGroup = 7, 100
+	for i := range perGroup {
+		for g := range groups {
+			if !p.Submit(&qbot.Message{GroupID: qbot.GroupID(g + 1), MsgID: qbot.MsgID(i)}) {
+				t.Fatalf("message %d of group %d dropped", i, g+1)
+			}
+		}
+	}
+	p.Close()
+	if !p.Wait(5 * time.Second) {
+		t.Fatal("workers did not exit")
+	}
+
+	for g := range groups {
+		ids := seen[qbot.GroupID(g+1)]
+		if len(ids) != perGroup {
+			t.Fatalf("group %d: handled %d messages, want %d", g+1, len(ids), perGroup)
+		}
+		for i, id := range ids {
+			if id != qbot.MsgID(i) {
+				t.Fatalf("group %d: message %d handled at position %d", g+1, id, i)
+			}
+		}
+	}
+	if st := p.Stats(); st.Submitted != groups*perGroup || st.Handled != groups*perGroup || st.Dropped != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+// blockingPool returns a pool whose handler waits for release, and a channel
+// that receives each message as its handling starts
+func blockingPool(workers, queueSize int, ordered bool, wait time.Duration) (*Pool, chan *qbot.Message, chan struct{}) {
+	started := make(chan *qbot.Message, 100)
+	release := make(chan struct{})
+	p := NewPool("test", workers, queueSize, ordered, wait, func(msg *qbot.Message) {
+		started <- msg
+		<-release
+	})
+	return p, started, release
+}
+
+func TestPoolDropsWhenFull(t *testing.T) {
+	p, started, release := blockingPool(1, 2, true, 0)
+
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 1})
+	<-started // the worker holds message 1, the queue has room for 2
+	results := []bool{
+		p.Submit(&qbot.Message{GroupID: 1, MsgID: 2}),
+		p.Submit(&qbot.Message{GroupID: 1, MsgID: 3}),
+		p.Submit(&qbot.Message{GroupID: 1, MsgID: 4}),
+		p.Submit(&qbot.Message{GroupID: 2, MsgID: 5}),
+	}
+	want := []bool{true, true, false, false}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("submit %d = %v, want %v", i+2, results[i], want[i])
+		}
+	}
+	if st := p.Stats(); st.Submitted != 3 || st.Dropped != 2 || st.Queued != 2 {
+		t.Errorf("stats while full = %+v", st)
+	}
+
+	close(release)
+	p.Close()
+	if !p.Wait(5 * time.Second) {
+		t.Fatal("workers did not exit")
+	}
+	if st := p.Stats(); st.Handled != 3 || st.Queued != 0 {
+		t.Errorf("stats after close = %+v", st)
+	}
+}
+
+func TestPoolSubmitWait(t *testing.T) {
+	p, started, release := blockingPool(1, 1, true, 50*time.Millisecond)
+	defer func() {
+		close(release)
+		p.Close()
+		p.Wait(5 * time.Second)
+	}()
+
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 1})
+	<-started
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 2})
+
+	start := time.Now()
+	if p.Submit(&qbot.Message{GroupID: 1, MsgID: 3}) {
+		t.Fatal("submit to a full queue succeeded")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("submit gave up after %v, want about 50ms", d)
+	}
+
+	// room that frees up while waiting is taken
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	if !p.Submit(&qbot.Message{GroupID: 1, MsgID: 4}) {
+		t.Error("submit did not wait for the queue to drain")
+	}
+}
+
+func TestPoolUnorderedDoesNotBlock(t *testing.T) {
+	p, started, release := blockingPool(2, 4, false, 0)
+
+	// both messages of group 1 run at once on different workers
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 1})
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 2})
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("second message waited for the first")
+		}
+	}
+	close(release)
+	p.Close()
+	if !p.Wait(5 * time.Second) {
+		t.Fatal("workers did not exit")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p, started, release := blockingPool(1, 4, true, 0)
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 1})
+	<-started
+	p.Submit(&qbot.Message{GroupID: 1, MsgID: 2})
+	p.Close()
+	p.Close()
+
+	if p.Submit(&qbot.Message{GroupID: 1, MsgID: 3}) {
+		t.Error("closed pool accepted a message")
+	}
+	if p.Wait(20 * time.Millisecond) {
+		t.Error("Wait returned while a message was running")
+	}
+	close(release)
+	if !p.Wait(5 * time.Second) {
+		t.Fatal("workers did not exit")
+	}
+	if st := p.Stats(); st.Handled != 2 {
+		t.Errorf("queued message not handled after close, stats = %+v", st)
+	}
+}